@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/johnwchadwick/bigboy/gameboy"
+)
+
+var (
+	frames     int
+	inputFile  string
+	outputFile string
+	useBootrom bool
+)
+
+func init() {
+	// Parse command line
+	flag.IntVar(&frames, "frames", 60, "number of frames to run")
+	flag.StringVar(&inputFile, "input", "", "input script to apply")
+	flag.StringVar(&outputFile, "o", "screenshot.png", "output PNG file")
+	flag.BoolVar(&useBootrom, "bootrom", false, "start in bootrom")
+	flag.Parse()
+}
+
+func main() {
+	romFile := flag.Arg(0)
+	if romFile == "" {
+		log.Fatalln("usage: bigboy-png [flags] rom")
+	}
+
+	// Load ROM
+	rom, err := ioutil.ReadFile(romFile)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// Load input script
+	var script gameboy.InputScript
+	if inputFile != "" {
+		f, err := os.Open(inputFile)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		script, err = gameboy.ParseInputScript(f)
+		f.Close()
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	if err := gameboy.CheckROMSize(rom); err != nil {
+		log.Println("warning:", err)
+	}
+	cart, err := gameboy.NewCartridge(rom)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	gb := gameboy.NewMachine(cart, useBootrom)
+
+	// Run and capture
+	out, err := os.Create(outputFile)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err := gameboy.Screenshot(out, gb, frames, script); err != nil {
+		out.Close()
+		log.Fatalln(err)
+	}
+	if err := out.Close(); err != nil {
+		log.Fatalln(err)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"math/bits"
+	"unsafe"
+
+	"github.com/veandco/go-sdl2/sdl"
+)
+
+// Channel masks for 32-bit surfaces holding framebuffer words, 0xAARRGGBB.
+// SDL applies masks to native words, so they are correct on any host.
+const (
+	surfaceRMask = 0x00FF0000
+	surfaceGMask = 0x0000FF00
+	surfaceBMask = 0x000000FF
+	surfaceAMask = 0xFF000000
+)
+
+// surfaceChannel extracts the channel selected by mask from a surface pixel.
+func surfaceChannel(pixel, mask uint32) uint8 {
+	return uint8((pixel & mask) >> uint(bits.TrailingZeros32(mask)))
+}
+
+// display presents GameBoy frames in a window.
+type display interface {
+	present(framebuf *[w * h]uint32) error
+	destroy()
+}
+
+// surfaceDisplay blits frames to the window surface. It may tear.
+type surfaceDisplay struct {
+	window *sdl.Window
+	screen *sdl.Surface
+	buffer *sdl.Surface
+}
+
+func newSurfaceDisplay(window *sdl.Window) (*surfaceDisplay, error) {
+	screen, err := window.GetSurface()
+	if err != nil {
+		return nil, err
+	}
+
+	buffer, err := sdl.CreateRGBSurface(0, w, h, 32, surfaceRMask, surfaceGMask, surfaceBMask, surfaceAMask)
+	if err != nil {
+		return nil, err
+	}
+
+	return &surfaceDisplay{window, screen, buffer}, nil
+}
+
+func (d *surfaceDisplay) present(framebuf *[w * h]uint32) error {
+	// Draw framebuffer to buffer.
+	if err := d.buffer.Lock(); err != nil {
+		return err
+	}
+
+	pixels := d.buffer.Data()
+	pitch := int(d.buffer.Pitch)
+
+	for x := 0; x < w; x++ {
+		for y := 0; y < h; y++ {
+			(*[w * h]uint32)(pixels)[y*(pitch/4)+x] = framebuf[y*w+x]
+		}
+	}
+
+	d.buffer.Unlock()
+
+	// Blit to screen.
+	d.buffer.BlitScaled(&sdl.Rect{W: w, H: h}, d.screen, &sdl.Rect{W: d.screen.W, H: d.screen.H})
+	return d.window.UpdateSurface()
+}
+
+func (d *surfaceDisplay) destroy() {
+	d.buffer.Free()
+}
+
+// textureDisplay uploads frames to a streaming texture and presents them with
+// vsync, avoiding tearing.
+type textureDisplay struct {
+	renderer *sdl.Renderer
+	texture  *sdl.Texture
+}
+
+func newTextureDisplay(window *sdl.Window) (*textureDisplay, error) {
+	renderer, err := sdl.CreateRenderer(window, -1, sdl.RENDERER_ACCELERATED|sdl.RENDERER_PRESENTVSYNC)
+	if err != nil {
+		return nil, err
+	}
+
+	// The framebuffer holds 0xAARRGGBB words.
+	texture, err := renderer.CreateTexture(sdl.PIXELFORMAT_ARGB8888, sdl.TEXTUREACCESS_STREAMING, w, h)
+	if err != nil {
+		renderer.Destroy()
+		return nil, err
+	}
+
+	return &textureDisplay{renderer, texture}, nil
+}
+
+func (d *textureDisplay) present(framebuf *[w * h]uint32) error {
+	// Upload framebuffer to texture. Rows may be padded beyond the width.
+	pixels, pitch, err := d.texture.Lock(nil)
+	if err != nil {
+		return err
+	}
+
+	stride := pitch / 4
+	dst := (*[1 << 24]uint32)(unsafe.Pointer(&pixels[0]))
+
+	for y := 0; y < h; y++ {
+		copy(dst[y*stride:y*stride+w], framebuf[y*w:(y+1)*w])
+	}
+
+	d.texture.Unlock()
+
+	// Present, waiting for vblank.
+	if err := d.renderer.Clear(); err != nil {
+		return err
+	}
+	if err := d.renderer.Copy(d.texture, nil, nil); err != nil {
+		return err
+	}
+	d.renderer.Present()
+	return nil
+}
+
+func (d *textureDisplay) destroy() {
+	d.texture.Destroy()
+	d.renderer.Destroy()
+}
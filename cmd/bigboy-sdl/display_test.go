@@ -0,0 +1,22 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/johnwchadwick/bigboy/gameboy"
+)
+
+func TestSurfaceMasks(t *testing.T) {
+	gb := gameboy.NewMachine(make(gameboy.ROM, 0x8000), false)
+	gb.StepFrame()
+
+	framebuf := gb.GetFrameBuffer()
+	rgba := gb.FrameBufferRGBA()
+
+	masks := [4]uint32{surfaceRMask, surfaceGMask, surfaceBMask, surfaceAMask}
+	for i, mask := range masks {
+		if c := surfaceChannel(framebuf[0], mask); c != rgba[i] {
+			t.Errorf("mask %08x: expected %02x, got %02x", mask, rgba[i], c)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/johnwchadwick/bigboy/gameboy"
+)
+
+// emulator steps a machine in its own goroutine, paced to real time. Finished
+// frames are passed to the presenter through a pair of double-buffered
+// channels, so slow presentation never stalls emulation.
+//
+// In deterministic mode, the emulator ignores the wall clock: it runs each
+// frame as soon as a buffer is free and never drops frames, so it is paced by
+// presentation instead.
+type emulator struct {
+	gb            *gameboy.Machine
+	deterministic bool
+	pacer         *pacer
+
+	mu  sync.Mutex
+	pad gameboy.Gamepad
+
+	frames chan *[w * h]uint32
+	free   chan *[w * h]uint32
+	quit   chan struct{}
+	done   chan struct{}
+}
+
+func newEmulator(gb *gameboy.Machine, deterministic, smooth bool) *emulator {
+	e := &emulator{
+		gb:            gb,
+		deterministic: deterministic,
+		pacer:         newPacer(smooth),
+		frames:        make(chan *[w * h]uint32, 2),
+		free:          make(chan *[w * h]uint32, 2),
+		quit:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+
+	// Double buffer
+	e.free <- new([w * h]uint32)
+	e.free <- new([w * h]uint32)
+
+	return e
+}
+
+// setPad sets the gamepad state applied from the next frame on.
+func (e *emulator) setPad(pad gameboy.Gamepad) {
+	e.mu.Lock()
+	e.pad = pad
+	e.mu.Unlock()
+}
+
+// start starts the emulation goroutine.
+func (e *emulator) start() {
+	go e.run()
+}
+
+// stop stops the emulation goroutine and waits for it to exit.
+func (e *emulator) stop() {
+	close(e.quit)
+	<-e.done
+}
+
+func (e *emulator) run() {
+	defer close(e.done)
+
+	framebuf := e.gb.GetFrameBuffer()
+	display := e.gb.GetDisplayFrameBuffer()
+
+	for {
+		select {
+		case <-e.quit:
+			return
+		default:
+		}
+
+		// Clear screen.
+		for i := range framebuf {
+			framebuf[i] = 0xFFFFFFFF
+		}
+
+		// Step frame.
+		e.mu.Lock()
+		pad := e.pad
+		e.mu.Unlock()
+
+		e.gb.UpdatePad(pad)
+		frameCycles := e.gb.StepFrame()
+
+		if e.deterministic {
+			// Wait for the presenter to free a buffer.
+			select {
+			case buf := <-e.free:
+				*buf = *display
+				e.frames <- buf
+			case <-e.quit:
+				return
+			}
+			continue
+		}
+
+		// Sleep to simulate timing.
+		e.pacer.Wait((time.Duration(frameCycles) * time.Second) / cyclesPerSecond)
+
+		// Hand the frame to the presenter, dropping it if both buffers are
+		// still in use.
+		select {
+		case buf := <-e.free:
+			*buf = *display
+			e.frames <- buf
+		default:
+		}
+	}
+}
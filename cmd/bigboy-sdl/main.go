@@ -1,9 +1,12 @@
 package main
 
 import (
+	"bufio"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"os"
 	"runtime"
 	"time"
 
@@ -16,22 +19,45 @@ const (
 	h = 144
 
 	cyclesPerSecond = 4194304
+
+	// pollInterval is the longest time input goes unpolled while waiting for
+	// a frame.
+	pollInterval = 5 * time.Millisecond
 )
 
 var (
 	rom        []byte
 	trace      bool
+	traceFile  string
 	useBootrom bool
+	vsync      bool
+
+	deterministic bool
+	smooth        bool
+
+	disasm     bool
+	disasmBank int
 )
 
 func init() {
-	var err error
-
+	// SDL must be used from the main thread.
 	runtime.LockOSThread()
+}
+
+// parseFlags parses the command line and loads the ROM. It is called from main
+// rather than init, so that tests can run with their own flags.
+func parseFlags() {
+	var err error
 
 	// Parse command line
 	flag.BoolVar(&trace, "trace", false, "enables instruction tracing")
+	flag.StringVar(&traceFile, "tracefile", "", "with -trace, write the trace to this file instead of stdout")
 	flag.BoolVar(&useBootrom, "bootrom", true, "start in bootrom")
+	flag.BoolVar(&vsync, "vsync", false, "present frames with vsync to avoid tearing")
+	flag.BoolVar(&deterministic, "deterministic", false, "pace emulation by presented frames instead of the wall clock")
+	flag.BoolVar(&smooth, "smooth", false, "smooth frame pacing, compensating for late wakeups and resyncing after stalls")
+	flag.BoolVar(&disasm, "disasm", false, "print a disassembly of the rom to stdout and exit")
+	flag.IntVar(&disasmBank, "bank", 0, "with -disasm, also disassemble this rom bank")
 	flag.Parse()
 
 	// Load ROM
@@ -46,18 +72,82 @@ func init() {
 	}
 }
 
+// windowTitle returns the window title for a cartridge.
+func windowTitle(header gameboy.Header) string {
+	if header.Title == "" {
+		return "big boy"
+	}
+	return fmt.Sprintf("%s (%s) - big boy", header.Title, header.Type.Name)
+}
+
+// traceOutput is a buffered trace file.
+type traceOutput struct {
+	*bufio.Writer
+	f *os.File
+}
+
+// Close flushes the buffered trace and closes the file.
+func (t *traceOutput) Close() error {
+	err := t.Flush()
+	if cerr := t.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// setupTrace enables tracing if trace is set, writing to the file at path if
+// it is not empty. The trace is buffered; the caller must close the returned
+// output, if any, to flush it.
+func setupTrace(gb *gameboy.Machine, trace bool, path string) (*traceOutput, error) {
+	var out *traceOutput
+	if path != "" {
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+		out = &traceOutput{bufio.NewWriter(f), f}
+		gb.SetTraceWriter(out)
+	}
+	gb.SetTrace(trace)
+	return out, nil
+}
+
 func main() {
 	var event sdl.Event
 	var pad gameboy.Gamepad
 
-	// TODO: detect cart type
-	cart := gameboy.NewMBC1Cartridge(rom)
+	parseFlags()
+
+	if disasm {
+		if err := gameboy.DisassembleROM(os.Stdout, rom, disasmBank); err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	if err := gameboy.CheckROMSize(rom); err != nil {
+		log.Println("warning:", err)
+	}
+	cart, err := gameboy.NewCartridge(rom)
+	if err != nil {
+		panic(err)
+	}
 	gb := gameboy.NewMachine(cart, useBootrom)
-	gb.SetTrace(trace)
+	if out, err := setupTrace(gb, trace, traceFile); err != nil {
+		panic(err)
+	} else if out != nil {
+		// Deferred before the emulator is started, so it runs after the
+		// emulator has stopped writing to the trace.
+		defer func() {
+			if err := out.Close(); err != nil {
+				log.Println("writing trace:", err)
+			}
+		}()
+	}
 
 	// Create window
 	sdl.Init(sdl.INIT_EVERYTHING)
-	window, err := sdl.CreateWindow("big boy",
+	window, err := sdl.CreateWindow(windowTitle(gameboy.ParseHeader(rom)),
 		sdl.WINDOWPOS_UNDEFINED,
 		sdl.WINDOWPOS_UNDEFINED,
 		w*3, h*3,
@@ -67,19 +157,22 @@ func main() {
 	}
 	defer window.Destroy()
 
-	// Get screen
-	screen, err := window.GetSurface()
-	if err != nil {
-		panic(err)
+	// Create display
+	var disp display
+	if vsync {
+		disp, err = newTextureDisplay(window)
+	} else {
+		disp, err = newSurfaceDisplay(window)
 	}
-
-	buffer, err := sdl.CreateRGBSurface(0, 160, 144, 32, 0, 0, 0, 0)
 	if err != nil {
 		panic(err)
 	}
+	defer disp.destroy()
 
-	framebuf := gb.GetFrameBuffer()
-	frameTime := time.Now()
+	// Start emulation
+	emu := newEmulator(gb, deterministic, smooth)
+	emu.start()
+	defer emu.stop()
 
 MainLoop:
 	for {
@@ -134,43 +227,19 @@ MainLoop:
 			}
 		}
 
-		// Clear screen.
-		for i := range framebuf {
-			framebuf[i] = 0xFFFFFFFF
-		}
-
-		// Step frame.
-		gb.UpdatePad(pad)
-		frameCycles := gb.StepFrame()
-
-		// Sleep to simulate timing.
-		frameDuration := (time.Duration(frameCycles) * time.Second) / cyclesPerSecond
-		frameTime = frameTime.Add(frameDuration)
-		currTime := time.Now()
-		if frameTime.After(currTime) {
-			time.Sleep(frameTime.Sub(currTime))
-		}
-
-		// Draw framebuffer to buffer.
-		err = buffer.Lock()
-		pixels := buffer.Data()
+		emu.setPad(pad)
 
-		pitch := int(buffer.Pitch)
-		if err != nil {
-			panic(err)
-		}
-
-		for x := 0; x < w; x++ {
-			for y := 0; y < h; y++ {
-				(*[w * h]uint32)(pixels)[y*(pitch/4)+x] = framebuf[y*w+x]
+		// Present the next frame, if one is ready before input is polled
+		// again.
+		select {
+		case frame := <-emu.frames:
+			err := disp.present(frame)
+			emu.free <- frame
+			if err != nil {
+				panic(err)
 			}
+		case <-time.After(pollInterval):
 		}
-
-		buffer.Unlock()
-
-		// Blit to screen.
-		buffer.BlitScaled(&sdl.Rect{0, 0, w, h}, screen, &sdl.Rect{0, 0, screen.W, screen.H})
-		window.UpdateSurface()
 	}
 
 	sdl.Quit()
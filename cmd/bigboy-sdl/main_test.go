@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/johnwchadwick/bigboy/gameboy"
+)
+
+func TestSetupTrace(t *testing.T) {
+	gb := gameboy.NewMachine(make(gameboy.ROM, 0x8000), false)
+	path := filepath.Join(t.TempDir(), "trace.log")
+
+	out, err := setupTrace(gb, true, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gb.Step()
+	gb.Step()
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != 2 {
+		t.Errorf("expected 2 trace lines, got %d:\n%s", lines, data)
+	}
+	if !strings.Contains(string(data), "nop") {
+		t.Errorf("expected trace of nop, got:\n%s", data)
+	}
+
+	if _, err := setupTrace(gb, true, filepath.Join(t.TempDir(), "missing", "trace.log")); err == nil {
+		t.Error("expected error for a path that cannot be created")
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import "time"
+
+const (
+	// maxLag is how far behind real time a smoothed pacer may fall, such as
+	// after the process is suspended, before it gives up catching up.
+	maxLag = 250 * time.Millisecond
+
+	// oversleepSamples is the number of frames averaged when estimating how
+	// late sleeps wake up.
+	oversleepSamples = 8
+)
+
+// pacer paces frames to real time. Each frame is due a fixed time after the
+// previous one, so rounding and scheduler delays do not accumulate.
+//
+// A smoothed pacer also tracks a moving average of how late its sleeps wake
+// up, and sleeps that much less, so frames are presented closer to when they
+// are due. If it falls too far behind, it resynchronizes with real time
+// instead of running frames back to back to catch up.
+type pacer struct {
+	smooth bool
+
+	now   func() time.Time
+	sleep func(time.Duration)
+
+	deadline  time.Time
+	oversleep time.Duration
+}
+
+func newPacer(smooth bool) *pacer {
+	return &pacer{
+		smooth:   smooth,
+		now:      time.Now,
+		sleep:    time.Sleep,
+		deadline: time.Now(),
+	}
+}
+
+// Wait sleeps until a frame of the given duration is due.
+func (p *pacer) Wait(frame time.Duration) {
+	p.deadline = p.deadline.Add(frame)
+
+	now := p.now()
+	if p.smooth && now.Sub(p.deadline) > maxLag {
+		p.deadline = now
+		return
+	}
+
+	d := p.deadline.Sub(now)
+	if p.smooth {
+		d -= p.oversleep
+	}
+	if d <= 0 {
+		return
+	}
+
+	p.sleep(d)
+
+	if p.smooth {
+		late := p.now().Sub(now.Add(d))
+		p.oversleep += (late - p.oversleep) / oversleepSamples
+	}
+}
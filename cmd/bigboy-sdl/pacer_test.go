@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock whose sleeps always wake up late.
+type fakeClock struct {
+	t    time.Time
+	late time.Duration
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func (c *fakeClock) sleep(d time.Duration) {
+	c.t = c.t.Add(d + c.late)
+}
+
+func newTestPacer(smooth bool, clock *fakeClock) *pacer {
+	return &pacer{smooth: smooth, now: clock.now, sleep: clock.sleep, deadline: clock.t}
+}
+
+func TestPacer(t *testing.T) {
+	const frame = 16 * time.Millisecond
+
+	tests := []struct {
+		smooth bool
+		late   time.Duration // How late the last frame is presented
+	}{
+		{false, 2 * time.Millisecond},
+		{true, 0},
+	}
+
+	for _, test := range tests {
+		clock := &fakeClock{t: time.Unix(0, 0), late: 2 * time.Millisecond}
+		p := newTestPacer(test.smooth, clock)
+
+		for i := 0; i < 100; i++ {
+			p.Wait(frame)
+		}
+
+		// Lateness never accumulates, but smoothing cancels it out.
+		late := clock.t.Sub(time.Unix(0, 0).Add(100 * frame))
+		if diff := late - test.late; diff < -100*time.Microsecond || diff > 100*time.Microsecond {
+			t.Errorf("smooth=%v: expected frame %v late, got %v", test.smooth, test.late, late)
+		}
+	}
+}
+
+func TestPacerResync(t *testing.T) {
+	const frame = 16 * time.Millisecond
+
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	p := newTestPacer(true, clock)
+	p.Wait(frame)
+
+	// After a pause, the next frame runs at once, and later frames are paced
+	// from there rather than run back to back.
+	clock.t = clock.t.Add(time.Second)
+	resumed := clock.t
+	p.Wait(frame)
+	if clock.t != resumed {
+		t.Errorf("expected no sleep after a pause, slept %v", clock.t.Sub(resumed))
+	}
+
+	p.Wait(frame)
+	if slept := clock.t.Sub(resumed); slept != frame {
+		t.Errorf("expected to sleep %v after resyncing, slept %v", frame, slept)
+	}
+}
@@ -0,0 +1,79 @@
+package gameboy
+
+// MemoryRegion is a region of the GameBoy address space.
+type MemoryRegion int
+
+// Memory regions counted by AccessStats.
+const (
+	RegionROM     MemoryRegion = iota // 0x0000-0x7FFF
+	RegionVRAM                        // 0x8000-0x9FFF
+	RegionCartRAM                     // 0xA000-0xBFFF
+	RegionWRAM                        // 0xC000-0xFDFF, including echo RAM
+	RegionOAM                         // 0xFE00-0xFEFF, including the unusable area
+	RegionIO                          // 0xFF00-0xFF7F and 0xFFFF
+	RegionHRAM                        // 0xFF80-0xFFFE
+
+	numRegions
+)
+
+var regionNames = [numRegions]string{"ROM", "VRAM", "cart RAM", "WRAM", "OAM", "IO", "HRAM"}
+
+func (r MemoryRegion) String() string {
+	if r < 0 || r >= numRegions {
+		return "unknown"
+	}
+	return regionNames[r]
+}
+
+// memoryRegion returns the region containing addr.
+func memoryRegion(addr uint16) MemoryRegion {
+	switch {
+	case addr < 0x8000:
+		return RegionROM
+	case addr < 0xA000:
+		return RegionVRAM
+	case addr < 0xC000:
+		return RegionCartRAM
+	case addr < 0xFE00:
+		return RegionWRAM
+	case addr < 0xFF00:
+		return RegionOAM
+	case addr >= 0xFF80 && addr < 0xFFFF:
+		return RegionHRAM
+	}
+	return RegionIO
+}
+
+// AccessStats counts memory reads and writes through Read and Write, by
+// region. This includes CPU accesses and OAM DMA, as well as any other calls
+// to Read and Write. Peek, ReadRange and the disassembler are not counted.
+type AccessStats struct {
+	Reads  [numRegions]uint64
+	Writes [numRegions]uint64
+}
+
+// SetAccessCounting enables or disables counting of memory accesses for
+// AccessStats. Counting is disabled by default; enabling it resets the counts.
+func (gb *Machine) SetAccessCounting(enabled bool) {
+	if !enabled {
+		gb.accessStats = nil
+		return
+	}
+	gb.accessStats = &AccessStats{}
+}
+
+// AccessStats returns the memory accesses counted since counting was enabled
+// or last reset.
+func (gb *Machine) AccessStats() AccessStats {
+	if gb.accessStats == nil {
+		return AccessStats{}
+	}
+	return *gb.accessStats
+}
+
+// ResetAccessStats resets the memory access counts to zero.
+func (gb *Machine) ResetAccessStats() {
+	if gb.accessStats != nil {
+		*gb.accessStats = AccessStats{}
+	}
+}
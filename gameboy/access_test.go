@@ -0,0 +1,84 @@
+package gameboy
+
+import (
+	"io"
+	"testing"
+)
+
+func TestAccessStats(t *testing.T) {
+	// Increment a byte of WRAM, forever.
+	gb := NewMachine(newTestROM(
+		0x21, 0x00, 0xC0, // ld hl, $c000
+		0x34,       // inc (hl)
+		0x34,       // inc (hl)
+		0x34,       // inc (hl)
+		0x34,       // inc (hl)
+		0x18, 0xFA, // jr $0103
+	), false)
+
+	if stats := gb.AccessStats(); stats != (AccessStats{}) {
+		t.Errorf("expected no counts while disabled, got %+v", stats)
+	}
+
+	gb.SetAccessCounting(true)
+	gb.StepFrame()
+
+	stats := gb.AccessStats()
+	wram := stats.Reads[RegionWRAM] + stats.Writes[RegionWRAM]
+	for r := MemoryRegion(0); r < numRegions; r++ {
+		if r == RegionWRAM {
+			continue
+		}
+		if n := stats.Reads[r] + stats.Writes[r]; n >= wram {
+			t.Errorf("expected WRAM accesses (%d) to exceed %s accesses (%d)", wram, r, n)
+		}
+	}
+	if stats.Reads[RegionWRAM] != stats.Writes[RegionWRAM] {
+		t.Errorf("expected equal WRAM reads and writes, got %d and %d", stats.Reads[RegionWRAM], stats.Writes[RegionWRAM])
+	}
+	if stats.Writes[RegionROM] != 0 {
+		t.Errorf("expected no ROM writes, got %d", stats.Writes[RegionROM])
+	}
+
+	gb.ResetAccessStats()
+	if stats := gb.AccessStats(); stats != (AccessStats{}) {
+		t.Errorf("expected counts to be reset, got %+v", stats)
+	}
+
+	// Tools inspecting memory are not counted.
+	gb.Peek(0x0100)
+	gb.ReadRange(0xC000, 0x10)
+	gb.RAMSearch().FilterChanged()
+	if err := DisassembleTo(io.Discard, gb, 0x0100, 4); err != nil {
+		t.Fatal(err)
+	}
+	if stats := gb.AccessStats(); stats != (AccessStats{}) {
+		t.Errorf("expected no counts from tools, got %+v", stats)
+	}
+}
+
+func TestMemoryRegion(t *testing.T) {
+	tests := []struct {
+		addr   uint16
+		region MemoryRegion
+	}{
+		{0x0000, RegionROM},
+		{0x7FFF, RegionROM},
+		{0x8000, RegionVRAM},
+		{0xA000, RegionCartRAM},
+		{0xC000, RegionWRAM},
+		{0xE000, RegionWRAM},
+		{0xFE00, RegionOAM},
+		{0xFEFF, RegionOAM},
+		{0xFF00, RegionIO},
+		{0xFF80, RegionHRAM},
+		{0xFFFE, RegionHRAM},
+		{0xFFFF, RegionIO},
+	}
+
+	for _, test := range tests {
+		if r := memoryRegion(test.addr); r != test.region {
+			t.Errorf("$%04x: expected %s, got %s", test.addr, test.region, r)
+		}
+	}
+}
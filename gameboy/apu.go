@@ -1,21 +1,680 @@
 package gameboy
 
+const (
+	// apuClockRate is the rate at which the APU is stepped, in Hz.
+	apuClockRate = 4194304
+
+	// defaultSampleRate is the audio sample rate used until one is set.
+	defaultSampleRate = 44100
+)
+
+var (
+	// squareDuty contains the waveforms for each square wave duty setting.
+	squareDuty = [4]uint8{0x01, 0x81, 0x87, 0x7E}
+
+	// noiseDivisor maps NR43 divisor codes to timer periods.
+	noiseDivisor = [8]int{8, 16, 32, 48, 64, 80, 96, 112}
+)
+
+// apuChannel contains the state common to all sound channels.
+type apuChannel struct {
+	enabled bool
+	dac     bool
+
+	length       uint16
+	lengthMax    uint16
+	lengthEnable bool
+
+	frequency uint16
+	timer     int
+}
+
+// clockLength clocks the length counter, disabling the channel on expiry.
+func (ch *apuChannel) clockLength() {
+	if ch.lengthEnable && ch.length > 0 {
+		ch.length--
+		if ch.length == 0 {
+			ch.enabled = false
+		}
+	}
+}
+
+// setLength loads the length counter from the value written to NRx1.
+func (ch *apuChannel) setLength(value uint8) {
+	ch.length = ch.lengthMax - uint16(value)&(ch.lengthMax-1)
+}
+
+// cleared returns the channel with its registers cleared, keeping the length
+// counter.
+func (ch *apuChannel) cleared() apuChannel {
+	return apuChannel{length: ch.length, lengthMax: ch.lengthMax}
+}
+
+// trigger performs the trigger behavior common to all channels.
+func (ch *apuChannel) trigger() {
+	ch.enabled = ch.dac
+	if ch.length == 0 {
+		ch.length = ch.lengthMax
+	}
+}
+
+// apuEnvelope implements a volume envelope.
+type apuEnvelope struct {
+	initial  uint8
+	increase bool
+	period   uint8
+
+	volume  uint8
+	counter uint8
+}
+
+func (env *apuEnvelope) reg() uint8 {
+	value := env.initial<<4 | env.period
+	setBit(&value, 3, env.increase)
+	return value
+}
+
+func (env *apuEnvelope) setReg(value uint8) {
+	env.initial = value >> 4
+	env.period = value & 0x7
+	getBit(value, 3, &env.increase)
+}
+
+// dac returns whether the envelope register enables the channel's DAC.
+func (env *apuEnvelope) dac() bool {
+	return env.initial != 0 || env.increase
+}
+
+func (env *apuEnvelope) trigger() {
+	env.volume = env.initial
+	env.counter = env.period
+}
+
+func (env *apuEnvelope) clock() {
+	if env.period == 0 {
+		return
+	}
+
+	if env.counter > 0 {
+		env.counter--
+	}
+	if env.counter > 0 {
+		return
+	}
+
+	env.counter = env.period
+	if env.increase && env.volume < 15 {
+		env.volume++
+	} else if !env.increase && env.volume > 0 {
+		env.volume--
+	}
+}
+
+// squareChannel implements the square wave channels. Only square 1 has a
+// frequency sweep.
+type squareChannel struct {
+	apuChannel
+	envelope apuEnvelope
+
+	duty     uint8
+	position uint8
+
+	sweepPeriod  uint8
+	sweepNegate  bool
+	sweepShift   uint8
+	sweepEnabled bool
+	sweepCounter uint8
+	sweepShadow  uint16
+}
+
+func (ch *squareChannel) period() int {
+	return (2048 - int(ch.frequency)) * 4
+}
+
+func (ch *squareChannel) trigger() {
+	ch.apuChannel.trigger()
+	ch.timer = ch.period()
+	ch.envelope.trigger()
+
+	ch.sweepShadow = ch.frequency
+	ch.sweepCounter = ch.sweepPeriod
+	if ch.sweepCounter == 0 {
+		ch.sweepCounter = 8
+	}
+	ch.sweepEnabled = ch.sweepPeriod != 0 || ch.sweepShift != 0
+	if ch.sweepShift != 0 {
+		ch.sweepFrequency()
+	}
+}
+
+func (ch *squareChannel) step() {
+	ch.timer--
+	if ch.timer <= 0 {
+		ch.timer = ch.period()
+		ch.position = (ch.position + 1) & 7
+	}
+}
+
+// sweepFrequency calculates the next sweep frequency, disabling the channel
+// on overflow.
+func (ch *squareChannel) sweepFrequency() uint16 {
+	delta := ch.sweepShadow >> ch.sweepShift
+	frequency := ch.sweepShadow + delta
+	if ch.sweepNegate {
+		frequency = ch.sweepShadow - delta
+	}
+	if frequency > 2047 {
+		ch.enabled = false
+	}
+	return frequency
+}
+
+func (ch *squareChannel) clockSweep() {
+	if ch.sweepCounter > 0 {
+		ch.sweepCounter--
+	}
+	if ch.sweepCounter > 0 {
+		return
+	}
+
+	ch.sweepCounter = ch.sweepPeriod
+	if ch.sweepCounter == 0 {
+		ch.sweepCounter = 8
+	}
+
+	if !ch.sweepEnabled || ch.sweepPeriod == 0 {
+		return
+	}
+
+	frequency := ch.sweepFrequency()
+	if frequency <= 2047 && ch.sweepShift != 0 {
+		ch.sweepShadow = frequency
+		ch.frequency = frequency
+		ch.sweepFrequency()
+	}
+}
+
+func (ch *squareChannel) output() uint8 {
+	if !ch.enabled {
+		return 0
+	}
+	if squareDuty[ch.duty]&(0x80>>ch.position) == 0 {
+		return 0
+	}
+	return ch.envelope.volume
+}
+
+// waveChannel implements the programmable wave channel.
+type waveChannel struct {
+	apuChannel
+
+	volume   uint8
+	position uint8
+	sample   uint8
+	ram      [16]uint8
+}
+
+func (ch *waveChannel) period() int {
+	return (2048 - int(ch.frequency)) * 2
+}
+
+func (ch *waveChannel) trigger() {
+	ch.apuChannel.trigger()
+	ch.timer = ch.period()
+	ch.position = 0
+}
+
+func (ch *waveChannel) step() {
+	ch.timer--
+	if ch.timer <= 0 {
+		ch.timer = ch.period()
+		ch.position = (ch.position + 1) & 31
+		ch.sample = ch.ram[ch.position/2]
+		if ch.position&1 == 0 {
+			ch.sample >>= 4
+		}
+		ch.sample &= 0xf
+	}
+}
+
+// ramIndex returns the wave RAM byte accessed by the CPU at addr. While the
+// channel is playing, accesses go to the byte holding the current sample
+// instead, which sample playback engines rely on.
+func (ch *waveChannel) ramIndex(addr uint16) uint8 {
+	if ch.enabled {
+		return ch.position / 2
+	}
+	return uint8(addr & 0xf)
+}
+
+func (ch *waveChannel) output() uint8 {
+	if !ch.enabled || ch.volume == 0 {
+		return 0
+	}
+	return ch.sample >> (ch.volume - 1)
+}
+
+// noiseChannel implements the noise channel.
+type noiseChannel struct {
+	apuChannel
+	envelope apuEnvelope
+
+	shift   uint8
+	width7  bool
+	divisor uint8
+	lfsr    uint16
+}
+
+func (ch *noiseChannel) period() int {
+	return noiseDivisor[ch.divisor] << ch.shift
+}
+
+func (ch *noiseChannel) trigger() {
+	ch.apuChannel.trigger()
+	ch.timer = ch.period()
+	ch.envelope.trigger()
+	ch.lfsr = 0x7fff
+}
+
+func (ch *noiseChannel) step() {
+	ch.timer--
+	if ch.timer <= 0 {
+		ch.timer = ch.period()
+
+		feedback := (ch.lfsr ^ ch.lfsr>>1) & 1
+		ch.lfsr = ch.lfsr>>1 | feedback<<14
+		if ch.width7 {
+			ch.lfsr = ch.lfsr&^(1<<6) | feedback<<6
+		}
+	}
+}
+
+func (ch *noiseChannel) output() uint8 {
+	if !ch.enabled || ch.lfsr&1 != 0 {
+		return 0
+	}
+	return ch.envelope.volume
+}
+
 // APU implements the audio processing unit of the Gameboy.
 type APU struct {
-	square1 struct {
-		sweep uint8
+	power bool
+
+	square1 squareChannel
+	square2 squareChannel
+	wave    waveChannel
+	noise   noiseChannel
+
+	// Master volume and panning
+	nr50 uint8 // 0xFF24
+	nr51 uint8 // 0xFF25
+
+	// Frame sequencer
+	sequencer      uint8
+	sequencerClock int
+
+	// Output
+	sink        AudioSink
+	sampleRate  int
+	sampleClock int
+	resampler   resampler
+}
+
+// AudioSink receives stereo samples from the APU, each in the range -1 to 1.
+type AudioSink func(left, right float32)
+
+// Reset sets the APU to its power-up state.
+func (apu *APU) Reset() {
+	*apu = APU{}
+
+	apu.square1.lengthMax = 64
+	apu.square2.lengthMax = 64
+	apu.wave.lengthMax = 256
+	apu.noise.lengthMax = 64
+
+	apu.setSampleRate(defaultSampleRate)
+}
+
+func (apu *APU) Read(addr uint16) uint8 {
+	switch addr {
+	case 0xFF10:
+		value := uint8(0x80) | apu.square1.sweepPeriod<<4 | apu.square1.sweepShift
+		setBit(&value, 3, apu.square1.sweepNegate)
+		return value
+	case 0xFF11:
+		return apu.square1.duty<<6 | 0x3F
+	case 0xFF12:
+		return apu.square1.envelope.reg()
+	case 0xFF14:
+		return apu.lengthEnableReg(&apu.square1.apuChannel)
+	case 0xFF16:
+		return apu.square2.duty<<6 | 0x3F
+	case 0xFF17:
+		return apu.square2.envelope.reg()
+	case 0xFF19:
+		return apu.lengthEnableReg(&apu.square2.apuChannel)
+	case 0xFF1A:
+		value := uint8(0x7F)
+		setBit(&value, 7, apu.wave.dac)
+		return value
+	case 0xFF1C:
+		return 0x9F | apu.wave.volume<<5
+	case 0xFF1E:
+		return apu.lengthEnableReg(&apu.wave.apuChannel)
+	case 0xFF21:
+		return apu.noise.envelope.reg()
+	case 0xFF22:
+		value := apu.noise.shift<<4 | apu.noise.divisor
+		setBit(&value, 3, apu.noise.width7)
+		return value
+	case 0xFF23:
+		return apu.lengthEnableReg(&apu.noise.apuChannel)
+	case 0xFF24:
+		return apu.nr50
+	case 0xFF25:
+		return apu.nr51
+	case 0xFF26:
+		value := uint8(0x70)
+		setBit(&value, 7, apu.power)
+		setBit(&value, 3, apu.noise.enabled)
+		setBit(&value, 2, apu.wave.enabled)
+		setBit(&value, 1, apu.square2.enabled)
+		setBit(&value, 0, apu.square1.enabled)
+		return value
+	}
+
+	if addr >= 0xFF30 && addr < 0xFF40 {
+		return apu.wave.ram[apu.wave.ramIndex(addr)]
+	}
+
+	return 0xFF
+}
+
+func (apu *APU) lengthEnableReg(ch *apuChannel) uint8 {
+	value := uint8(0xBF)
+	setBit(&value, 6, ch.lengthEnable)
+	return value
+}
+
+func (apu *APU) Write(addr uint16, value uint8) {
+	if addr >= 0xFF30 && addr < 0xFF40 {
+		apu.wave.ram[apu.wave.ramIndex(addr)] = value
+		return
+	}
+
+	if addr == 0xFF26 {
+		apu.setPower(value&0x80 != 0)
+		return
+	}
+
+	if !apu.power {
+		// Registers are read-only while powered off, except that on DMG the
+		// length counters can still be written.
+		switch addr {
+		case 0xFF11:
+			apu.square1.setLength(value)
+		case 0xFF16:
+			apu.square2.setLength(value)
+		case 0xFF1B:
+			apu.wave.setLength(value)
+		case 0xFF20:
+			apu.noise.setLength(value)
+		}
+		return
+	}
+
+	switch addr {
+	// Square 1
+	case 0xFF10:
+		apu.square1.sweepPeriod = (value >> 4) & 0x7
+		apu.square1.sweepShift = value & 0x7
+		getBit(value, 3, &apu.square1.sweepNegate)
+	case 0xFF11:
+		apu.square1.duty = value >> 6
+		apu.square1.setLength(value)
+	case 0xFF12:
+		apu.setEnvelope(&apu.square1.apuChannel, &apu.square1.envelope, value)
+	case 0xFF13:
+		apu.square1.frequency = apu.square1.frequency&0x700 | uint16(value)
+	case 0xFF14:
+		apu.square1.frequency = apu.square1.frequency&0xff | uint16(value&0x7)<<8
+		getBit(value, 6, &apu.square1.lengthEnable)
+		if value&0x80 != 0 {
+			apu.square1.trigger()
+		}
+
+	// Square 2
+	case 0xFF16:
+		apu.square2.duty = value >> 6
+		apu.square2.setLength(value)
+	case 0xFF17:
+		apu.setEnvelope(&apu.square2.apuChannel, &apu.square2.envelope, value)
+	case 0xFF18:
+		apu.square2.frequency = apu.square2.frequency&0x700 | uint16(value)
+	case 0xFF19:
+		apu.square2.frequency = apu.square2.frequency&0xff | uint16(value&0x7)<<8
+		getBit(value, 6, &apu.square2.lengthEnable)
+		if value&0x80 != 0 {
+			apu.square2.trigger()
+		}
+
+	// Wave
+	case 0xFF1A:
+		getBit(value, 7, &apu.wave.dac)
+		if !apu.wave.dac {
+			apu.wave.enabled = false
+		}
+	case 0xFF1B:
+		apu.wave.setLength(value)
+	case 0xFF1C:
+		apu.wave.volume = (value >> 5) & 0x3
+	case 0xFF1D:
+		apu.wave.frequency = apu.wave.frequency&0x700 | uint16(value)
+	case 0xFF1E:
+		apu.wave.frequency = apu.wave.frequency&0xff | uint16(value&0x7)<<8
+		getBit(value, 6, &apu.wave.lengthEnable)
+		if value&0x80 != 0 {
+			apu.wave.trigger()
+		}
+
+	// Noise
+	case 0xFF20:
+		apu.noise.setLength(value)
+	case 0xFF21:
+		apu.setEnvelope(&apu.noise.apuChannel, &apu.noise.envelope, value)
+	case 0xFF22:
+		apu.noise.shift = value >> 4
+		apu.noise.divisor = value & 0x7
+		getBit(value, 3, &apu.noise.width7)
+	case 0xFF23:
+		getBit(value, 6, &apu.noise.lengthEnable)
+		if value&0x80 != 0 {
+			apu.noise.trigger()
+		}
+
+	// Control
+	case 0xFF24:
+		apu.nr50 = value
+	case 0xFF25:
+		apu.nr51 = value
+	}
+}
 
-		duty   uint8
-		length uint8
+// setEnvelope writes an envelope register, which also controls the DAC.
+func (apu *APU) setEnvelope(ch *apuChannel, env *apuEnvelope, value uint8) {
+	env.setReg(value)
+	ch.dac = env.dac()
+	if !ch.dac {
+		ch.enabled = false
+	}
+}
+
+func (apu *APU) setPower(on bool) {
+	if on && !apu.power {
+		apu.sequencer = 0
+		apu.sequencerClock = 0
+	}
+	if !on && apu.power {
+		apu.clearRegisters()
+	}
+	apu.power = on
+}
+
+// clearRegisters clears the sound registers and disables all channels, as
+// powering off the APU does. Wave RAM and, on DMG, the length counters are
+// kept.
+func (apu *APU) clearRegisters() {
+	apu.square1 = squareChannel{apuChannel: apu.square1.cleared()}
+	apu.square2 = squareChannel{apuChannel: apu.square2.cleared()}
+	apu.wave = waveChannel{apuChannel: apu.wave.cleared(), ram: apu.wave.ram}
+	apu.noise = noiseChannel{apuChannel: apu.noise.cleared()}
+	apu.nr50 = 0
+	apu.nr51 = 0
+}
+
+// restore loads the registers from 0xFF10 to 0xFF3F, as saved in a save
+// state, without the side effects of writing them: trigger bits are ignored,
+// and the order of the writes does not matter. Save states do not hold the
+// internal state of the channels, so the channels enabled in NR52 restart
+// their current note, and the others stay silent.
+func (apu *APU) restore(regs []byte) {
+	nr52 := regs[0x16]
+
+	apu.power = true
+	apu.square1.enabled = false
+	apu.square2.enabled = false
+	apu.wave.enabled = false
+	apu.noise.enabled = false
+
+	for i, value := range regs {
+		addr := 0xFF10 + uint16(i)
+		switch addr {
+		case 0xFF14, 0xFF19, 0xFF1E, 0xFF23:
+			value &^= 0x80
+		case 0xFF26:
+			continue
+		}
+		apu.Write(addr, value)
+	}
 
-		envelope uint8
-		volume   uint8
+	if nr52&0x01 != 0 {
+		apu.square1.trigger()
+	}
+	if nr52&0x02 != 0 {
+		apu.square2.trigger()
+	}
+	if nr52&0x04 != 0 {
+		apu.wave.trigger()
+	}
+	if nr52&0x08 != 0 {
+		apu.noise.trigger()
+	}
+	apu.setPower(nr52&0x80 != 0)
+}
 
-		expire     bool
-		cfrequency uint16
-		ifrequency uint16
+// clockSequencer steps the frame sequencer, which runs at 512 Hz.
+func (apu *APU) clockSequencer() {
+	switch apu.sequencer {
+	case 0, 4:
+		apu.clockLengths()
+	case 2, 6:
+		apu.clockLengths()
+		apu.square1.clockSweep()
+	case 7:
+		apu.square1.envelope.clock()
+		apu.square2.envelope.clock()
+		apu.noise.envelope.clock()
 	}
+	apu.sequencer = (apu.sequencer + 1) & 7
+}
+
+func (apu *APU) clockLengths() {
+	apu.square1.clockLength()
+	apu.square2.clockLength()
+	apu.wave.clockLength()
+	apu.noise.clockLength()
+}
+
+// mix mixes the channel outputs into a stereo sample.
+func (apu *APU) mix() (left, right float32) {
+	if !apu.power {
+		return 0, 0
+	}
+
+	channels := [4]struct {
+		dac    bool
+		output uint8
+	}{
+		{apu.square1.dac, apu.square1.output()},
+		{apu.square2.dac, apu.square2.output()},
+		{apu.wave.dac, apu.wave.output()},
+		{apu.noise.dac, apu.noise.output()},
+	}
+
+	for i, ch := range channels {
+		if !ch.dac {
+			continue
+		}
+
+		// Each DAC maps the digital range 0-15 to an analog -1 to 1.
+		analog := float32(ch.output)/7.5 - 1
+		if apu.nr51&(0x10<<uint(i)) != 0 {
+			left += analog
+		}
+		if apu.nr51&(0x01<<uint(i)) != 0 {
+			right += analog
+		}
+	}
+
+	left *= float32((apu.nr50>>4)&0x7+1) / 32
+	right *= float32(apu.nr50&0x7+1) / 32
+	return left, right
+}
+
+// step advances the APU by one clock.
+func (apu *APU) step() {
+	apu.stepOutput()
+
+	if !apu.power {
+		return
+	}
+
+	apu.sequencerClock++
+	if apu.sequencerClock == 8192 {
+		apu.sequencerClock = 0
+		apu.clockSequencer()
+	}
+
+	apu.square1.step()
+	apu.square2.step()
+	apu.wave.step()
+	apu.noise.step()
 }
 
 func (gb *Machine) stepAudio() {
+	gb.apu.step()
+}
+
+// ChannelFrequencies returns the frequency, in Hz, of each sound channel: the
+// tone frequency of the square and wave channels, and the rate at which the
+// noise channel's LFSR is clocked. Channels that are not playing report 0.
+func (gb *Machine) ChannelFrequencies() [4]float64 {
+	apu := &gb.apu
+	var freqs [4]float64
+
+	// A square wave cycles through 8 duty steps; a wave through 32 samples.
+	if apu.square1.enabled {
+		freqs[0] = apuClockRate / float64(apu.square1.period()*8)
+	}
+	if apu.square2.enabled {
+		freqs[1] = apuClockRate / float64(apu.square2.period()*8)
+	}
+	if apu.wave.enabled {
+		freqs[2] = apuClockRate / float64(apu.wave.period()*32)
+	}
+	if apu.noise.enabled {
+		freqs[3] = apuClockRate / float64(apu.noise.period())
+	}
+
+	return freqs
 }
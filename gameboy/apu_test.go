@@ -0,0 +1,460 @@
+package gameboy
+
+import (
+	"math"
+	"testing"
+)
+
+// newTestAPU returns a powered-on APU.
+func newTestAPU() *APU {
+	apu := &APU{}
+	apu.Reset()
+	apu.Write(0xFF26, 0x80)
+	return apu
+}
+
+// stepAPU steps the APU for the given number of clocks.
+func stepAPU(apu *APU, clocks int) {
+	for i := 0; i < clocks; i++ {
+		apu.step()
+	}
+}
+
+func TestAPUTriggerReloadsTimer(t *testing.T) {
+	tests := []struct {
+		name    string
+		regs    [][2]uint16
+		trigger uint16
+		timer   func(apu *APU) int
+		period  int
+	}{
+		{"square1", [][2]uint16{{0xFF12, 0xF0}, {0xFF13, 0x00}}, 0xFF14, func(apu *APU) int { return apu.square1.timer }, (2048 - 0x700) * 4},
+		{"square2", [][2]uint16{{0xFF17, 0xF0}, {0xFF18, 0x00}}, 0xFF19, func(apu *APU) int { return apu.square2.timer }, (2048 - 0x700) * 4},
+		{"wave", [][2]uint16{{0xFF1A, 0x80}, {0xFF1D, 0x00}}, 0xFF1E, func(apu *APU) int { return apu.wave.timer }, (2048 - 0x700) * 2},
+		{"noise", [][2]uint16{{0xFF21, 0xF0}, {0xFF22, 0x23}}, 0xFF23, func(apu *APU) int { return apu.noise.timer }, 48 << 2},
+	}
+
+	for _, test := range tests {
+		apu := newTestAPU()
+		for _, reg := range test.regs {
+			apu.Write(reg[0], uint8(reg[1]))
+		}
+
+		apu.Write(test.trigger, 0x87)
+		if timer := test.timer(apu); timer != test.period {
+			t.Errorf("%s: expected timer %d after trigger, got %d", test.name, test.period, timer)
+		}
+
+		stepAPU(apu, 50)
+		if timer := test.timer(apu); timer == test.period {
+			t.Errorf("%s: expected timer to advance", test.name)
+		}
+
+		apu.Write(test.trigger, 0x87)
+		if timer := test.timer(apu); timer != test.period {
+			t.Errorf("%s: expected timer %d after retrigger, got %d", test.name, test.period, timer)
+		}
+	}
+}
+
+func TestAPUTriggerAfterLengthExpiry(t *testing.T) {
+	tests := []struct {
+		name   string
+		dac    [2]uint16
+		length uint16
+		nrx4   uint16
+		status uint8
+		ch     func(apu *APU) *apuChannel
+	}{
+		{"square1", [2]uint16{0xFF12, 0xF0}, 0xFF11, 0xFF14, 0x01, func(apu *APU) *apuChannel { return &apu.square1.apuChannel }},
+		{"square2", [2]uint16{0xFF17, 0xF0}, 0xFF16, 0xFF19, 0x02, func(apu *APU) *apuChannel { return &apu.square2.apuChannel }},
+		{"wave", [2]uint16{0xFF1A, 0x80}, 0xFF1B, 0xFF1E, 0x04, func(apu *APU) *apuChannel { return &apu.wave.apuChannel }},
+		{"noise", [2]uint16{0xFF21, 0xF0}, 0xFF20, 0xFF23, 0x08, func(apu *APU) *apuChannel { return &apu.noise.apuChannel }},
+	}
+
+	for _, test := range tests {
+		apu := newTestAPU()
+		apu.Write(test.dac[0], uint8(test.dac[1]))
+
+		// Load a length of 1 and trigger with length enabled.
+		apu.Write(test.length, 0xFF)
+		apu.Write(test.nrx4, 0xC0)
+		if apu.Read(0xFF26)&test.status == 0 {
+			t.Errorf("%s: expected channel to be enabled after trigger", test.name)
+		}
+
+		// The first frame sequencer step clocks the length counters.
+		stepAPU(apu, 8192)
+		if apu.Read(0xFF26)&test.status != 0 {
+			t.Errorf("%s: expected channel to be disabled after length expiry", test.name)
+		}
+
+		apu.Write(test.nrx4, 0x80)
+		if apu.Read(0xFF26)&test.status == 0 {
+			t.Errorf("%s: expected channel to be enabled after retrigger", test.name)
+		}
+		if ch := test.ch(apu); ch.length != ch.lengthMax {
+			t.Errorf("%s: expected length %d after retrigger, got %d", test.name, ch.lengthMax, ch.length)
+		}
+	}
+}
+
+func TestAPUTriggerWithDACOff(t *testing.T) {
+	apu := newTestAPU()
+	apu.Write(0xFF12, 0x00)
+	apu.Write(0xFF14, 0x80)
+	if apu.Read(0xFF26)&0x01 != 0 {
+		t.Error("expected trigger with DAC off to leave channel disabled")
+	}
+}
+
+func TestAPUTriggerEnvelopeAndSweep(t *testing.T) {
+	apu := newTestAPU()
+	apu.Write(0xFF10, 0x21)
+	apu.Write(0xFF12, 0xA3)
+	apu.Write(0xFF13, 0x00)
+	apu.Write(0xFF14, 0x84)
+
+	if apu.square1.envelope.volume != 0xA {
+		t.Errorf("expected envelope volume 10, got %d", apu.square1.envelope.volume)
+	}
+	if apu.square1.envelope.counter != 3 {
+		t.Errorf("expected envelope counter 3, got %d", apu.square1.envelope.counter)
+	}
+	if !apu.square1.sweepEnabled || apu.square1.sweepCounter != 2 || apu.square1.sweepShadow != 0x400 {
+		t.Errorf("expected sweep enabled with counter 2 and shadow $400, got %v %d $%03x",
+			apu.square1.sweepEnabled, apu.square1.sweepCounter, apu.square1.sweepShadow)
+	}
+}
+
+func TestAudioSampleRate(t *testing.T) {
+	for _, rate := range []int{44100, 48000} {
+		gb := NewMachine(newTestROM(0x18, 0xFE), false)
+		gb.SetAudioSampleRate(rate)
+
+		samples := 0
+		gb.SetAudioSink(func(left, right float32) {
+			samples++
+		})
+
+		for gb.cpu.clock < apuClockRate {
+			gb.Step()
+		}
+
+		expected := int(uint64(gb.cpu.clock) * uint64(rate) / apuClockRate)
+		if samples < expected-1 || samples > expected+1 {
+			t.Errorf("%d Hz: expected %d samples, got %d", rate, expected, samples)
+		}
+	}
+}
+
+func TestAudioSampleRateInvalid(t *testing.T) {
+	for _, rate := range []int{0, -8000} {
+		gb := NewMachineWithOptions(newTestROM(0x18, 0xFE), Options{AudioSampleRate: rate, AudioResampler: ResampleLowPass})
+		if gb.apu.sampleRate != defaultSampleRate {
+			t.Errorf("%d Hz option: expected the default rate, got %d", rate, gb.apu.sampleRate)
+		}
+
+		gb.SetAudioSampleRate(rate)
+		if gb.apu.sampleRate != defaultSampleRate {
+			t.Errorf("%d Hz: expected the default rate, got %d", rate, gb.apu.sampleRate)
+		}
+		for _, s := range gb.CaptureAudio(100) {
+			if math.IsNaN(float64(s)) {
+				t.Errorf("%d Hz: expected valid samples, got NaN", rate)
+				break
+			}
+		}
+	}
+}
+
+// toneRMS plays a square wave on square 1 at the given frequency register
+// value and returns the RMS of the AC component of the output, sampled at 8000
+// Hz with the given resampler.
+func toneRMS(mode ResampleMode, frequency uint16) float64 {
+	apu := newTestAPU()
+	apu.setSampleRate(8000)
+	apu.setResampler(mode)
+
+	var samples []float32
+	apu.sink = func(left, right float32) {
+		samples = append(samples, left)
+	}
+
+	apu.Write(0xFF24, 0x77)
+	apu.Write(0xFF25, 0x11)
+	apu.Write(0xFF11, 0x80)
+	apu.Write(0xFF12, 0xF0)
+	apu.Write(0xFF13, uint8(frequency))
+	apu.Write(0xFF14, 0x80|uint8(frequency>>8))
+	stepAPU(apu, apuClockRate/8)
+
+	// Skip the filter warming up.
+	samples = samples[len(samples)/4:]
+
+	mean := 0.0
+	for _, s := range samples {
+		mean += float64(s)
+	}
+	mean /= float64(len(samples))
+
+	sum := 0.0
+	for _, s := range samples {
+		sum += (float64(s) - mean) * (float64(s) - mean)
+	}
+	return math.Sqrt(sum / float64(len(samples)))
+}
+
+func TestAudioResamplerLowPass(t *testing.T) {
+	// 131072/(2048-2035) = ~10 kHz, above the 4 kHz Nyquist frequency.
+	nearest := toneRMS(ResampleNearest, 2035)
+	lowpass := toneRMS(ResampleLowPass, 2035)
+	if nearest < 0.05 {
+		t.Fatalf("expected nearest to alias the tone, got RMS %f", nearest)
+	}
+	if lowpass > nearest/10 {
+		t.Errorf("expected low-pass to attenuate the tone, got RMS %f vs %f", lowpass, nearest)
+	}
+
+	// 131072/(2048-1786) = ~500 Hz, well below the cutoff.
+	nearest = toneRMS(ResampleNearest, 1786)
+	lowpass = toneRMS(ResampleLowPass, 1786)
+	if lowpass < nearest*0.8 {
+		t.Errorf("expected low-pass to pass the tone, got RMS %f vs %f", lowpass, nearest)
+	}
+
+	linear := toneRMS(ResampleLinear, 1786)
+	if linear < nearest*0.8 {
+		t.Errorf("expected linear to pass the tone, got RMS %f vs %f", linear, nearest)
+	}
+}
+
+func TestWaveSamplePlayback(t *testing.T) {
+	apu := newTestAPU()
+	apu.Write(0xFF1A, 0x80)
+	apu.Write(0xFF1C, 0x20)
+
+	// A period of 64 clocks per sample.
+	frequency := uint16(2048 - 32)
+	apu.Write(0xFF1D, uint8(frequency))
+	apu.Write(0xFF1E, 0x80|uint8(frequency>>8))
+
+	for n := uint8(0); n < 16; n++ {
+		// Rewrite the wave RAM continuously, as a playback engine would.
+		// Any address reaches the byte being played, which supplies the
+		// second of its two samples.
+		for i := 0; i < 4*64 || apu.wave.position%2 == 0; i++ {
+			apu.Write(0xFF30+uint16(i%16), n<<4|n)
+			apu.step()
+		}
+
+		if output := apu.wave.output(); output != n {
+			t.Errorf("expected output to follow written sample %d, got %d", n, output)
+		}
+	}
+
+	// With the channel stopped, accesses go to the addressed byte.
+	apu.Write(0xFF1A, 0x00)
+	apu.Write(0xFF35, 0xAB)
+	if apu.wave.ram[5] != 0xAB || apu.Read(0xFF35) != 0xAB {
+		t.Error("expected write to $ff35 to reach wave RAM byte 5")
+	}
+}
+
+func TestAPULengthWidths(t *testing.T) {
+	tests := []struct {
+		name   string
+		dac    [2]uint16
+		length uint16
+		nrx4   uint16
+		status uint8
+		steps  int
+	}{
+		{"square1", [2]uint16{0xFF12, 0xF0}, 0xFF11, 0xFF14, 0x01, 64},
+		{"square2", [2]uint16{0xFF17, 0xF0}, 0xFF16, 0xFF19, 0x02, 64},
+		{"wave", [2]uint16{0xFF1A, 0x80}, 0xFF1B, 0xFF1E, 0x04, 256},
+		{"noise", [2]uint16{0xFF21, 0xF0}, 0xFF20, 0xFF23, 0x08, 64},
+	}
+
+	for _, test := range tests {
+		apu := newTestAPU()
+		apu.Write(test.dac[0], uint8(test.dac[1]))
+
+		// A length of 0 loads the maximum length.
+		apu.Write(test.length, 0x00)
+		apu.Write(test.nrx4, 0xC0)
+
+		// Length is clocked on every other frame sequencer step, starting
+		// with the first.
+		stepAPU(apu, 8192+(test.steps-2)*16384)
+		if apu.Read(0xFF26)&test.status == 0 {
+			t.Errorf("%s: expected channel to play for %d length steps", test.name, test.steps-1)
+		}
+
+		stepAPU(apu, 16384)
+		if apu.Read(0xFF26)&test.status != 0 {
+			t.Errorf("%s: expected channel to stop after %d length steps", test.name, test.steps)
+		}
+	}
+}
+
+func TestAPUPowerOff(t *testing.T) {
+	apu := newTestAPU()
+	apu.Write(0xFF24, 0x77)
+	apu.Write(0xFF17, 0xF0)
+	apu.Write(0xFF19, 0x80)
+	apu.Write(0xFF30, 0x5A)
+
+	apu.Write(0xFF26, 0x00)
+
+	// Registers are cleared and read-only; wave RAM is kept.
+	apu.Write(0xFF24, 0x33)
+	apu.Write(0xFF17, 0xF0)
+	if v := apu.Read(0xFF24); v != 0x00 {
+		t.Errorf("expected NR50=00 while off, got %02x", v)
+	}
+	if v := apu.Read(0xFF17); v != 0x00 {
+		t.Errorf("expected NR22=00 while off, got %02x", v)
+	}
+	if v := apu.Read(0xFF26); v != 0x70 {
+		t.Errorf("expected NR52=70 while off, got %02x", v)
+	}
+	if v := apu.Read(0xFF30); v != 0x5A {
+		t.Errorf("expected wave RAM to be kept, got %02x", v)
+	}
+
+	// On DMG, length can be written while off: 64-63 leaves one step.
+	apu.Write(0xFF16, 0x3F)
+	apu.Write(0xFF26, 0x80)
+	apu.Write(0xFF17, 0xF0)
+	apu.Write(0xFF19, 0xC0)
+	if apu.Read(0xFF26)&0x02 == 0 {
+		t.Fatal("expected square 2 to play after power on")
+	}
+
+	stepAPU(apu, 8192)
+	if apu.Read(0xFF26)&0x02 != 0 {
+		t.Error("expected square 2 to stop after the length set while off")
+	}
+}
+
+func TestChannelFrequencies(t *testing.T) {
+	gb := NewMachine(newTestROM(), false)
+
+	if freqs := gb.ChannelFrequencies(); freqs != [4]float64{} {
+		t.Errorf("expected silent channels to report 0, got %v", freqs)
+	}
+
+	// Square 1 at x=1750: 131072/(2048-1750) Hz.
+	gb.Write(0xFF12, 0xF0)
+	gb.Write(0xFF13, 0xD6)
+	gb.Write(0xFF14, 0x86)
+
+	// Wave at x=1024: 65536/(2048-1024) Hz.
+	gb.Write(0xFF1A, 0x80)
+	gb.Write(0xFF1D, 0x00)
+	gb.Write(0xFF1E, 0x84)
+
+	// Noise with divisor code 0, treated as 0.5, and shift 2:
+	// 262144/(0.5*2^2) Hz.
+	gb.Write(0xFF21, 0xF0)
+	gb.Write(0xFF22, 0x20)
+	gb.Write(0xFF23, 0x80)
+
+	freqs := gb.ChannelFrequencies()
+	expected := [4]float64{131072.0 / (2048 - 1750), 0, 64, 262144 / (0.5 * 4)}
+	for i := range expected {
+		if math.Abs(freqs[i]-expected[i]) > 1e-9 {
+			t.Errorf("channel %d: expected %.3f Hz, got %.3f Hz", i+1, expected[i], freqs[i])
+		}
+	}
+}
+
+func TestNoiseDivisor(t *testing.T) {
+	tests := []struct {
+		nr43   uint8
+		period int
+	}{
+		// Divisor code 0 divides by 8, not 0.
+		{0x00, 8},
+		{0x01, 16},
+		{0x02, 32},
+		{0x07, 112},
+		{0x10, 16},
+		{0x20, 32},
+	}
+
+	for _, test := range tests {
+		apu := newTestAPU()
+		apu.Write(0xFF21, 0xF0)
+		apu.Write(0xFF22, test.nr43)
+		apu.Write(0xFF23, 0x80)
+
+		lfsr := apu.noise.lfsr
+		stepAPU(apu, test.period-1)
+		if apu.noise.lfsr != lfsr {
+			t.Errorf("NR43=%02x: expected LFSR not to clock before %d clocks", test.nr43, test.period)
+		}
+		stepAPU(apu, 1)
+		if apu.noise.lfsr == lfsr {
+			t.Errorf("NR43=%02x: expected LFSR to clock after %d clocks", test.nr43, test.period)
+		}
+	}
+}
+
+func TestWaveVolume(t *testing.T) {
+	tests := []struct {
+		nr32   uint8
+		output uint8
+	}{
+		{0x00, 0}, // Mute, not a shift of 0
+		{0x20, 0xF},
+		{0x40, 0x7},
+		{0x60, 0x3},
+	}
+
+	for _, test := range tests {
+		apu := newTestAPU()
+		for addr := uint16(0xFF30); addr < 0xFF40; addr++ {
+			apu.Write(addr, 0xFF)
+		}
+		apu.Write(0xFF1A, 0x80)
+		apu.Write(0xFF1C, test.nr32)
+		apu.Write(0xFF1D, 0x00)
+		apu.Write(0xFF1E, 0x87)
+
+		for i := 0; i < 64; i++ {
+			stepAPU(apu, apu.wave.period())
+			if out := apu.wave.output(); out != test.output {
+				t.Errorf("NR32=%02x: expected output %x, got %x", test.nr32, test.output, out)
+				break
+			}
+		}
+	}
+}
+
+func TestWaveSampleRate(t *testing.T) {
+	for _, freq := range []uint16{0, 1024, 1792, 2040} {
+		apu := newTestAPU()
+		apu.Write(0xFF1A, 0x80)
+		apu.Write(0xFF1C, 0x20)
+		apu.Write(0xFF1D, uint8(freq))
+		apu.Write(0xFF1E, 0x80|uint8(freq>>8))
+
+		// Count samples played over 1/64 of a second.
+		samples := 0
+		for i := 0; i < apuClockRate/64; i++ {
+			position := apu.wave.position
+			apu.step()
+			if apu.wave.position != position {
+				samples++
+			}
+		}
+
+		// The wave is 32 samples long.
+		hz := float64(samples*64) / 32
+		if expected := 65536 / float64(2048-freq); hz != expected {
+			t.Errorf("freq=%d: expected %.1f Hz, got %.1f Hz", freq, expected, hz)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package gameboy
+
+import "strings"
+
+const (
+	// asciiRamp maps shades, from lightest to darkest, to characters.
+	asciiRamp = " .:#"
+
+	// Each character covers a block of pixels. Blocks are twice as tall as
+	// they are wide, roughly matching the shape of terminal characters.
+	asciiBlockW = 2
+	asciiBlockH = 4
+)
+
+// RenderASCII renders the framebuffer as text, 80 columns by 36 lines, for
+// viewing in a terminal or log. Each character shows the average brightness of
+// a 2x4 block of pixels, from ' ' for the lightest shade to '#' for the
+// darkest.
+func (gb *Machine) RenderASCII() string {
+	var sb strings.Builder
+
+	for by := 0; by < 144; by += asciiBlockH {
+		for bx := 0; bx < 160; bx += asciiBlockW {
+			luma := 0
+			for y := by; y < by+asciiBlockH; y++ {
+				for x := bx; x < bx+asciiBlockW; x++ {
+					r, g, b, _ := colorRGBA(gb.ppu.screen[y*160+x])
+					luma += (int(r)*2 + int(g)*5 + int(b)) / 8
+				}
+			}
+			luma /= asciiBlockW * asciiBlockH
+
+			sb.WriteByte(asciiRamp[3-luma*4/256])
+		}
+		sb.WriteByte('\n')
+	}
+
+	return sb.String()
+}
@@ -0,0 +1,45 @@
+package gameboy
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderASCII(t *testing.T) {
+	gb := NewMachine(ROM(nil), false)
+
+	// Lightest shade on the left half, darkest on the right, with a band of
+	// the middle shades along the top.
+	for y := 0; y < 144; y++ {
+		for x := 0; x < 160; x++ {
+			shade := 0
+			if x >= 80 {
+				shade = 3
+			}
+			if y < 4 {
+				shade = 1 + x/80
+			}
+			gb.ppu.screen[y*160+x] = rgbColors[shade]
+		}
+	}
+
+	lines := strings.Split(strings.TrimSuffix(gb.RenderASCII(), "\n"), "\n")
+	if len(lines) != 36 {
+		t.Fatalf("expected 36 lines, got %d", len(lines))
+	}
+
+	tests := []struct {
+		line int
+		text string
+	}{
+		{0, strings.Repeat(".", 40) + strings.Repeat(":", 40)},
+		{1, strings.Repeat(" ", 40) + strings.Repeat("#", 40)},
+		{35, strings.Repeat(" ", 40) + strings.Repeat("#", 40)},
+	}
+
+	for _, test := range tests {
+		if lines[test.line] != test.text {
+			t.Errorf("line %d: expected %q, got %q", test.line, test.text, lines[test.line])
+		}
+	}
+}
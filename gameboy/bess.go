@@ -0,0 +1,182 @@
+package gameboy
+
+// This file implements loading of BESS (Best Effort Save State) files, as
+// written by SameBoy and other emulators.
+// See https://github.com/LIJI32/SameBoy/blob/master/BESS.md
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+var (
+	errBESSFooter = errors.New("bess: missing footer")
+	errBESSCore   = errors.New("bess: missing CORE block")
+)
+
+// cartRAM is implemented by cartridges with external RAM.
+type cartRAM interface {
+	ramBytes() []byte
+}
+
+// bessBlock is a single block of a BESS file.
+type bessBlock struct {
+	name string
+	data []byte
+}
+
+// readBESSBlocks reads the blocks of a BESS file, up to the END block.
+func readBESSBlocks(file []byte) ([]bessBlock, error) {
+	if len(file) < 8 || string(file[len(file)-4:]) != "BESS" {
+		return nil, errBESSFooter
+	}
+
+	var blocks []bessBlock
+
+	offset := uint64(binary.LittleEndian.Uint32(file[len(file)-8:]))
+	for {
+		if offset+8 > uint64(len(file)) {
+			return nil, fmt.Errorf("bess: block header at %#x out of range", offset)
+		}
+
+		name := string(file[offset : offset+4])
+		size := uint64(binary.LittleEndian.Uint32(file[offset+4:]))
+		offset += 8
+
+		if offset+size > uint64(len(file)) {
+			return nil, fmt.Errorf("bess: %q block out of range", name)
+		}
+
+		if name == "END " {
+			return blocks, nil
+		}
+
+		blocks = append(blocks, bessBlock{name, file[offset : offset+size]})
+		offset += size
+	}
+}
+
+// bessBuffer returns the buffer referenced by the size and offset pair at the
+// start of ref.
+func bessBuffer(file []byte, ref []byte) ([]byte, error) {
+	size := uint64(binary.LittleEndian.Uint32(ref[0:]))
+	offset := uint64(binary.LittleEndian.Uint32(ref[4:]))
+
+	if offset+size > uint64(len(file)) {
+		return nil, fmt.Errorf("bess: buffer at %#x out of range", offset)
+	}
+
+	return file[offset : offset+size], nil
+}
+
+// RestoreBESS loads a BESS save state. Only the state this emulator models is
+// restored; unknown blocks are ignored.
+func (gb *Machine) RestoreBESS(r io.Reader) error {
+	file, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	blocks, err := readBESSBlocks(file)
+	if err != nil {
+		return err
+	}
+
+	// The CORE block must come first, after the optional NAME and INFO.
+	var core []byte
+	for _, block := range blocks {
+		if block.name == "NAME" || block.name == "INFO" {
+			continue
+		}
+		if block.name == "CORE" {
+			core = block.data
+		}
+		break
+	}
+	if core == nil {
+		return errBESSCore
+	}
+	if len(core) < 0xD0 {
+		return fmt.Errorf("bess: CORE block too short (%d bytes)", len(core))
+	}
+	if major := binary.LittleEndian.Uint16(core[0:]); major != 1 {
+		return fmt.Errorf("bess: unsupported major version %d", major)
+	}
+	if core[4] != 'G' {
+		return fmt.Errorf("bess: unsupported model %q", core[4:8])
+	}
+
+	// Resolve buffers before touching any state.
+	var buffers [5][]byte
+	for i := range buffers {
+		buffers[i], err = bessBuffer(file, core[0x98+i*8:])
+		if err != nil {
+			return err
+		}
+	}
+	ram, vram, mbcram, oam, hram := buffers[0], buffers[1], buffers[2], buffers[3], buffers[4]
+
+	// Registers
+	gb.cpu.pc = binary.LittleEndian.Uint16(core[8:])
+	gb.cpu.setAF(binary.LittleEndian.Uint16(core[10:]))
+	gb.cpu.setBC(binary.LittleEndian.Uint16(core[12:]))
+	gb.cpu.setDE(binary.LittleEndian.Uint16(core[14:]))
+	gb.cpu.setHL(binary.LittleEndian.Uint16(core[16:]))
+	gb.cpu.sp = binary.LittleEndian.Uint16(core[18:])
+	gb.cpu.ime = core[20] != 0
+	gb.cpu.imeScheduled = false
+	gb.cpu.ie = core[21]
+	gb.cpu.halt = core[22] == 1
+	gb.cpu.stop = core[22] == 2
+
+	// Memory-mapped registers. The APU registers are restored directly, as
+	// writing them would trigger channels.
+	regs := core[24 : 24+0x80]
+	gb.apu.restore(regs[0x10:0x40])
+	for i, value := range regs {
+		addr := uint16(0xFF00 + i)
+		if addr >= 0xFF10 && addr < 0xFF40 {
+			continue
+		}
+		switch addr {
+		case 0xFF04:
+			gb.cpu.div = uint16(value) << 8
+		case 0xFF44:
+			gb.ppu.ly = value
+			gb.ppu.lx = 0
+			gb.ppu.clock = int(value) * 456
+		case 0xFF46:
+			// Do not start a DMA transfer.
+		case 0xFF50:
+			if value != 0 {
+				gb.lockBootROM()
+			}
+		default:
+			gb.bus.Write(addr, value)
+		}
+	}
+
+	// Memory
+	copy(gb.wram[:], ram)
+	copy(gb.ppu.vram[:], vram)
+	copy(gb.ppu.oam[:], oam)
+	copy(gb.cpu.hram[:], hram)
+	if cart, ok := gb.cart.(cartRAM); ok {
+		copy(cart.ramBytes(), mbcram)
+	}
+
+	// Mapper registers
+	for _, block := range blocks {
+		if block.name != "MBC " {
+			continue
+		}
+		for i := 0; i+3 <= len(block.data); i += 3 {
+			gb.bus.Write(binary.LittleEndian.Uint16(block.data[i:]), block.data[i+2])
+		}
+	}
+
+	return nil
+}
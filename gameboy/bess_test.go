@@ -0,0 +1,192 @@
+package gameboy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// bessWriter builds BESS files for tests.
+type bessWriter struct {
+	bytes.Buffer
+}
+
+// buffer appends raw data and returns its size and offset.
+func (w *bessWriter) buffer(data []byte) [2]uint32 {
+	offset := uint32(w.Len())
+	w.Write(data)
+	return [2]uint32{uint32(len(data)), offset}
+}
+
+// block appends a block.
+func (w *bessWriter) block(name string, data []byte) uint32 {
+	offset := uint32(w.Len())
+	w.WriteString(name)
+	binary.Write(w, binary.LittleEndian, uint32(len(data)))
+	w.Write(data)
+	return offset
+}
+
+// newBESSFixture creates a small BESS file for a DMG.
+func newBESSFixture() []byte {
+	var io [0x80]byte
+	io[0x40] = 0x91
+	io[0x47] = 0xE4
+	return newBESSFile(io)
+}
+
+// newBESSFile creates a BESS file for a DMG with the given memory-mapped
+// registers.
+func newBESSFile(io [0x80]byte) []byte {
+	var w bessWriter
+
+	wram := make([]byte, 0x2000)
+	copy(wram[0x0123:], "WRAM")
+	vram := make([]byte, 0x2000)
+	copy(vram[0x1800:], "VRAM")
+	oam := make([]byte, 0xA0)
+	oam[0] = 0x42
+	hram := make([]byte, 0x7F)
+	hram[0x10] = 0x99
+
+	buffers := [][2]uint32{
+		w.buffer(wram),
+		w.buffer(vram),
+		w.buffer(nil),
+		w.buffer(oam),
+		w.buffer(hram),
+		w.buffer(nil),
+		w.buffer(nil),
+	}
+
+	core := make([]byte, 0xD0)
+	binary.LittleEndian.PutUint16(core[0:], 1)
+	binary.LittleEndian.PutUint16(core[2:], 1)
+	copy(core[4:], "GD  ")
+	binary.LittleEndian.PutUint16(core[8:], 0x0150)
+	binary.LittleEndian.PutUint16(core[10:], 0x12B0)
+	binary.LittleEndian.PutUint16(core[12:], 0x3456)
+	binary.LittleEndian.PutUint16(core[14:], 0x789A)
+	binary.LittleEndian.PutUint16(core[16:], 0xBCDE)
+	binary.LittleEndian.PutUint16(core[18:], 0xDFF0)
+	core[20] = 1
+	core[21] = 0x05
+	copy(core[24:], io[:])
+	for i, b := range buffers {
+		binary.LittleEndian.PutUint32(core[0x98+i*8:], b[0])
+		binary.LittleEndian.PutUint32(core[0x98+i*8+4:], b[1])
+	}
+
+	first := w.block("NAME", []byte("bigboy test"))
+	w.block("CORE", core)
+	w.block("END ", nil)
+
+	binary.Write(&w, binary.LittleEndian, first)
+	w.WriteString("BESS")
+
+	return w.Bytes()
+}
+
+func TestRestoreBESS(t *testing.T) {
+	gb := NewMachine(ROM(nil), false)
+
+	if err := gb.RestoreBESS(bytes.NewReader(newBESSFixture())); err != nil {
+		t.Fatal(err)
+	}
+
+	s := gb.GetCPUState()
+	if s.PC != 0x0150 || s.SP != 0xDFF0 || gb.cpu.af() != 0x12B0 || gb.cpu.bc() != 0x3456 || gb.cpu.de() != 0x789A || gb.cpu.hl() != 0xBCDE {
+		t.Errorf("unexpected registers %+v", s)
+	}
+	if !s.IME || s.IE != 0x05 {
+		t.Errorf("expected ime=true ie=05, got ime=%v ie=%02x", s.IME, s.IE)
+	}
+
+	memory := []struct {
+		addr  uint16
+		value uint8
+	}{
+		{0xC123, 'W'}, {0xC126, 'M'},
+		{0x9800, 'V'}, {0x9803, 'M'},
+		{0xFE00, 0x42},
+		{0xFF90, 0x99},
+		{0xFF40, 0x91},
+		{0xFF47, 0xE4},
+	}
+	for _, m := range memory {
+		if v := gb.Read(m.addr); v != m.value {
+			t.Errorf("expected (%04x)=%02x, got %02x", m.addr, m.value, v)
+		}
+	}
+}
+
+func TestRestoreBESSAudio(t *testing.T) {
+	// Play a note on square 1. Square 2 was triggered last, but has since
+	// been silenced.
+	writes := []struct {
+		addr  uint16
+		value uint8
+	}{
+		{0xFF24, 0x77}, {0xFF25, 0xFF},
+		{0xFF16, 0x80}, {0xFF17, 0xF0}, {0xFF18, 0x00}, {0xFF19, 0x87}, {0xFF17, 0x00},
+		{0xFF11, 0x80}, {0xFF12, 0xF0}, {0xFF13, 0x00}, {0xFF14, 0x87},
+	}
+
+	gb := NewMachine(newTestROM(0x18, 0xFE), false)
+	var io [0x80]byte
+	for _, w := range writes {
+		gb.Write(w.addr, w.value)
+		io[w.addr-0xFF00] = w.value
+	}
+	io[0x17] = 0xF0 // NR22 as the game last wrote it, before the DAC was cut.
+	for i := 0; i < 1000; i++ {
+		gb.Step()
+	}
+	io[0x26] = gb.Read(0xFF26)
+
+	restored := NewMachine(newTestROM(0x18, 0xFE), false)
+	if err := restored.RestoreBESS(bytes.NewReader(newBESSFile(io))); err != nil {
+		t.Fatal(err)
+	}
+
+	if a, b := restored.Read(0xFF26), gb.Read(0xFF26); a != b {
+		t.Errorf("expected NR52=%02x, got %02x", b, a)
+	}
+	if ch := restored.apu.square1; !ch.enabled || ch.frequency != 0x700 || ch.envelope.volume != 15 {
+		t.Errorf("expected square 1 playing at frequency 700 and volume 15, got enabled=%v frequency=%03x volume=%d", ch.enabled, ch.frequency, ch.envelope.volume)
+	}
+	if restored.apu.square2.enabled {
+		t.Error("expected square 2 not to be retriggered")
+	}
+	if v := restored.Read(0xFF24); v != 0x77 {
+		t.Errorf("expected NR50=77, got %02x", v)
+	}
+
+	samples := restored.CaptureAudio(200)
+	lo, hi := samples[0], samples[0]
+	for _, s := range samples {
+		if s < lo {
+			lo = s
+		}
+		if s > hi {
+			hi = s
+		}
+	}
+	if hi-lo < 0.1 {
+		t.Errorf("expected the note to keep playing, got samples from %f to %f", lo, hi)
+	}
+}
+
+func TestRestoreBESSInvalid(t *testing.T) {
+	gb := NewMachine(ROM(nil), false)
+
+	if err := gb.RestoreBESS(bytes.NewReader([]byte("not a save state"))); err == nil {
+		t.Error("expected error for missing footer")
+	}
+
+	file := newBESSFixture()
+	file[len(file)-8] = 0xFF
+	if err := gb.RestoreBESS(bytes.NewReader(file)); err == nil {
+		t.Error("expected error for bad block offset")
+	}
+}
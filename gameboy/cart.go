@@ -0,0 +1,182 @@
+package gameboy
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CartridgeTypeInfo describes a cartridge type, as given by the cartridge type
+// byte at 0x0147 in the ROM header.
+type CartridgeTypeInfo struct {
+	Type    uint8
+	Name    string
+	Battery bool
+	RTC     bool
+	Rumble  bool
+}
+
+// Cartridge is a cartridge created by NewCartridge.
+type Cartridge interface {
+	IO
+
+	// HasBattery returns whether the cartridge RAM is battery-backed, and
+	// so should be saved. Volatile cartridge RAM is lost at power off.
+	HasBattery() bool
+
+	// Reset returns the mapper registers to their power-on state. The
+	// contents of cartridge RAM are kept.
+	Reset()
+}
+
+// cartridgeType is a supported cartridge type and its constructor.
+type cartridgeType struct {
+	CartridgeTypeInfo
+	new func(rom []byte, info CartridgeTypeInfo) Cartridge
+}
+
+var cartridgeTypes = []cartridgeType{
+	{CartridgeTypeInfo{Type: 0x00, Name: "ROM ONLY"}, newROMCartridge},
+	{CartridgeTypeInfo{Type: 0x01, Name: "MBC1"}, newMBC1Cartridge},
+	{CartridgeTypeInfo{Type: 0x02, Name: "MBC1+RAM"}, newMBC1Cartridge},
+	{CartridgeTypeInfo{Type: 0x03, Name: "MBC1+RAM+BATTERY", Battery: true}, newMBC1Cartridge},
+	{CartridgeTypeInfo{Type: 0x19, Name: "MBC5"}, newMBC5Cartridge},
+	{CartridgeTypeInfo{Type: 0x1A, Name: "MBC5+RAM"}, newMBC5Cartridge},
+	{CartridgeTypeInfo{Type: 0x1B, Name: "MBC5+RAM+BATTERY", Battery: true}, newMBC5Cartridge},
+	{CartridgeTypeInfo{Type: 0x1C, Name: "MBC5+RUMBLE", Rumble: true}, newMBC5Cartridge},
+	{CartridgeTypeInfo{Type: 0x1D, Name: "MBC5+RUMBLE+RAM", Rumble: true}, newMBC5Cartridge},
+	{CartridgeTypeInfo{Type: 0x1E, Name: "MBC5+RUMBLE+RAM+BATTERY", Battery: true, Rumble: true}, newMBC5Cartridge},
+}
+
+func newROMCartridge(rom []byte, info CartridgeTypeInfo) Cartridge {
+	return ROM(rom)
+}
+
+func newMBC1Cartridge(rom []byte, info CartridgeTypeInfo) Cartridge {
+	cart := NewMBC1Cartridge(rom)
+	cart.battery = info.Battery
+	return cart
+}
+
+func newMBC5Cartridge(rom []byte, info CartridgeTypeInfo) Cartridge {
+	cart := NewMBC5Cartridge(rom)
+	cart.battery = info.Battery
+	return cart
+}
+
+// bankedCartridge is implemented by cartridges with bank switching.
+type bankedCartridge interface {
+	CurrentROMBank() uint
+	CurrentRAMBank() uint
+}
+
+// CartridgeState describes the banks currently mapped by the cartridge.
+type CartridgeState struct {
+	ROMBank uint // Mapped at 0x4000-0x7FFF
+	RAMBank uint // Mapped at 0xA000-0xBFFF
+}
+
+// CartridgeState returns the banks currently mapped by the cartridge.
+// Cartridges without a mapper always report ROM bank 1 and RAM bank 0.
+func (gb *Machine) CartridgeState() CartridgeState {
+	if cart, ok := gb.cart.(bankedCartridge); ok {
+		return CartridgeState{cart.CurrentROMBank(), cart.CurrentRAMBank()}
+	}
+	return CartridgeState{ROMBank: 1}
+}
+
+// SupportedCartridgeTypes returns the cartridge types that can be loaded by
+// NewCartridge.
+func SupportedCartridgeTypes() []CartridgeTypeInfo {
+	types := make([]CartridgeTypeInfo, len(cartridgeTypes))
+	for i, t := range cartridgeTypes {
+		types[i] = t.CartridgeTypeInfo
+	}
+	return types
+}
+
+// lookupCartridgeType finds a supported cartridge type by header byte.
+func lookupCartridgeType(t uint8) (cartridgeType, bool) {
+	for _, ct := range cartridgeTypes {
+		if ct.Type == t {
+			return ct, true
+		}
+	}
+	return cartridgeType{}, false
+}
+
+// NewCartridge creates a cartridge for the given ROM, based on the cartridge
+// type in its header. ROMs too short to contain a header are treated as ROM
+// only. The ROM size in the header is not checked; use CheckROMSize for that.
+func NewCartridge(rom []byte) (Cartridge, error) {
+	t := uint8(0x00)
+	if len(rom) > 0x0147 {
+		t = rom[0x0147]
+	}
+
+	ct, ok := lookupCartridgeType(t)
+	if !ok {
+		return nil, fmt.Errorf("unsupported cartridge type $%02x", t)
+	}
+
+	return ct.new(rom, ct.CartridgeTypeInfo), nil
+}
+
+// CheckROMSize returns an error if the ROM size declared in the header does
+// not match the length of the ROM, which usually indicates a bad dump. ROMs too
+// short to contain a header are not checked.
+func CheckROMSize(rom []byte) error {
+	if len(rom) <= 0x0148 {
+		return nil
+	}
+
+	size, ok := romSize[rom[0x0148]]
+	if !ok {
+		return fmt.Errorf("unknown ROM size $%02x in header", rom[0x0148])
+	}
+	if uint(len(rom)) != size {
+		return fmt.Errorf("header declares %d KiB of ROM, but the ROM is %d KiB", size/1024, len(rom)/1024)
+	}
+
+	return nil
+}
+
+// Header contains fields parsed from the cartridge header.
+type Header struct {
+	Title string
+	Type  CartridgeTypeInfo
+}
+
+// ParseHeader parses the cartridge header of the given ROM. The title is
+// trimmed of padding and stripped of non-printable characters. If the
+// cartridge type is unsupported, Type has an empty Name.
+func ParseHeader(rom []byte) Header {
+	var h Header
+
+	if len(rom) > 0x0147 {
+		h.Type.Type = rom[0x0147]
+		if ct, ok := lookupCartridgeType(h.Type.Type); ok {
+			h.Type = ct.CartridgeTypeInfo
+		}
+	}
+
+	if len(rom) >= 0x0144 {
+		h.Title = sanitizeTitle(rom[0x0134:0x0144])
+	}
+
+	return h
+}
+
+// sanitizeTitle converts the title bytes from a header to a string. The title
+// ends at the first NUL; other bytes outside of printable ASCII are dropped.
+func sanitizeTitle(b []byte) string {
+	var sb strings.Builder
+	for _, c := range b {
+		if c == 0x00 {
+			break
+		}
+		if c >= 0x20 && c < 0x7F {
+			sb.WriteByte(c)
+		}
+	}
+	return strings.TrimSpace(sb.String())
+}
@@ -0,0 +1,218 @@
+package gameboy
+
+import "testing"
+
+func TestSupportedCartridgeTypes(t *testing.T) {
+	supported := map[uint8]CartridgeTypeInfo{}
+	for _, info := range SupportedCartridgeTypes() {
+		supported[info.Type] = info
+	}
+
+	tests := []struct {
+		t       uint8
+		listed  bool
+		battery bool
+	}{
+		{0x00, true, false},
+		{0x01, true, false},
+		{0x03, true, true},
+		{0xFC, false, false},
+	}
+
+	for _, test := range tests {
+		info, ok := supported[test.t]
+		if ok != test.listed {
+			t.Errorf("type $%02x: expected listed %v, got %v", test.t, test.listed, ok)
+			continue
+		}
+		if ok && info.Battery != test.battery {
+			t.Errorf("type $%02x: expected battery %v, got %v", test.t, test.battery, info.Battery)
+		}
+		if ok && info.Name == "" {
+			t.Errorf("type $%02x: expected a name", test.t)
+		}
+	}
+}
+
+func TestNewCartridge(t *testing.T) {
+	rom := newTestROM()
+
+	cart, err := NewCartridge(rom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cart.(ROM); !ok {
+		t.Errorf("type $00: expected ROM, got %T", cart)
+	}
+
+	rom[0x0147] = 0x01
+	cart, err = NewCartridge(rom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cart.(*MBC1Cartridge); !ok {
+		t.Errorf("type $01: expected *MBC1Cartridge, got %T", cart)
+	}
+
+	rom[0x0147] = 0xFC
+	if _, err := NewCartridge(rom); err == nil {
+		t.Error("type $fc: expected error")
+	}
+}
+
+func TestCartridgeState(t *testing.T) {
+	rom := newTestCartROM(8, 0x03, 0x03)
+	gb := NewMachine(NewMBC1Cartridge(rom), false)
+
+	tests := []struct {
+		addr  uint16
+		value uint8
+		state CartridgeState
+	}{
+		{0x2000, 0x05, CartridgeState{5, 0}},
+		// The secondary register selects the upper bits of the ROM bank,
+		// which wraps to the 8 banks of the ROM: $45 maps bank 5.
+		{0x4000, 0x02, CartridgeState{5, 2}},
+		// Selecting bank 0 maps bank 1.
+		{0x2000, 0x00, CartridgeState{1, 2}},
+		{0x2000, 0x07, CartridgeState{7, 2}},
+	}
+
+	for _, test := range tests {
+		gb.Write(test.addr, test.value)
+		if state := gb.CartridgeState(); state != test.state {
+			t.Errorf("$%02x to $%04x: expected %+v, got %+v", test.value, test.addr, test.state, state)
+		}
+		if bank := gb.Read(0x4000); uint(bank) != test.state.ROMBank {
+			t.Errorf("$%02x to $%04x: expected bank %d mapped, got %d", test.value, test.addr, test.state.ROMBank, bank)
+		}
+	}
+
+	gb = NewMachine(newTestROM(), false)
+	if state := gb.CartridgeState(); state != (CartridgeState{ROMBank: 1}) {
+		t.Errorf("ROM only: expected bank 1, got %+v", state)
+	}
+}
+
+func TestMBC1BankRegisters(t *testing.T) {
+	cart := NewMBC1Cartridge(newTestCartROM(128, 0x01, 0x00))
+
+	tests := []struct {
+		addr  uint16
+		value uint8
+		bank  uint
+	}{
+		{0x2000, 0x01, 0x01},
+		// Only the low 5 bits are latched, so $20 selects bank 0, and so 1.
+		{0x2000, 0x20, 0x01},
+		{0x2000, 0x3F, 0x1F},
+		{0x4000, 0x01, 0x3F},
+		{0x2000, 0x20, 0x21},
+		{0x4000, 0x03, 0x61},
+		{0x2000, 0x01, 0x61},
+	}
+
+	for _, test := range tests {
+		cart.Write(test.addr, test.value)
+		if bank := cart.CurrentROMBank(); bank != test.bank {
+			t.Errorf("$%02x to $%04x: expected bank $%02x, got $%02x", test.value, test.addr, test.bank, bank)
+		}
+		if bank := cart.Read(0x4000); uint(bank) != test.bank {
+			t.Errorf("$%02x to $%04x: expected bank $%02x mapped, got $%02x", test.value, test.addr, test.bank, bank)
+		}
+	}
+}
+
+func TestParseHeader(t *testing.T) {
+	tests := []struct {
+		title []byte
+		want  string
+	}{
+		{[]byte("TETRIS"), "TETRIS"},
+		{[]byte("POKEMON RED\x00\x00\x00\x00\x00"), "POKEMON RED"},
+		// The CGB flag shares the last byte of the title.
+		{[]byte("ZELDA DX\x00\x00\x00AZ7E\x80"), "ZELDA DX"},
+		{[]byte("  PADDED\x7F\x01  "), "PADDED"},
+		{[]byte("\xff\xfeA\tB"), "AB"},
+		{[]byte{}, ""},
+	}
+
+	for _, test := range tests {
+		rom := newTestROM()
+		copy(rom[0x0134:0x0144], test.title)
+		if h := ParseHeader(rom); h.Title != test.want {
+			t.Errorf("%q: expected title %q, got %q", test.title, test.want, h.Title)
+		}
+	}
+
+	rom := newTestROM()
+	rom[0x0147] = 0x1B
+	if h := ParseHeader(rom); h.Type.Name != "MBC5+RAM+BATTERY" {
+		t.Errorf("type $1b: expected MBC5+RAM+BATTERY, got %q", h.Type.Name)
+	}
+
+	if h := ParseHeader(nil); h != (Header{}) {
+		t.Errorf("empty ROM: expected empty header, got %+v", h)
+	}
+}
+
+func TestCheckROMSize(t *testing.T) {
+	tests := []struct {
+		banks int
+		size  uint8
+		ok    bool
+	}{
+		{2, 0x00, true},
+		{32, 0x04, true},
+		// A 512 KiB ROM claiming to be 1 MiB.
+		{32, 0x05, false},
+		{4, 0x00, false},
+		{4, 0x0F, false},
+	}
+
+	for _, test := range tests {
+		rom := newTestCartROM(test.banks, 0x19, 0x00)
+		rom[0x0148] = test.size
+		if err := CheckROMSize(rom); (err == nil) != test.ok {
+			t.Errorf("%d banks, size $%02x: expected ok %v, got %v", test.banks, test.size, test.ok, err)
+		}
+	}
+
+	if err := CheckROMSize(nil); err != nil {
+		t.Errorf("no header: expected ok, got %v", err)
+	}
+}
+
+func TestROMBankWrap(t *testing.T) {
+	// Selecting a bank past the end of a 4 bank ROM wraps around.
+	cart := NewMBC5Cartridge(newTestCartROM(4, 0x19, 0x00))
+	cart.Write(0x2000, 0x06)
+	if bank := cart.Read(0x4000); bank != 2 {
+		t.Errorf("expected bank 6 to map bank 2, got %d", bank)
+	}
+}
+
+func TestCartridgeHasBattery(t *testing.T) {
+	tests := []struct {
+		t       uint8
+		battery bool
+	}{
+		{0x00, false},
+		{0x01, false},
+		{0x02, false},
+		{0x03, true},
+		{0x1A, false},
+		{0x1B, true},
+		{0x1E, true},
+	}
+
+	for _, test := range tests {
+		cart, err := NewCartridge(newTestCartROM(4, test.t, 0x02))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cart.HasBattery() != test.battery {
+			t.Errorf("type $%02x: expected battery %v, got %v", test.t, test.battery, cart.HasBattery())
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package gameboy
+
+import "fmt"
+
+// cartCloner is implemented by cartridges that can be copied by Clone.
+type cartCloner interface {
+	clone() IO
+}
+
+func (rom ROM) clone() IO {
+	// ROM is never written, so it can be shared.
+	return rom
+}
+
+func (cart *MBC1Cartridge) clone() IO {
+	c := *cart
+	c.ram = append([]byte(nil), cart.ram...)
+	return &c
+}
+
+func (cart *MBC5Cartridge) clone() IO {
+	c := *cart
+	c.ram = append([]byte(nil), cart.ram...)
+	c.onRumble = nil
+	return &c
+}
+
+// Clone returns an independent copy of the machine, including the cartridge
+// RAM and bank state, which can be stepped without affecting the original.
+// Opcode hooks are kept, as they are passed the machine they run on, but other
+// callbacks, tracing, audio output and GIF recording are not copied. It
+// returns an error if the cartridge cannot be copied.
+func (gb *Machine) Clone() (*Machine, error) {
+	cart, ok := gb.cart.(cartCloner)
+	if !ok {
+		return nil, fmt.Errorf("cannot clone cartridge of type %T", gb.cart)
+	}
+
+	c := new(Machine)
+	*c = *gb
+	c.cart = cart.clone()
+
+	// Point the bus at the copied components.
+	for i, io := range c.bus.io {
+		switch io.(type) {
+		case nil:
+		case *CPU:
+			c.bus.io[i] = &c.cpu
+		case *PPU:
+			c.bus.io[i] = &c.ppu
+		case *APU:
+			c.bus.io[i] = &c.apu
+		case *WRAM:
+			c.bus.io[i] = &c.wram
+		case *unimplementedIO:
+			c.bus.io[i] = &c.unimplemented
+		default:
+			// Anything else is the cartridge, or the boot ROM while it is
+			// mapped.
+			if gb.bootLocked || i >= len(gb.bootROM) {
+				c.bus.io[i] = c.cart
+			}
+		}
+	}
+
+	c.unimplemented.gb = c
+	if gb.unimplemented.accesses != nil {
+		c.unimplemented.accesses = make(map[uint16]*UnimplementedAccess, len(gb.unimplemented.accesses))
+		for addr, access := range gb.unimplemented.accesses {
+			a := *access
+			c.unimplemented.accesses[addr] = &a
+		}
+	}
+
+	if gb.history != nil {
+		h := *gb.history
+		h.records = make([]stepRecord, len(gb.history.records))
+		for i, r := range gb.history.records {
+			r.writes = append([]MemoryByte(nil), r.writes...)
+			h.records[i] = r
+		}
+		c.history = &h
+	}
+
+	c.stateAddrs = append([]uint16(nil), gb.stateAddrs...)
+	c.sgb.command = append([]byte(nil), gb.sgb.command...)
+
+	if gb.accessStats != nil {
+		stats := *gb.accessStats
+		c.accessStats = &stats
+	}
+
+	c.onBootHandoff = nil
+	c.onFrame = nil
+	c.cpu.onStackViolation = nil
+	c.cpu.trace = false
+	c.cpu.traceOut = nil
+	c.cpu.traceWriter = nil
+	c.cpu.traceVBlanks = 0
+	c.apu.sink = nil
+	c.gif = nil
+
+	return c, nil
+}
@@ -0,0 +1,89 @@
+package gameboy
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestClone(t *testing.T) {
+	// Count in cartridge RAM and switch ROM banks, forever.
+	rom := newTestCartROM(4, 0x1B, 0x02)
+	copy(rom[0x100:], []byte{
+		0x3E, 0x0A, // ld a, $0a
+		0xEA, 0x00, 0x00, // ld ($0000), a
+		0x21, 0x00, 0xA0, // ld hl, $a000
+		0x34,       // inc (hl)
+		0x7E,       // ld a, (hl)
+		0xE6, 0x03, // and $03
+		0xEA, 0x00, 0x20, // ld ($2000), a
+		0x18, 0xF7, // jr $0108
+	})
+	cart, err := NewCartridge(rom)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gb := NewMachine(cart, false)
+	for i := 0; i < 20; i++ {
+		gb.Step()
+	}
+
+	clone, err := gb.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state, counter, bank := gb.GetCPUState(), gb.Read(0xA000), gb.CartridgeState()
+	if !reflect.DeepEqual(clone.GetCPUState(), state) || clone.Read(0xA000) != counter {
+		t.Fatal("expected clone to match the original")
+	}
+
+	for i := 0; i < 100; i++ {
+		clone.Step()
+	}
+	clone.Write(0xC000, 0x55)
+
+	if !reflect.DeepEqual(gb.GetCPUState(), state) {
+		t.Errorf("expected original CPU state %+v, got %+v", state, gb.GetCPUState())
+	}
+	if v := gb.Read(0xA000); v != counter {
+		t.Errorf("expected original cartridge RAM %02x, got %02x", counter, v)
+	}
+	if s := gb.CartridgeState(); s != bank {
+		t.Errorf("expected original banks %+v, got %+v", bank, s)
+	}
+	if v := gb.Read(0xC000); v == 0x55 {
+		t.Error("expected original work RAM to be unaffected")
+	}
+	if v := clone.Read(0xA000); v == counter {
+		t.Error("expected clone to keep counting")
+	}
+
+	// The original keeps running as before.
+	gb.Step()
+	if pc := gb.GetCPUState().PC; pc == state.PC {
+		t.Error("expected original to step independently")
+	}
+}
+
+func TestCloneTrace(t *testing.T) {
+	var buf bytes.Buffer
+	gb := NewMachine(newTestROM(), false)
+	gb.SetTraceWriter(&buf)
+	gb.SetTrace(true)
+
+	clone, err := gb.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clone.Step()
+	if buf.Len() != 0 {
+		t.Errorf("expected clone not to trace, got:\n%s", buf.String())
+	}
+
+	gb.Step()
+	if buf.Len() == 0 {
+		t.Error("expected original to keep tracing")
+	}
+}
@@ -1,6 +1,11 @@
 package gameboy
 
-import "fmt"
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
 
 // Interrupt bits (for irq/ie)
 const (
@@ -20,15 +25,17 @@ const (
 	allFlags      = carryFlag | halfCarryFlag | subtractFlag | zeroFlag
 )
 
-var (
-	interruptVectorMap = map[uint8]uint16{
-		intVBlank:  0x0040,
-		intLCDStat: 0x0048,
-		intTimer:   0x0050,
-		intSerial:  0x0058,
-		intGamepad: 0x0060,
-	}
-)
+// interruptVectors lists interrupts and their vectors in priority order.
+var interruptVectors = []struct {
+	flag   uint8
+	vector uint16
+}{
+	{intVBlank, 0x0040},
+	{intLCDStat, 0x0048},
+	{intTimer, 0x0050},
+	{intSerial, 0x0058},
+	{intGamepad, 0x0060},
+}
 
 // CPU implements the GameBoy DMG processor.
 type CPU struct {
@@ -41,77 +48,110 @@ type CPU struct {
 	sp uint16
 	pc uint16
 
+	// Address of the instruction being executed
+	oppc uint16
+
 	// High RAM
 	hram [127]byte
 
 	// Interrupts
-	irq uint8
-	ie  uint8
-	ime bool
+	irq          uint8
+	ie           uint8
+	ime          bool
+	imeScheduled bool // Set by EI, to enable IME after the next instruction
 
 	// Processor state
-	clock uint
-	halt  bool
-	stop  bool
+	clock   uint
+	halt    bool
+	haltBug bool // The next opcode fetch does not increment PC
+	stop    bool
+
+	// Cycles run by the CPU but not yet ticked, with an external clock
+	pendingCycles uint
 
 	// Gamepad state
 	gamepad Gamepad
 	button  bool
 	dpad    bool
+	padLow  uint8 // Input lines P10-P13 that were low when last checked
 
 	// DMA state
 	dma      bool
 	dmabank  uint8
 	dmaindex uint16
+	dmavalue uint8
 
 	// Timer state
 	timer, tima, tma uint8
-	div              uint
+	div              uint16 // Internal counter; DIV is the upper byte
+	timerSignal      bool   // Selected counter bit, ANDed with the enable
+
+	// Recently executed instructions, a ring buffer
+	recent      [recentInstructions]RecentInstruction
+	recentPos   int
+	recentCount int
 
 	// Debug state
-	trace bool
+	trace            bool
+	traceOut         io.Writer // Set by TraceNextFrame; traceWriter if nil
+	traceWriter      io.Writer // Standard output if nil
+	traceVBlanks     int       // Stop tracing after this many VBlanks
+	stackCheck       bool
+	stackLo, stackHi uint16
+	onStackViolation func(sp uint16)
+}
+
+// readPad returns the state of the input lines P10-P13 for the selected rows.
+// A line is low while a button on a selected row is pressed.
+func (cpu *CPU) readPad() uint8 {
+	value := uint8(0xF)
+
+	// Button bits
+	button := uint8(0xF)
+	setBit(&button, 0, !cpu.gamepad.A)
+	setBit(&button, 1, !cpu.gamepad.B)
+	setBit(&button, 2, !cpu.gamepad.Select)
+	setBit(&button, 3, !cpu.gamepad.Start)
+	if cpu.button {
+		value &= button
+	}
+
+	// DPad bits
+	dpad := uint8(0xF)
+	setBit(&dpad, 0, !cpu.gamepad.Right)
+	setBit(&dpad, 1, !cpu.gamepad.Left)
+	setBit(&dpad, 2, !cpu.gamepad.Up)
+	setBit(&dpad, 3, !cpu.gamepad.Down)
+	if cpu.dpad {
+		value &= dpad
+	}
+
+	return value
+}
+
+// checkPad requests the joypad interrupt when an input line goes low, either
+// from a button press or from selecting a row with a button held. Reading
+// 0xFF00 has no effect on the interrupt.
+func (gb *Machine) checkPad() {
+	low := ^gb.cpu.readPad() & 0xF
+	if low&^gb.cpu.padLow != 0 {
+		gb.Interrupt(intGamepad)
+	}
+	gb.cpu.padLow = low
 }
 
 func (cpu *CPU) Read(addr uint16) uint8 {
 	switch {
 	case addr == 0xFF00:
-		value := uint8(0xF)
-
-		// Button bits
-		button := uint8(0xF)
-		setBit(&button, 0, !cpu.gamepad.A)
-		setBit(&button, 1, !cpu.gamepad.B)
-		setBit(&button, 2, !cpu.gamepad.Select)
-		setBit(&button, 3, !cpu.gamepad.Start)
-		if cpu.button {
-			value &= button
-		}
-
-		// DPad bits
-		dpad := uint8(0xF)
-		setBit(&dpad, 0, !cpu.gamepad.Right)
-		setBit(&dpad, 1, !cpu.gamepad.Left)
-		setBit(&dpad, 2, !cpu.gamepad.Up)
-		setBit(&dpad, 3, !cpu.gamepad.Down)
-		if cpu.dpad {
-			value &= dpad
-		}
-
-		// Fire interrupt if anything pressed
-		if value != 0xF {
-			cpu.ie |= intGamepad
-		}
+		value := cpu.readPad()
 
 		// Select bits
 		setBit(&value, 4, !cpu.dpad)
 		setBit(&value, 5, !cpu.button)
 
 		return value
-	case addr == 0xFF01 || addr == 0xFF02:
-		// Serial bus not implemented
-		return 0xFF
 	case addr == 0xFF04:
-		return uint8(cpu.div)
+		return uint8(cpu.div >> 8)
 	case addr == 0xFF05:
 		return cpu.tima
 	case addr == 0xFF06:
@@ -120,10 +160,12 @@ func (cpu *CPU) Read(addr uint16) uint8 {
 		return cpu.timer
 	case addr == 0xFF0F:
 		return cpu.irq
+	case addr == 0xFF46:
+		return cpu.dmabank
 	case addr >= 0xFF80 && addr < 0xFFFF:
 		return cpu.hram[addr&0x7F]
 	case addr == 0xFFFF:
-		return cpu.ie & 0x1f
+		return cpu.ie
 	}
 	return 0xFF
 }
@@ -150,13 +192,53 @@ func (cpu *CPU) Write(addr uint16, value uint8) {
 	case addr >= 0xFF80 && addr < 0xFFFF:
 		cpu.hram[addr&0x7F] = value
 	case addr == 0xFFFF:
-		cpu.ie = value & 0x1f
+		cpu.ie = value
+	}
+}
+
+// cpuRead reads a byte from memory on behalf of the CPU. While OAM DMA is
+// active, the transfer occupies the bus holding its source, so CPU reads from
+// that bus see the byte being copied instead, and OAM reads return 0xFF.
+func (gb *Machine) cpuRead(addr uint16) uint8 {
+	if gb.dmaConflict(addr) {
+		return gb.cpu.dmavalue
+	}
+	if gb.cpu.dma && addr >= 0xFE00 && addr < 0xFEA0 {
+		return 0xFF
+	}
+	if !gb.relaxedPPUAccess && !gb.ppu.accessible(addr) {
+		return 0xFF
 	}
+	return gb.Read(addr)
+}
+
+// cpuWrite writes a byte to memory for the CPU. Writes to VRAM or OAM while
+// the PPU is using it are ignored.
+func (gb *Machine) cpuWrite(addr uint16, value uint8) {
+	if !gb.relaxedPPUAccess && !gb.ppu.accessible(addr) {
+		return
+	}
+	gb.Write(addr, value)
+}
+
+// dmaConflict returns whether a CPU access to addr is on the same bus as the
+// active OAM DMA source.
+func (gb *Machine) dmaConflict(addr uint16) bool {
+	if !gb.cpu.dma || addr >= 0xFE00 {
+		return false
+	}
+	return isVRAMBus(addr) == isVRAMBus(uint16(gb.cpu.dmabank)<<8)
+}
+
+// isVRAMBus returns whether an address is on the video RAM bus, rather than
+// the external bus.
+func isVRAMBus(addr uint16) bool {
+	return addr >= 0x8000 && addr < 0xA000
 }
 
 // cpuFetch fetches a byte from pc and increments pc
 func (gb *Machine) cpuFetch() uint8 {
-	val := gb.Read(gb.cpu.pc)
+	val := gb.cpuRead(gb.cpu.pc)
 	gb.cpu.pc++
 	gb.stepCycle()
 
@@ -165,7 +247,7 @@ func (gb *Machine) cpuFetch() uint8 {
 
 // cpuFetchSigned fetches a signed byte from pc and increments pc
 func (gb *Machine) cpuFetchSigned() int8 {
-	val := int8(gb.Read(gb.cpu.pc))
+	val := int8(gb.cpuRead(gb.cpu.pc))
 	gb.cpu.pc++
 	gb.stepCycle()
 
@@ -174,11 +256,11 @@ func (gb *Machine) cpuFetchSigned() int8 {
 
 // cpuFetch16 fetches a dword from pc and increments pc
 func (gb *Machine) cpuFetch16() uint16 {
-	val := uint16(gb.Read(gb.cpu.pc)) << 0
+	val := uint16(gb.cpuRead(gb.cpu.pc)) << 0
 	gb.cpu.pc++
 	gb.stepCycle()
 
-	val |= uint16(gb.Read(gb.cpu.pc)) << 8
+	val |= uint16(gb.cpuRead(gb.cpu.pc)) << 8
 	gb.cpu.pc++
 	gb.stepCycle()
 
@@ -188,29 +270,44 @@ func (gb *Machine) cpuFetch16() uint16 {
 // cpuPush pushes a dword onto the stack.
 func (gb *Machine) cpuPush(dword uint16) {
 	gb.cpu.sp--
-	gb.Write(gb.cpu.sp, uint8(dword>>8))
+	gb.cpuWrite(gb.cpu.sp, uint8(dword>>8))
 	gb.stepCycle()
 
 	gb.cpu.sp--
-	gb.Write(gb.cpu.sp, uint8(dword>>0))
+	gb.cpuWrite(gb.cpu.sp, uint8(dword>>0))
 	gb.stepCycle()
+
+	gb.checkStack()
 }
 
 // cpuPop pops a dword off of the stack.
 func (gb *Machine) cpuPop() uint16 {
 	var value uint16
 
-	value |= uint16(gb.Read(gb.cpu.sp)) << 0
+	value |= uint16(gb.cpuRead(gb.cpu.sp)) << 0
 	gb.cpu.sp++
 	gb.stepCycle()
 
-	value |= uint16(gb.Read(gb.cpu.sp)) << 8
+	value |= uint16(gb.cpuRead(gb.cpu.sp)) << 8
 	gb.cpu.sp++
 	gb.stepCycle()
 
+	gb.checkStack()
+
 	return value
 }
 
+// checkStack calls the stack violation callback if stack checking is enabled
+// and SP is outside of the stack bounds.
+func (gb *Machine) checkStack() {
+	if !gb.cpu.stackCheck || gb.cpu.onStackViolation == nil {
+		return
+	}
+	if gb.cpu.sp < gb.cpu.stackLo || gb.cpu.sp > gb.cpu.stackHi {
+		gb.cpu.onStackViolation(gb.cpu.sp)
+	}
+}
+
 // Interrupt sets an interrupt request.
 func (gb *Machine) Interrupt(i uint8) {
 	if gb.cpu.ie&i != 0 && gb.cpu.halt {
@@ -219,55 +316,53 @@ func (gb *Machine) Interrupt(i uint8) {
 	gb.cpu.irq |= i
 }
 
-// cpuInterrupt runs an interupt vector.
+// cpuInterrupt runs an interupt vector. Servicing an interrupt takes 5
+// M-cycles: two internal delays, two to push PC and one to set PC.
 func (gb *Machine) cpuInterrupt(vector uint16) {
 	// Set flags to stop interrupts.
 	gb.cpu.ime = false
 
-	// Push the program counter onto the stack.
-	gb.cpuPush(gb.cpu.pc)
+	gb.stepCycle()
+	gb.stepCycle()
+
+	// Push the program counter onto the stack. If HALT exited with the HALT
+	// bug pending, as after EI; HALT, the interrupt returns to the HALT.
+	ret := gb.cpu.pc
+	if gb.cpu.haltBug {
+		gb.cpu.haltBug = false
+		ret--
+	}
+	gb.cpuPush(ret)
 
 	// Set PC to vector.
 	gb.cpu.pc = vector
+	gb.stepCycle()
+}
+
+// timerBits maps the TAC clock select to the bit of the internal counter that
+// clocks TIMA.
+var timerBits = [4]uint16{
+	1 << 9, // 4096 Hz
+	1 << 3, // 262144 Hz
+	1 << 5, // 65536 Hz
+	1 << 7, // 16384 Hz
 }
 
+// checkTimers advances the internal counter. TIMA is incremented on a falling
+// edge of the selected counter bit ANDed with the timer enable, so writes to
+// DIV or TAC that clear the signal also increment TIMA.
 func (gb *Machine) checkTimers() {
-	// TODO(john): Implement proper timings and behavior.
-	// See http://gbdev.gg8.se/wiki/articles/Timer_Obscure_Behaviour
-
-	// Only update div every 256th clock.
-	if gb.cpu.clock&0xff == 0 {
-		gb.cpu.div++
-	}
-
-	// Figure out how often timer should fire.
-	mask := uint(0)
-	switch gb.cpu.timer & 0x7 {
-	case 0x5:
-		// 262144 Hz
-		mask = 0x00f
-	case 0x6:
-		// 65536 Hz
-		mask = 0x03f
-	case 0x7:
-		// 16384 Hz
-		mask = 0x0ff
-	case 0x4:
-		// 4096 Hz
-		mask = 0x3ff
-	default:
-		// Disabled
-		return
-	}
+	gb.cpu.div++
 
-	// Increment tima.
-	if gb.cpu.clock&mask == 0 {
+	signal := gb.cpu.timer&0x4 != 0 && gb.cpu.div&timerBits[gb.cpu.timer&0x3] != 0
+	if gb.cpu.timerSignal && !signal {
 		gb.cpu.tima++
 		if gb.cpu.tima == 0 {
 			gb.cpu.tima = gb.cpu.tma
 			gb.Interrupt(intTimer)
 		}
 	}
+	gb.cpu.timerSignal = signal
 }
 
 func (gb *Machine) checkInterrupts() {
@@ -275,10 +370,10 @@ func (gb *Machine) checkInterrupts() {
 		return
 	}
 
-	for flag, vector := range interruptVectorMap {
-		if gb.cpu.irq&gb.cpu.ie&flag != 0 {
-			gb.cpu.irq &= ^flag
-			gb.cpuInterrupt(vector)
+	for _, i := range interruptVectors {
+		if gb.cpu.irq&gb.cpu.ie&i.flag != 0 {
+			gb.cpu.irq &= ^i.flag
+			gb.cpuInterrupt(i.vector)
 			return
 		}
 	}
@@ -290,6 +385,7 @@ func (gb *Machine) stepDMA() {
 		srcindex := uint16(gb.cpu.dmabank)<<8 + gb.cpu.dmaindex
 		src := gb.Read(srcindex)
 		gb.Write(dstindex, src)
+		gb.cpu.dmavalue = src
 		//fmt.Printf("dma%02x: %04x = (%04x) %02x\n", gb.cpu.dmaindex, dstindex, srcindex, src)
 
 		gb.cpu.dmaindex++
@@ -302,12 +398,12 @@ func (gb *Machine) stepDMA() {
 func (gb *Machine) trace() {
 	// Decode instruction
 	ins := []byte{}
-	rdr := busReader{bus: gb, addr: gb.cpu.pc}
+	rdr := busReader{gb: gb, addr: gb.cpu.pc}
 	asm := Disassemble(&rdr)
 
 	// Get instruction bytes
 	for i := gb.cpu.pc; i < rdr.addr; i++ {
-		ins = append(ins, gb.Read(i))
+		ins = append(ins, gb.Peek(i))
 	}
 
 	// Pad instruction bytes
@@ -322,10 +418,79 @@ func (gb *Machine) trace() {
 		asmstr += " "
 	}
 
-	fmt.Printf("%s %s | b=%02x c=%02x d=%02x e=%02x h=%02x l=%02x a=%02x f=%04b sp=%04x pc=%04x clk=%d\n", insstr, asmstr, gb.cpu.b, gb.cpu.c, gb.cpu.d, gb.cpu.e, gb.cpu.h, gb.cpu.l, gb.cpu.a, gb.cpu.f>>4, gb.cpu.sp, gb.cpu.pc, gb.cpu.clock/4)
+	out := gb.cpu.traceOut
+	if out == nil {
+		out = gb.cpu.traceWriter
+	}
+	if out == nil {
+		out = os.Stdout
+	}
+
+	fmt.Fprintf(out, "%s %s | b=%02x c=%02x d=%02x e=%02x h=%02x l=%02x a=%02x f=%04b sp=%04x pc=%04x clk=%d\n", insstr, asmstr, gb.cpu.b, gb.cpu.c, gb.cpu.d, gb.cpu.e, gb.cpu.h, gb.cpu.l, gb.cpu.a, gb.cpu.f>>4, gb.cpu.sp, gb.cpu.pc, gb.cpu.clock/4)
+}
+
+// recentInstructions is the number of instructions kept for crash reports.
+const recentInstructions = 16
+
+// RecentInstruction is an executed instruction: its address and opcode. For
+// CB-prefixed instructions, the opcode is $CB.
+type RecentInstruction struct {
+	PC     uint16
+	Opcode uint8
+}
+
+// recordInstruction adds an instruction to the ring buffer of recently
+// executed instructions.
+func (cpu *CPU) recordInstruction(pc uint16, op uint8) {
+	cpu.recent[cpu.recentPos] = RecentInstruction{pc, op}
+	cpu.recentPos = (cpu.recentPos + 1) % recentInstructions
+	if cpu.recentCount < recentInstructions {
+		cpu.recentCount++
+	}
+}
+
+// RecentInstructions returns the most recently executed instructions, oldest
+// first. Up to the last 16 are kept.
+func (gb *Machine) RecentInstructions() []RecentInstruction {
+	cpu := &gb.cpu
+	recent := make([]RecentInstruction, cpu.recentCount)
+	start := cpu.recentPos - cpu.recentCount + recentInstructions
+	for i := range recent {
+		recent[i] = cpu.recent[(start+i)%recentInstructions]
+	}
+	return recent
+}
+
+// UndefinedOpcodeError is the panic value raised when the CPU executes an
+// undefined opcode. StepSafe returns it as an error.
+type UndefinedOpcodeError struct {
+	PC     uint16
+	Opcode uint8
+
+	report string
+}
+
+// Error returns a crash report, with the recently executed instructions.
+func (e *UndefinedOpcodeError) Error() string {
+	return e.report
+}
+
+// crashReport describes a CPU crash, with the recently executed instructions.
+func (gb *Machine) crashReport(reason string) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s at $%04x; recent instructions:", reason, gb.cpu.oppc)
+	for _, ins := range gb.RecentInstructions() {
+		fmt.Fprintf(&sb, " $%04x:%02x", ins.PC, ins.Opcode)
+	}
+	return sb.String()
 }
 
 func (gb *Machine) stepInstruction() {
+	if gb.history != nil {
+		gb.history.begin(&gb.cpu)
+		defer gb.history.end()
+	}
+
 	if gb.cpu.halt {
 		// Halted still
 		gb.stepCycle()
@@ -341,19 +506,33 @@ func (gb *Machine) stepInstruction() {
 	}
 
 	// Fetch next instruction.
+	gb.cpu.oppc = gb.cpu.pc
 	op := gb.cpuFetch()
+	if gb.cpu.haltBug {
+		gb.cpu.haltBug = false
+		gb.cpu.pc--
+	}
+	gb.cpu.recordInstruction(gb.cpu.oppc, op)
+
+	// EI takes effect after the instruction following it.
+	enableIME := gb.cpu.imeScheduled
 
 	// Dispatch.
-	if op == 0xcb {
-		gb.cpuDispatchCB(gb.cpuFetch())
-	} else {
-		gb.cpuDispatch(op)
+	gb.cpuDispatch(op)
+
+	if enableIME && gb.cpu.imeScheduled {
+		gb.cpu.ime = true
+		gb.cpu.imeScheduled = false
 	}
 }
 
 func (gb *Machine) cpuDispatch(op uint8) {
 	cpu := &gb.cpu
 
+	if hook := gb.opcodeHooks[op]; hook != nil && hook(gb) {
+		return
+	}
+
 	switch op {
 	case 0x00:
 		gb.cpuOpNop()
@@ -766,7 +945,7 @@ func (gb *Machine) cpuDispatch(op uint8) {
 	case 0xCA:
 		gb.cpuOpJumpFlag(cpu.zf(), gb.cpuFetch16())
 	case 0xCB:
-		panic("invalid opcode")
+		gb.cpuDispatchCB(gb.cpuFetch())
 	case 0xCC:
 		gb.cpuOpCallFlag(cpu.zf(), gb.cpuFetch16())
 	case 0xCD:
@@ -847,6 +1026,7 @@ func (gb *Machine) cpuDispatch(op uint8) {
 		gb.cpuOpLoad(&cpu.a, gb.fetchAt(uint16(0xFF00)+uint16(cpu.c)))
 	case 0xF3:
 		cpu.ime = false
+		cpu.imeScheduled = false
 	case 0xF4:
 		gb.cpuOpUndefined()
 	case 0xF5:
@@ -856,13 +1036,13 @@ func (gb *Machine) cpuDispatch(op uint8) {
 	case 0xF7:
 		gb.cpuOpRestart(0x30)
 	case 0xF8:
-		gb.cpu.setHL(uint16(int(cpu.sp) + int(gb.cpuFetchSigned())))
+		gb.cpuOpLoadHLSP(gb.cpuFetchSigned())
 	case 0xF9:
 		gb.cpu.sp = cpu.hl()
 	case 0xFA:
 		gb.cpuOpLoad(&cpu.a, gb.fetchAt(gb.cpuFetch16()))
 	case 0xFB:
-		cpu.ime = true
+		cpu.imeScheduled = true
 	case 0xFC:
 		gb.cpuOpUndefined()
 	case 0xFD:
@@ -926,8 +1106,8 @@ func (gb *Machine) cpuDispatchCB(op uint8) {
 		gb.cpuOpCBBitSet(bit, reg)
 	}
 
-	switch op % 8 {
-	case 6:
+	// BIT only reads its operand; the other ops write (hl) back.
+	if op%8 == 6 && (op < 0x40 || op >= 0x80) {
 		gb.writeAt(gb.cpu.hl(), *reg)
 	}
 }
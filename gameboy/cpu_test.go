@@ -0,0 +1,399 @@
+package gameboy
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDMABusConflict(t *testing.T) {
+	gb := NewMachine(newTestROM(0x18, 0xFE), false)
+	for i := uint16(0); i < 160; i++ {
+		gb.Write(0xC000+i, uint8(i)+0x40)
+	}
+	gb.Write(0x8000, 0x11)
+	gb.Write(0xFF80, 0x22)
+
+	// Start a transfer from WRAM and let it copy its first few bytes.
+	gb.Write(0xFF46, 0xC0)
+	gb.stepCycle()
+	copying := gb.Read(0xC000 + gb.cpu.dmaindex - 1)
+
+	tests := []struct {
+		addr  uint16
+		value uint8
+	}{
+		// The external bus returns the byte being copied.
+		{0xC100, copying},
+		{0x0100, copying},
+		// The VRAM bus and HRAM are unaffected.
+		{0x8000, 0x11},
+		{0xFF80, 0x22},
+	}
+
+	for _, test := range tests {
+		if value := gb.cpuRead(test.addr); value != test.value {
+			t.Errorf("$%04x during DMA: expected $%02x, got $%02x", test.addr, test.value, value)
+		}
+	}
+
+	// Debugger reads are not affected.
+	if value := gb.Read(0xC100); value != 0x00 {
+		t.Errorf("expected Read to bypass the conflict, got $%02x", value)
+	}
+
+	for gb.cpu.dma {
+		gb.stepCycle()
+	}
+	if value := gb.cpuRead(0xC100); value != 0x00 {
+		t.Errorf("$c100 after DMA: expected $00, got $%02x", value)
+	}
+}
+
+func TestOAMReadDuringDMA(t *testing.T) {
+	gb := NewMachine(newTestROM(0x18, 0xFE), false)
+	gb.Write(0xFF40, 0x00)
+	for i := uint16(0); i < 160; i++ {
+		gb.Write(0xC000+i, uint8(i)+0x40)
+	}
+
+	gb.Write(0xFF46, 0xC0)
+	gb.stepCycle()
+
+	for _, addr := range []uint16{0xFE00, 0xFE50, 0xFE9F} {
+		if value := gb.cpuRead(addr); value != 0xFF {
+			t.Errorf("$%04x during DMA: expected $ff, got $%02x", addr, value)
+		}
+	}
+
+	for gb.cpu.dma {
+		gb.stepCycle()
+	}
+	for _, addr := range []uint16{0xFE00, 0xFE50, 0xFE9F} {
+		if value, expected := gb.cpuRead(addr), uint8(addr-0xFE00)+0x40; value != expected {
+			t.Errorf("$%04x after DMA: expected $%02x, got $%02x", addr, expected, value)
+		}
+	}
+}
+
+func TestStackBounds(t *testing.T) {
+	// ld sp, $c004; push bc; push bc; pop bc; push bc
+	gb := NewMachine(newTestROM(0x31, 0x04, 0xC0, 0xC5, 0xC5, 0xC1, 0xC5), false)
+
+	var violations []uint16
+	gb.SetStackBounds(0xC002, 0xC004)
+	gb.SetStackCallback(func(sp uint16) {
+		violations = append(violations, sp)
+	})
+
+	for i := 0; i < 4; i++ {
+		gb.Step()
+	}
+
+	// Only the second push moves SP past the low bound.
+	if len(violations) != 1 || violations[0] != 0xC000 {
+		t.Errorf("expected a violation at c000, got %04x", violations)
+	}
+
+	gb.ClearStackBounds()
+	gb.Step()
+	if len(violations) != 1 {
+		t.Errorf("expected no violations with checking disabled, got %04x", violations)
+	}
+}
+
+func TestDIVWriteGlitch(t *testing.T) {
+	tests := []struct {
+		bitHigh bool
+		tima    uint8
+	}{
+		// Resetting the counter while the selected bit is high is a falling
+		// edge, so TIMA increments.
+		{true, 1},
+		{false, 0},
+	}
+
+	for _, test := range tests {
+		gb := NewMachine(newTestROM(), false)
+
+		// 262144 Hz, clocked by bit 3 of the internal counter.
+		gb.Write(0xFF07, 0x05)
+		gb.cpu.div = 0x0000
+		if test.bitHigh {
+			gb.cpu.div = 0x0007
+		}
+		gb.checkTimers()
+		gb.cpu.tima = 0
+
+		gb.Write(0xFF04, 0x00)
+		gb.checkTimers()
+
+		if gb.cpu.tima != test.tima {
+			t.Errorf("bit high %v: expected tima=%d, got %d", test.bitHigh, test.tima, gb.cpu.tima)
+		}
+		if div := gb.Read(0xFF04); div != 0 {
+			t.Errorf("bit high %v: expected div=0, got %d", test.bitHigh, div)
+		}
+	}
+}
+
+func TestTimerFrequencies(t *testing.T) {
+	tests := []struct {
+		tac    uint8
+		clocks int
+	}{
+		{0x04, 1024},
+		{0x05, 16},
+		{0x06, 64},
+		{0x07, 256},
+	}
+
+	for _, test := range tests {
+		gb := NewMachine(newTestROM(), false)
+		gb.Write(0xFF07, test.tac)
+		gb.Write(0xFF05, 0)
+
+		for i := 0; i < test.clocks*10; i++ {
+			gb.checkTimers()
+		}
+		if gb.cpu.tima != 10 {
+			t.Errorf("tac=%02x: expected tima=10 after %d clocks, got %d", test.tac, test.clocks*10, gb.cpu.tima)
+		}
+	}
+}
+
+func TestRecentInstructions(t *testing.T) {
+	// ld a, $01; inc a; then nops, then an undefined opcode.
+	program := make([]byte, 20)
+	copy(program, []byte{0x3E, 0x01, 0x3C})
+	program = append(program, 0xD3)
+	gb := NewMachine(newTestROM(program...), false)
+
+	gb.Step()
+	gb.Step()
+	expected := []RecentInstruction{{0x0100, 0x3E}, {0x0102, 0x3C}}
+	if recent := gb.RecentInstructions(); !reflect.DeepEqual(recent, expected) {
+		t.Errorf("expected %v, got %v", expected, recent)
+	}
+
+	// 17 nops later, only the last 16 instructions are kept.
+	for i := 0; i < 17; i++ {
+		gb.Step()
+	}
+	recent := gb.RecentInstructions()
+	if len(recent) != 16 {
+		t.Fatalf("expected 16 instructions, got %d", len(recent))
+	}
+	for i, ins := range recent {
+		if pc := uint16(0x0104 + i); ins != (RecentInstruction{pc, 0x00}) {
+			t.Errorf("%d: expected $%04x: nop, got %+v", i, pc, ins)
+		}
+	}
+
+	defer func() {
+		err, _ := recover().(*UndefinedOpcodeError)
+		if err == nil || err.PC != 0x0114 || err.Opcode != 0xD3 {
+			t.Fatalf("expected undefined opcode $d3 at $0114, got %v", err)
+		}
+		if msg := err.Error(); !strings.Contains(msg, "undefined opcode at $0114") || !strings.HasSuffix(msg, "$0113:00 $0114:d3") {
+			t.Errorf("expected crash report, got %q", msg)
+		}
+	}()
+	gb.Step()
+}
+
+func TestJoypadBothRows(t *testing.T) {
+	tests := []struct {
+		sel    uint8
+		pad    Gamepad
+		nibble uint8
+	}{
+		// Both rows selected: the rows are ANDed together.
+		{0x00, Gamepad{A: true, Left: true}, 0xC},
+		{0x00, Gamepad{A: true, Right: true}, 0xE},
+		{0x00, Gamepad{Start: true, Up: true}, 0x3},
+		// One row selected.
+		{0x10, Gamepad{A: true, Left: true}, 0xE},
+		{0x20, Gamepad{A: true, Left: true}, 0xD},
+		// No rows selected.
+		{0x30, Gamepad{A: true, Left: true}, 0xF},
+	}
+
+	for _, test := range tests {
+		gb := NewMachine(newTestROM(), false)
+		gb.UpdatePad(test.pad)
+		gb.Write(0xFF00, test.sel)
+
+		value := gb.Read(0xFF00)
+		if value&0xF != test.nibble {
+			t.Errorf("select %02x, %+v: expected %x, got %x", test.sel, test.pad, test.nibble, value&0xF)
+		}
+		if value&0x30 != test.sel {
+			t.Errorf("select %02x: expected select bits to read back, got %02x", test.sel, value&0x30)
+		}
+	}
+}
+
+func TestJoypadInterrupt(t *testing.T) {
+	gb := NewMachine(newTestROM(0x18, 0xFE), false)
+	gb.Write(0xFF00, 0x10) // Select buttons
+	gb.Step()
+	gb.cpu.irq = 0
+
+	gb.UpdatePad(Gamepad{A: true})
+	if gb.cpu.irq&intGamepad == 0 {
+		t.Fatal("expected press to request the joypad interrupt")
+	}
+	gb.cpu.irq = 0
+
+	for i := 0; i < 10; i++ {
+		if v := gb.Read(0xFF00); v&0xF != 0xE {
+			t.Fatalf("expected A to read pressed, got %02x", v)
+		}
+		gb.Step()
+	}
+	if gb.cpu.irq&intGamepad != 0 {
+		t.Error("expected held button not to request the interrupt again")
+	}
+	if gb.cpu.ie&intGamepad != 0 {
+		t.Error("expected reads not to modify IE")
+	}
+
+	// Selecting the d-pad releases the line; reselecting the buttons with A
+	// held pulls it low again.
+	gb.Write(0xFF00, 0x20)
+	gb.Step()
+	gb.Write(0xFF00, 0x10)
+	gb.Step()
+	if gb.cpu.irq&intGamepad == 0 {
+		t.Error("expected selecting a row with a held button to request the interrupt")
+	}
+}
+
+func TestOpcodeHook(t *testing.T) {
+	gb := NewMachine(newTestROM(0x00, 0x00, 0x3C, 0x00), false)
+
+	nops := 0
+	gb.SetOpcodeHook(0x00, func(gb *Machine) bool {
+		nops++
+		gb.cpu.b = 0x42
+		return true
+	})
+
+	// Returning true skips inc a.
+	gb.SetOpcodeHook(0x3C, func(gb *Machine) bool {
+		return true
+	})
+
+	for i := 0; i < 4; i++ {
+		gb.Step()
+	}
+
+	if nops != 3 {
+		t.Errorf("expected hook to run 3 times, got %d", nops)
+	}
+	s := gb.GetCPUState()
+	if s.B != 0x42 || s.A != 0x01 || s.PC != 0x0104 {
+		t.Errorf("expected b=42 a=01 pc=0104, got b=%02x a=%02x pc=%04x", s.B, s.A, s.PC)
+	}
+
+	// Returning false runs the normal implementation.
+	gb.SetOpcodeHook(0x00, nil)
+	gb.SetOpcodeHook(0x3C, func(gb *Machine) bool {
+		return false
+	})
+	gb.SetCPUState(CPUState{PC: 0x0102, A: 0x01, SP: 0xFFFE})
+	gb.Step()
+	gb.Step()
+	if nops != 3 {
+		t.Errorf("expected removed hook not to run, got %d calls", nops)
+	}
+	if a := gb.GetCPUState().A; a != 0x02 {
+		t.Errorf("expected a=02, got %02x", a)
+	}
+}
+
+func TestStepSafe(t *testing.T) {
+	gb := NewMachine(newTestROM(0x00, 0xD3), false)
+
+	if err := gb.StepSafe(); err != nil {
+		t.Fatalf("nop: expected no error, got %v", err)
+	}
+	err := gb.StepSafe()
+	if _, ok := err.(*UndefinedOpcodeError); !ok || !strings.Contains(err.Error(), "undefined opcode at $0101") {
+		t.Errorf("expected undefined opcode error, got %v", err)
+	}
+}
+
+func FuzzStepSafe(f *testing.F) {
+	f.Add([]byte{0x00})
+	f.Add([]byte{0x3E, 0x42, 0xEA, 0x00, 0xC0, 0x18, 0xF9})
+	f.Add([]byte{0xCD, 0x00, 0x01})
+	f.Add([]byte{0xFB, 0x76, 0xD3})
+
+	f.Fuzz(func(t *testing.T, program []byte) {
+		rom := make(ROM, 0x8000)
+		copy(rom[0x100:], program)
+		gb := NewMachine(rom, false)
+
+		// Undefined opcodes end the run; any other panic is a bug.
+		for i := 0; i < 10000; i++ {
+			err := gb.StepSafe()
+			if err == nil {
+				continue
+			}
+			var undefined *UndefinedOpcodeError
+			if errors.As(err, &undefined) {
+				return
+			}
+			t.Fatalf("step %d: %v", i, err)
+		}
+	})
+}
+
+func TestInterruptEnableUpperBits(t *testing.T) {
+	gb := NewMachine(newTestROM(
+		0x3E, 0xE0, // ld a, $e0
+		0xE0, 0xFF, // ldh (ie), a
+		0xF0, 0xFF, // ldh a, (ie)
+		0xFB,       // ei
+		0x18, 0xFE, // jr -2
+	), false)
+	gb.Write(0xFF0F, 0xFF)
+
+	for i := 0; i < 3; i++ {
+		gb.Step()
+	}
+	if a := gb.GetCPUState().A; a != 0xE0 {
+		t.Errorf("expected IE to read back e0, got %02x", a)
+	}
+
+	for i := 0; i < 100; i++ {
+		gb.Step()
+		if pc := gb.GetCPUState().PC; pc < 0x0100 {
+			t.Fatalf("expected no interrupt from IE upper bits, jumped to %04x", pc)
+		}
+	}
+}
+
+func TestInterruptDispatchCycles(t *testing.T) {
+	gb := NewMachine(newTestROM(0x00), false)
+	gb.cpu.ime = true
+	gb.cpu.ie = intTimer
+	gb.cpu.irq = intTimer
+
+	// The interrupt is serviced, then the nop at $0050 runs.
+	clock, dot := gb.cpu.clock, gb.ppu.clock
+	gb.Step()
+
+	if pc := gb.cpu.pc; pc != 0x0051 {
+		t.Fatalf("expected pc=0051, got %04x", pc)
+	}
+	if cycles := gb.cpu.clock - clock; cycles != 20+4 {
+		t.Errorf("expected 24 cycles for dispatch and nop, got %d", cycles)
+	}
+	if dots := gb.ppu.clock - dot; dots != 20+4 {
+		t.Errorf("expected the PPU to advance 24 dots, got %d", dots)
+	}
+}
@@ -6,7 +6,7 @@ import (
 )
 
 type busReader struct {
-	bus  IO
+	gb   *Machine
 	addr uint16
 }
 
@@ -16,9 +16,48 @@ var (
 	rp2table = [4]string{"bc", "de", "hl", "af"}
 	cndtable = [4]string{"nz", "z", "nc", "c"}
 	alutable = [8]string{"add a,", "adc a,", "sub a,", "sbc a,", "and", "xor", "or", "cp"}
-	rottable = [8]string{"rlc", "rrc", "rl", "rr", "sla", "sra", "sll", "srl"}
+	rottable = [8]string{"rlc", "rrc", "rl", "rr", "sla", "sra", "swap", "srl"}
 )
 
+// DisassembleSyntax selects the assembly syntax produced by the disassembler.
+type DisassembleSyntax int
+
+const (
+	// SyntaxDefault uses parentheses for memory operands and shows relative
+	// jumps as signed offsets.
+	SyntaxDefault DisassembleSyntax = iota
+
+	// SyntaxRGBDS produces output that RGBDS can assemble: brackets for
+	// memory operands, ldh for high page loads, and relative jumps as
+	// offsets from the current address.
+	SyntaxRGBDS
+)
+
+// mem formats a memory operand.
+func (s DisassembleSyntax) mem(operand string) string {
+	if s == SyntaxRGBDS {
+		return "[" + operand + "]"
+	}
+	return "(" + operand + ")"
+}
+
+// reg formats an 8-bit register operand.
+func (s DisassembleSyntax) reg(i byte) string {
+	if i == 6 {
+		return s.mem("hl")
+	}
+	return regtable[i]
+}
+
+// rel formats the target of a relative jump.
+func (s DisassembleSyntax) rel(offset int8) string {
+	if s == SyntaxRGBDS {
+		// Offsets are relative to the end of the two byte instruction.
+		return fmt.Sprintf("@%+d", int(offset)+2)
+	}
+	return fmt.Sprintf("%+d", offset)
+}
+
 func (r *busReader) safeRead(addr uint16) (b byte, err error) {
 	defer func() {
 		if r := recover(); r != nil {
@@ -32,7 +71,7 @@ func (r *busReader) safeRead(addr uint16) (b byte, err error) {
 		}
 	}()
 
-	b = r.bus.Read(addr)
+	b = r.gb.Peek(addr)
 
 	return b, nil
 }
@@ -52,7 +91,8 @@ func (r *busReader) Read(p []byte) (n int, err error) {
 	return
 }
 
-// BusReader creates an io.Reader that reads from GameBoy memory.
+// BusReader creates an io.Reader that reads from GameBoy memory. Reads are not
+// counted in AccessStats.
 func BusReader(gb *Machine, addr uint16) io.Reader {
 	return &busReader{gb, addr}
 }
@@ -71,19 +111,25 @@ func fetch16(r io.Reader) uint16 {
 
 // Disassemble returns a string representing the opcode read from the reader.
 func Disassemble(r io.Reader) string {
+	return DisassembleWithSyntax(r, SyntaxDefault)
+}
+
+// DisassembleWithSyntax returns a string representing the opcode read from
+// the reader, in the given syntax.
+func DisassembleWithSyntax(r io.Reader, syntax DisassembleSyntax) string {
 	op := fetch8(r)
 
 	if op == 0xCB {
-		return disassembleCB(fetch8(r), r)
+		return disassembleCB(fetch8(r), syntax)
 	}
 
-	return disassemble(op, r)
+	return disassemble(op, r, syntax)
 }
 
 // dissassemble disassembles unprefixed ops. Based on a couple references:
 // - http://www.z80.info/decoding.htm (for the overarching patterns)
 // - http://pastraiser.com/cpu/gameboy/gameboy_opcodes.html (for the LR35902)
-func disassemble(op byte, r io.Reader) string {
+func disassemble(op byte, r io.Reader, s DisassembleSyntax) string {
 	x := op >> 6 & 0x7
 	y := op >> 3 & 0x7
 	z := op >> 0 & 0x7
@@ -99,44 +145,44 @@ func disassemble(op byte, r io.Reader) string {
 			case 0:
 				return "nop"
 			case 1:
-				return fmt.Sprintf("ld $%04x, sp", fetch16(r))
+				return fmt.Sprintf("ld %s, sp", s.mem(fmt.Sprintf("$%04x", fetch16(r))))
 			case 2:
 				return fmt.Sprintf("stop")
 			case 3:
-				return fmt.Sprintf("jr %+d", int8(fetch8(r)))
+				return fmt.Sprintf("jr %s", s.rel(int8(fetch8(r))))
 			case 4, 5, 6, 7:
-				return fmt.Sprintf("jr %s, %+d", cndtable[y-4], int8(fetch8(r)))
+				return fmt.Sprintf("jr %s, %s", cndtable[y-4], s.rel(int8(fetch8(r))))
 			}
 		case 1:
 			switch q {
 			case 0:
 				return fmt.Sprintf("ld %s, $%04x", rp1table[p], fetch16(r))
 			case 1:
-				return fmt.Sprintf("add hl, $%04x", rp1table[p])
+				return fmt.Sprintf("add hl, %s", rp1table[p])
 			}
 		case 2:
 			switch q {
 			case 0:
 				switch p {
 				case 0:
-					return fmt.Sprintf("ld (bc), a")
+					return fmt.Sprintf("ld %s, a", s.mem("bc"))
 				case 1:
-					return fmt.Sprintf("ld (de), a")
+					return fmt.Sprintf("ld %s, a", s.mem("de"))
 				case 2:
-					return fmt.Sprintf("ld (hl+), a")
+					return fmt.Sprintf("ld %s, a", s.mem("hl+"))
 				case 3:
-					return fmt.Sprintf("ld (hl-), a")
+					return fmt.Sprintf("ld %s, a", s.mem("hl-"))
 				}
 			case 1:
 				switch p {
 				case 0:
-					return fmt.Sprintf("ld a, (bc)")
+					return fmt.Sprintf("ld a, %s", s.mem("bc"))
 				case 1:
-					return fmt.Sprintf("ld a, (de)")
+					return fmt.Sprintf("ld a, %s", s.mem("de"))
 				case 2:
-					return fmt.Sprintf("ld a, (hl+)")
+					return fmt.Sprintf("ld a, %s", s.mem("hl+"))
 				case 3:
-					return fmt.Sprintf("ld a, (hl-)")
+					return fmt.Sprintf("ld a, %s", s.mem("hl-"))
 				}
 			}
 		case 3:
@@ -147,11 +193,11 @@ func disassemble(op byte, r io.Reader) string {
 				return fmt.Sprintf("dec %s", rp1table[p])
 			}
 		case 4:
-			return fmt.Sprintf("inc %s", regtable[y])
+			return fmt.Sprintf("inc %s", s.reg(y))
 		case 5:
-			return fmt.Sprintf("dec %s", regtable[y])
+			return fmt.Sprintf("dec %s", s.reg(y))
 		case 6:
-			return fmt.Sprintf("ld %s, $%02x", regtable[y], fetch8(r))
+			return fmt.Sprintf("ld %s, $%02x", s.reg(y), fetch8(r))
 		case 7:
 			switch y {
 			case 0:
@@ -177,9 +223,9 @@ func disassemble(op byte, r io.Reader) string {
 			return "halt"
 		}
 
-		return fmt.Sprintf("ld %s, %s", regtable[y], regtable[z])
+		return fmt.Sprintf("ld %s, %s", s.reg(y), s.reg(z))
 	case x == 2:
-		return fmt.Sprintf("%s %s", alutable[y], regtable[z])
+		return fmt.Sprintf("%s %s", alutable[y], s.reg(z))
 	case x == 3:
 		switch z {
 		case 0:
@@ -187,10 +233,16 @@ func disassemble(op byte, r io.Reader) string {
 			case 0, 1, 2, 3:
 				return fmt.Sprintf("ret %s", cndtable[y])
 			case 4:
+				if s == SyntaxRGBDS {
+					return fmt.Sprintf("ldh [$ff%02x], a", fetch8(r))
+				}
 				return fmt.Sprintf("ld ($ff%02x), a", fetch8(r))
 			case 5:
 				return fmt.Sprintf("add sp, %d", int8(fetch8(r)))
 			case 6:
+				if s == SyntaxRGBDS {
+					return fmt.Sprintf("ldh a, [$ff%02x]", fetch8(r))
+				}
 				return fmt.Sprintf("ld a, ($ff%02x)", fetch8(r))
 			case 7:
 				return fmt.Sprintf("ld hl, sp%+d", int8(fetch8(r)))
@@ -206,6 +258,9 @@ func disassemble(op byte, r io.Reader) string {
 				case 1:
 					return "reti"
 				case 2:
+					if s == SyntaxRGBDS {
+						return "jp hl"
+					}
 					return "jp (hl)"
 				case 3:
 					return "ld sp, hl"
@@ -216,13 +271,19 @@ func disassemble(op byte, r io.Reader) string {
 			case 0, 1, 2, 3:
 				return fmt.Sprintf("jp %s, $%04x", cndtable[y], fetch16(r))
 			case 4:
-				return fmt.Sprintf("ld (c), a")
+				if s == SyntaxRGBDS {
+					return "ldh [c], a"
+				}
+				return "ld (c), a"
 			case 5:
-				return fmt.Sprintf("ld ($%04x), a", fetch16(r))
+				return fmt.Sprintf("ld %s, a", s.mem(fmt.Sprintf("$%04x", fetch16(r))))
 			case 6:
-				return fmt.Sprintf("ld a, (c)")
+				if s == SyntaxRGBDS {
+					return "ldh a, [c]"
+				}
+				return "ld a, (c)"
 			case 7:
-				return fmt.Sprintf("ld a, ($%04x)", fetch16(r))
+				return fmt.Sprintf("ld a, %s", s.mem(fmt.Sprintf("$%04x", fetch16(r))))
 			}
 		case 3:
 			switch y {
@@ -238,7 +299,7 @@ func disassemble(op byte, r io.Reader) string {
 		case 4:
 			switch y {
 			case 0, 1, 2, 3:
-				return fmt.Sprintf("call %s, $%04x", cndtable[p], fetch16(r))
+				return fmt.Sprintf("call %s, $%04x", cndtable[y], fetch16(r))
 			default:
 				break
 			}
@@ -254,28 +315,90 @@ func disassemble(op byte, r io.Reader) string {
 		case 6:
 			return fmt.Sprintf("%s $%02x", alutable[y], fetch8(r))
 		case 7:
+			if s == SyntaxRGBDS {
+				return fmt.Sprintf("rst $%02x", y<<3)
+			}
 			return fmt.Sprintf("rst $%04x", y<<3)
 		}
 	}
 
+	// Undefined opcodes are a single byte.
 	return fmt.Sprintf("db $%02x", op)
 }
 
-func disassembleCB(op byte, r io.Reader) string {
+func disassembleCB(op byte, s DisassembleSyntax) string {
 	x := op >> 6 & 0x7
 	y := op >> 3 & 0x7
 	z := op >> 0 & 0x7
 
 	switch x {
 	case 0:
-		return fmt.Sprintf("%s, %s", rottable[y], regtable[z])
+		return fmt.Sprintf("%s %s", rottable[y], s.reg(z))
 	case 1:
-		return fmt.Sprintf("bit %d, %s", y, regtable[z])
+		return fmt.Sprintf("bit %d, %s", y, s.reg(z))
 	case 2:
-		return fmt.Sprintf("res %d, %s", y, regtable[z])
+		return fmt.Sprintf("res %d, %s", y, s.reg(z))
 	case 3:
-		return fmt.Sprintf("set %d, %s", y, regtable[z])
+		return fmt.Sprintf("set %d, %s", y, s.reg(z))
 	}
 
-	return fmt.Sprintf("db $%02x", op)
+	return fmt.Sprintf("db $cb, $%02x", op)
+}
+
+// DisassembleTo writes a listing of count instructions starting at start to w.
+// Each line contains the address, the instruction bytes and the mnemonic.
+func DisassembleTo(w io.Writer, gb *Machine, start uint16, count int) error {
+	rdr := busReader{gb: gb, addr: start}
+
+	for i := 0; i < count; i++ {
+		if err := writeInstruction(w, gb, &rdr); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DisassembleROM writes a listing of ROM bank 0 to w, in the format of
+// DisassembleTo. If bank is not 0, the listing continues with the given bank,
+// mapped at 0x4000 by the cartridge's mapper.
+func DisassembleROM(w io.Writer, rom []byte, bank int) error {
+	cart, err := NewCartridge(rom)
+	if err != nil {
+		return err
+	}
+	gb := NewMachine(cart, false)
+
+	end := 0x4000
+	if bank != 0 {
+		gb.Write(0x2000, uint8(bank))
+		if mapped := gb.CartridgeState().ROMBank; mapped != uint(bank) || bank*0x4000 >= len(rom) {
+			return fmt.Errorf("cannot map ROM bank %d", bank)
+		}
+		end = 0x8000
+	}
+
+	rdr := busReader{gb: gb, addr: 0x0000}
+	for int(rdr.addr) < end {
+		if err := writeInstruction(w, gb, &rdr); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeInstruction disassembles the instruction at the reader's address and
+// writes it to w as a listing line.
+func writeInstruction(w io.Writer, gb *Machine, rdr *busReader) error {
+	addr := rdr.addr
+	asm := Disassemble(rdr)
+
+	ins := []byte{}
+	for a := addr; a != rdr.addr; a++ {
+		ins = append(ins, gb.Peek(a))
+	}
+
+	_, err := fmt.Fprintf(w, "%04x: %-8s  %s\n", addr, fmt.Sprintf("% 02x", ins), asm)
+	return err
 }
@@ -0,0 +1,166 @@
+package gameboy
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestDisassembleTo(t *testing.T) {
+	// ld a, $03; ldh ($47), a; call $0150; then nops.
+	gb := NewMachine(newTestROM(0x3E, 0x03, 0xE0, 0x47, 0xCD, 0x50, 0x01), false)
+
+	var buf bytes.Buffer
+	if err := DisassembleTo(&buf, gb, 0x0100, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 100 {
+		t.Fatalf("expected 100 lines, got %d", len(lines))
+	}
+
+	expected := []string{
+		"0100: 3e 03     ld a, $03",
+		"0102: e0 47     ld ($ff47), a",
+		"0104: cd 50 01  call $0150",
+		"0107: 00        nop",
+	}
+	for i, line := range expected {
+		if lines[i] != line {
+			t.Errorf("line %d: expected %q, got %q", i, line, lines[i])
+		}
+	}
+
+	if last := lines[99]; last != "0167: 00        nop" {
+		t.Errorf("expected last line at $0167, got %q", last)
+	}
+}
+
+func TestDisassembleIllegal(t *testing.T) {
+	for _, op := range []byte{0xD3, 0xDB, 0xDD, 0xE3, 0xE4, 0xEB, 0xEC, 0xED, 0xF4, 0xFC, 0xFD} {
+		// The following byte must not be consumed.
+		r := bytes.NewReader([]byte{op, 0x00})
+		expected := fmt.Sprintf("db $%02x", op)
+		if asm := Disassemble(r); asm != expected {
+			t.Errorf("$%02x: expected %q, got %q", op, expected, asm)
+		}
+		if r.Len() != 1 {
+			t.Errorf("$%02x: expected 1 byte consumed, got %d", op, 2-r.Len())
+		}
+	}
+
+	if asm := disassembleCB(0x00, SyntaxDefault); strings.HasPrefix(asm, "db") {
+		t.Errorf("expected CB ops to be defined, got %q", asm)
+	}
+}
+
+func TestDisassembleDefault(t *testing.T) {
+	tests := []struct {
+		code []byte
+		asm  string
+	}{
+		// 16-bit register operands, not immediates.
+		{[]byte{0x09}, "add hl, bc"},
+		{[]byte{0x39}, "add hl, sp"},
+		// Stores of sp take a memory operand.
+		{[]byte{0x08, 0x00, 0xC0}, "ld ($c000), sp"},
+		// The condition is selected by bits 3-4.
+		{[]byte{0xC4, 0x34, 0x12}, "call nz, $1234"},
+		{[]byte{0xCC, 0x34, 0x12}, "call z, $1234"},
+		{[]byte{0xD4, 0x34, 0x12}, "call nc, $1234"},
+		{[]byte{0xDC, 0x34, 0x12}, "call c, $1234"},
+		// CB shifts and rotates take a single operand; $30-$37 is swap.
+		{[]byte{0xCB, 0x00}, "rlc b"},
+		{[]byte{0xCB, 0x1E}, "rr (hl)"},
+		{[]byte{0xCB, 0x30}, "swap b"},
+		{[]byte{0xCB, 0x36}, "swap (hl)"},
+		{[]byte{0xCB, 0x3F}, "srl a"},
+	}
+
+	for _, test := range tests {
+		if asm := Disassemble(bytes.NewReader(test.code)); asm != test.asm {
+			t.Errorf("% x: expected %q, got %q", test.code, test.asm, asm)
+		}
+	}
+}
+
+func TestDisassembleSyntax(t *testing.T) {
+	tests := []struct {
+		code  []byte
+		plain string
+		rgbds string
+	}{
+		{[]byte{0x08, 0x00, 0xC0}, "ld ($c000), sp", "ld [$c000], sp"},
+		{[]byte{0x18, 0xFE}, "jr -2", "jr @+0"},
+		{[]byte{0x20, 0x05}, "jr nz, +5", "jr nz, @+7"},
+		{[]byte{0x19}, "add hl, de", "add hl, de"},
+		{[]byte{0x22}, "ld (hl+), a", "ld [hl+], a"},
+		{[]byte{0x1A}, "ld a, (de)", "ld a, [de]"},
+		{[]byte{0x34}, "inc (hl)", "inc [hl]"},
+		{[]byte{0x36, 0x42}, "ld (hl), $42", "ld [hl], $42"},
+		{[]byte{0x7E}, "ld a, (hl)", "ld a, [hl]"},
+		{[]byte{0x96}, "sub a, (hl)", "sub a, [hl]"},
+		{[]byte{0xE0, 0x47}, "ld ($ff47), a", "ldh [$ff47], a"},
+		{[]byte{0xF0, 0x44}, "ld a, ($ff44)", "ldh a, [$ff44]"},
+		{[]byte{0xE2}, "ld (c), a", "ldh [c], a"},
+		{[]byte{0xF2}, "ld a, (c)", "ldh a, [c]"},
+		{[]byte{0xEA, 0x00, 0xD0}, "ld ($d000), a", "ld [$d000], a"},
+		{[]byte{0xFA, 0x34, 0x12}, "ld a, ($1234)", "ld a, [$1234]"},
+		{[]byte{0xE9}, "jp (hl)", "jp hl"},
+		{[]byte{0xDC, 0x00, 0x40}, "call c, $4000", "call c, $4000"},
+		{[]byte{0xFF}, "rst $0038", "rst $38"},
+		{[]byte{0xF8, 0xFE}, "ld hl, sp-2", "ld hl, sp-2"},
+		{[]byte{0xCB, 0x37}, "swap a", "swap a"},
+		{[]byte{0xCB, 0x7E}, "bit 7, (hl)", "bit 7, [hl]"},
+		{[]byte{0xCB, 0x06}, "rlc (hl)", "rlc [hl]"},
+	}
+
+	for _, test := range tests {
+		if asm := DisassembleWithSyntax(bytes.NewReader(test.code), SyntaxDefault); asm != test.plain {
+			t.Errorf("% x: expected %q, got %q", test.code, test.plain, asm)
+		}
+		if asm := DisassembleWithSyntax(bytes.NewReader(test.code), SyntaxRGBDS); asm != test.rgbds {
+			t.Errorf("% x (RGBDS): expected %q, got %q", test.code, test.rgbds, asm)
+		}
+	}
+}
+
+func TestDisassembleROM(t *testing.T) {
+	rom := newTestCartROM(4, 0x01, 0x00)
+	copy(rom[0x0100:], []byte{0x00, 0xC3, 0x50, 0x01})
+	copy(rom[0x3FFE:], []byte{0x18, 0xFE})
+	copy(rom[2*0x4000:], []byte{0x02, 0x3E, 0x12, 0xC9})
+
+	var buf bytes.Buffer
+	if err := DisassembleROM(&buf, rom, 0); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+
+	for _, line := range []string{
+		"0100: 00        nop\n",
+		"0101: c3 50 01  jp $0150\n",
+		"3ffe: 18 fe     jr -2\n",
+	} {
+		if !strings.Contains(out, line) {
+			t.Errorf("bank 0: expected %q", line)
+		}
+	}
+	if !strings.HasSuffix(out, "3ffe: 18 fe     jr -2\n") {
+		t.Errorf("bank 0: expected listing to end at $3fff")
+	}
+
+	buf.Reset()
+	if err := DisassembleROM(&buf, rom, 2); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "4000: 02        ld (bc), a\n4001: 3e 12     ld a, $12\n4003: c9        ret\n") {
+		t.Errorf("bank 2: expected bank 2 at $4000")
+	}
+
+	if err := DisassembleROM(&buf, rom, 4); err == nil {
+		t.Error("bank 4: expected error")
+	}
+}
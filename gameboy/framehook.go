@@ -0,0 +1,44 @@
+package gameboy
+
+// FrameInfo describes a frame, passed to the function set by SetFrameHook.
+type FrameInfo struct {
+	// Frame is the number of the frame, counting from 0 at power-on.
+	Frame uint64
+
+	// Cycles is the number of clock cycles since the previous frame ended,
+	// normally 70224.
+	Cycles uint
+
+	// VBlankInterrupt and StatInterrupt report whether the PPU requested the
+	// VBlank and STAT interrupts during the frame.
+	VBlankInterrupt bool
+	StatInterrupt   bool
+}
+
+// frameCounter tracks the current frame for FrameInfo.
+type frameCounter struct {
+	frame      uint64
+	startClock uint
+	vblank     bool
+	stat       bool
+}
+
+// SetFrameHook sets a function to be called each time the PPU enters VBlank,
+// with information about the frame just completed. A nil hook disables it.
+func (gb *Machine) SetFrameHook(hook func(info FrameInfo)) {
+	gb.onFrame = hook
+}
+
+// finishFrame calls the frame hook and starts counting the next frame.
+func (gb *Machine) finishFrame() {
+	f := &gb.frameCounter
+	if gb.onFrame != nil {
+		gb.onFrame(FrameInfo{
+			Frame:           f.frame,
+			Cycles:          gb.cpu.clock - f.startClock,
+			VBlankInterrupt: f.vblank,
+			StatInterrupt:   f.stat,
+		})
+	}
+	*f = frameCounter{frame: f.frame + 1, startClock: gb.cpu.clock}
+}
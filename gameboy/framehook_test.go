@@ -0,0 +1,48 @@
+package gameboy
+
+import "testing"
+
+func TestFrameHook(t *testing.T) {
+	gb := NewMachine(newTestROM(0x18, 0xFE), false)
+	gb.Write(0xFF41, 0x08) // STAT interrupt on HBlank
+
+	var frames []FrameInfo
+	gb.SetFrameHook(func(info FrameInfo) {
+		frames = append(frames, info)
+	})
+
+	stepFrames := func(n int) {
+		for want := len(frames) + n; len(frames) < want; {
+			gb.Step()
+		}
+	}
+
+	stepFrames(5)
+	for i, f := range frames {
+		if f.Frame != uint64(i) {
+			t.Errorf("frame %d: expected frame number %d, got %d", i, i, f.Frame)
+		}
+		if !f.VBlankInterrupt || !f.StatInterrupt {
+			t.Errorf("frame %d: expected VBlank and STAT interrupts, got vblank=%v stat=%v", i, f.VBlankInterrupt, f.StatInterrupt)
+		}
+		if i > 0 && f.Cycles != 70224 {
+			t.Errorf("frame %d: expected 70224 cycles, got %d", i, f.Cycles)
+		}
+	}
+
+	// Without STAT sources or the LCD, no interrupts fire.
+	gb.Write(0xFF41, 0x00)
+	gb.Write(0xFF40, 0x00)
+	frames = nil
+	stepFrames(1)
+	if f := frames[0]; f.Frame != 5 || f.VBlankInterrupt || f.StatInterrupt {
+		t.Errorf("expected frame 5 without interrupts, got %+v", f)
+	}
+
+	gb.SetFrameHook(nil)
+	gb.StepFrame()
+	gb.StepFrame()
+	if len(frames) != 1 {
+		t.Errorf("expected hook to be disabled, got %d frames", len(frames))
+	}
+}
@@ -1,17 +1,123 @@
+// Package gameboy emulates the Nintendo GameBoy.
+//
+// Emulation is deterministic: all timing is derived from emulated clock
+// cycles, never from the wall clock, so a Machine created with the same
+// options and cartridge and given the same input on the same frames always
+// produces the same video, audio and memory. Tests may rely on this to compare
+// framebuffers or hashes between runs.
 package gameboy
 
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+)
+
 // Machine is... the Nintendo GameBoy.
 type Machine struct {
 	bus  Bus
 	cpu  CPU
 	ppu  PPU
 	apu  APU
+	wram WRAM
 	cart IO
+
+	// Options the machine was created with, for Reset
+	opts Options
+
+	// Boot ROM state
+	bootROM       ROM
+	bootLocked    bool
+	onBootHandoff func()
+
+	// Accesses to unimplemented registers
+	unimplemented unimplementedIO
+
+	// Super GameBoy border
+	sgb sgbBorder
+
+	// LCD ghosting, set by SetLCDGhosting
+	ghosting lcdGhosting
+
+	// Active GIF recording
+	gif *gifRecorder
+
+	// Instruction history, for StepBack
+	history *stepHistory
+
+	// Allow CPU access to VRAM and OAM while the PPU is using them
+	relaxedPPUAccess bool
+
+	// Functions run in place of opcodes, set by SetOpcodeHook
+	opcodeHooks [256]func(gb *Machine) bool
+
+	// Memory access counts, if enabled
+	accessStats *AccessStats
+
+	// Advance the machine only with TickCycle, set by SetExternalClock
+	externalClock bool
+
+	// Frame completion hook, set by SetFrameHook
+	onFrame      func(info FrameInfo)
+	frameCounter frameCounter
+
+	// Addresses passed to SetCPUState.
+	stateAddrs []uint16
+}
+
+// Model selects the GameBoy hardware to emulate.
+type Model int
+
+const (
+	// ModelDMG is the original GameBoy.
+	ModelDMG Model = iota
+
+	// ModelCGB is the GameBoy Color.
+	ModelCGB
+)
+
+// Options configures a new Machine.
+type Options struct {
+	// Model is the hardware to emulate. The default is ModelDMG.
+	Model Model
+
+	// UseBootROM runs the boot ROM at power-on. Otherwise, the machine starts
+	// at 0x0100 in the state the boot ROM leaves it in.
+	UseBootROM bool
+
+	// BootROM replaces the built-in DMG boot ROM. Only the first 256 bytes
+	// are mapped.
+	BootROM []byte
+
+	// RAMInit is the power-on contents of work RAM, high RAM and video RAM.
+	RAMInit RAMInit
+
+	// AudioSampleRate is the audio sample rate, in Hz. The default, used for
+	// rates of 0 or less, is 44100.
+	AudioSampleRate int
+
+	// AudioResampler selects how audio is resampled to the sample rate.
+	AudioResampler ResampleMode
 }
 
 // NewMachine creates a new GameBoy machine.
 func NewMachine(cart IO, useBootrom bool) *Machine {
+	return NewMachineWithOptions(cart, Options{UseBootROM: useBootrom})
+}
+
+// NewMachineWithOptions creates a new GameBoy machine configured by opts.
+func NewMachineWithOptions(cart IO, opts Options) *Machine {
 	gb := new(Machine)
+	gb.opts = opts
+
+	// Boot ROM
+	gb.bootROM = dmgBootROM
+	if opts.BootROM != nil {
+		gb.bootROM = ROM(opts.BootROM)
+	}
+	if len(gb.bootROM) > 0x100 {
+		gb.bootROM = gb.bootROM[:0x100]
+	}
 
 	// Cartridge
 	gb.cart = cart
@@ -30,9 +136,8 @@ func NewMachine(cart IO, useBootrom bool) *Machine {
 	}
 
 	// Work RAM
-	wram := &WRAM{}
 	for i := 0xC000; i < 0xFE00; i++ {
-		gb.bus.io[i] = wram
+		gb.bus.io[i] = &gb.wram
 	}
 
 	// Sprite attribute table
@@ -42,8 +147,6 @@ func NewMachine(cart IO, useBootrom bool) *Machine {
 
 	// CPU registers
 	gb.bus.io[0xFF00] = &gb.cpu
-	gb.bus.io[0xFF01] = &gb.cpu
-	gb.bus.io[0xFF02] = &gb.cpu
 	gb.bus.io[0xFF04] = &gb.cpu
 	gb.bus.io[0xFF05] = &gb.cpu
 	gb.bus.io[0xFF06] = &gb.cpu
@@ -51,6 +154,12 @@ func NewMachine(cart IO, useBootrom bool) *Machine {
 	gb.bus.io[0xFF0F] = &gb.cpu
 	gb.bus.io[0xFF46] = &gb.cpu
 
+	// APU registers and wave RAM
+	gb.apu.Reset()
+	for i := 0xFF10; i < 0xFF40; i++ {
+		gb.bus.io[i] = &gb.apu
+	}
+
 	// PPU registers
 	gb.bus.io[0xFF40] = &gb.ppu
 	gb.bus.io[0xFF41] = &gb.ppu
@@ -63,6 +172,7 @@ func NewMachine(cart IO, useBootrom bool) *Machine {
 	gb.bus.io[0xFF49] = &gb.ppu
 	gb.bus.io[0xFF4A] = &gb.ppu
 	gb.bus.io[0xFF4B] = &gb.ppu
+	gb.bus.io[0xFF4F] = &gb.ppu
 
 	// High RAM
 	for i := 0xFF80; i < 0xFFFF; i++ {
@@ -72,13 +182,28 @@ func NewMachine(cart IO, useBootrom bool) *Machine {
 	// Interrupt Enable Register
 	gb.bus.io[0xFFFF] = &gb.cpu
 
-	if useBootrom {
+	// Unimplemented registers
+	gb.unimplemented.gb = gb
+	for i := 0xFF00; i < 0xFF80; i++ {
+		if gb.bus.io[i] == nil {
+			gb.bus.io[i] = &gb.unimplemented
+		}
+	}
+
+	// Audio output
+	if opts.AudioSampleRate > 0 {
+		gb.apu.setSampleRate(opts.AudioSampleRate)
+	}
+	gb.apu.setResampler(opts.AudioResampler)
+
+	if opts.UseBootROM {
 		// Setup boot ROM
-		for i := 0; i < len(dmgBootROM); i++ {
-			gb.bus.io[i] = dmgBootROM
+		for i := 0; i < len(gb.bootROM); i++ {
+			gb.bus.io[i] = gb.bootROM
 		}
 	} else {
 		// Simulate boot ROM side-effects
+		gb.bootLocked = true
 		gb.cpu.b = 0x00
 		gb.cpu.c = 0x13
 		gb.cpu.d = 0x00
@@ -86,59 +211,287 @@ func NewMachine(cart IO, useBootrom bool) *Machine {
 		gb.cpu.h = 0x01
 		gb.cpu.l = 0x4d
 		gb.cpu.a = 0x01
+		if opts.Model == ModelCGB {
+			gb.cpu.a = 0x11
+		}
 		gb.cpu.f = 0xb0
 		gb.cpu.sp = 0xfffe
 		gb.cpu.pc = 0x0100
+
+		gb.ppu.Reset()
+		gb.ppu.Write(0xFF40, 0x91)
+		gb.ppu.Write(0xFF47, 0xFC)
+		gb.ppu.Write(0xFF48, 0xFF)
+		gb.ppu.Write(0xFF49, 0xFF)
+
+		gb.apu.Write(0xFF26, 0x80)
+		gb.apu.Write(0xFF24, 0x77)
+		gb.apu.Write(0xFF25, 0xF3)
 	}
 
+	// Model
+	gb.ppu.cgb = opts.Model == ModelCGB
+	gb.sgb.reset()
+
+	// Power-on RAM contents
+	opts.RAMInit.fill(gb.wram[:])
+	opts.RAMInit.fill(gb.cpu.hram[:])
+	opts.RAMInit.fill(gb.ppu.vram[:])
+
 	return gb
 }
 
 func (gb *Machine) lockBootROM() {
+	gb.bootLocked = true
+
 	// This remaps the cart to the bus, for the first 0x100 bytes.
-	for i := 0; i < len(dmgBootROM); i++ {
+	for i := 0; i < len(gb.bootROM); i++ {
 		gb.bus.io[i] = gb.cart
 	}
 }
 
+// SetBootHandoffCallback sets a function to be called when the boot ROM
+// unmaps itself and hands off to the cartridge.
+func (gb *Machine) SetBootHandoffCallback(callback func()) {
+	gb.onBootHandoff = callback
+}
+
 // UpdatePad updates the state of the gamepad.
 func (gb *Machine) UpdatePad(pad Gamepad) {
 	gb.cpu.gamepad = pad
+	gb.checkPad()
 }
 
-// SetTrace enables or disables instruction tracing.
+// SetTrace enables or disables instruction tracing to standard output, or to
+// the writer set by SetTraceWriter.
 func (gb *Machine) SetTrace(trace bool) {
 	gb.cpu.trace = trace
+	gb.cpu.traceOut = nil
+	gb.cpu.traceVBlanks = 0
+}
+
+// SetTraceWriter sets the writer used for tracing enabled by SetTrace. A nil
+// writer restores standard output.
+func (gb *Machine) SetTraceWriter(w io.Writer) {
+	gb.cpu.traceWriter = w
+}
+
+// TraceNextFrame traces instructions to w until the PPU next enters VBlank,
+// then disables tracing. Call it after StepFrame to trace one whole frame.
+func (gb *Machine) TraceNextFrame(w io.Writer) {
+	gb.cpu.trace = true
+	gb.cpu.traceOut = w
+	gb.cpu.traceVBlanks = 1
+
+	// StepFrame may return just before the PPU enters VBlank. That VBlank
+	// ends the previous frame, so trace until the one after.
+	if gb.ppu.clock == 65664 {
+		gb.cpu.traceVBlanks = 2
+	}
+}
+
+// SetStrictPPUAccess sets whether the CPU is blocked from VRAM during mode 3
+// and from OAM during modes 2 and 3, as on hardware: blocked reads return 0xFF
+// and blocked writes are ignored. It is enabled by default. Disabling it
+// deviates from hardware, but can help when debugging rendering. Read and
+// Write are never blocked.
+func (gb *Machine) SetStrictPPUAccess(strict bool) {
+	gb.relaxedPPUAccess = !strict
+}
+
+// SetOpcodeHook sets a function to run when the CPU executes the given opcode,
+// after it has been fetched. If fn returns true, the opcode is treated as
+// handled and the normal implementation is skipped; fn is then responsible for
+// fetching any operands and updating the CPU state. A nil fn removes the hook.
+// Hooking 0xCB intercepts all CB-prefixed instructions, before the second byte
+// is fetched.
+func (gb *Machine) SetOpcodeHook(op uint8, fn func(gb *Machine) bool) {
+	gb.opcodeHooks[op] = fn
+}
+
+// SetAudioSink sets the function that receives audio samples. Samples are
+// produced at the rate set by SetAudioSampleRate, 44100 Hz by default.
+func (gb *Machine) SetAudioSink(sink AudioSink) {
+	gb.apu.sink = sink
+}
+
+// SetAudioSampleRate sets the rate, in Hz, at which audio samples are produced.
+// Rates of 0 or less restore the default of 44100 Hz.
+func (gb *Machine) SetAudioSampleRate(hz int) {
+	gb.apu.setSampleRate(hz)
+}
+
+// SetAudioResampler sets how audio is resampled to the sample rate. The
+// default, ResampleNearest, is the fastest; ResampleLowPass sounds best.
+func (gb *Machine) SetAudioResampler(mode ResampleMode) {
+	gb.apu.setResampler(mode)
+}
+
+// SetStackBounds enables stack checking, a debugging aid. After each push and
+// pop, the stack callback is called if SP is outside of lo to hi, inclusive.
+func (gb *Machine) SetStackBounds(lo, hi uint16) {
+	gb.cpu.stackCheck = true
+	gb.cpu.stackLo, gb.cpu.stackHi = lo, hi
+}
+
+// ClearStackBounds disables stack checking.
+func (gb *Machine) ClearStackBounds() {
+	gb.cpu.stackCheck = false
+}
+
+// SetStackCallback sets the function called with SP when it moves outside of
+// the bounds set by SetStackBounds.
+func (gb *Machine) SetStackCallback(callback func(sp uint16)) {
+	gb.cpu.onStackViolation = callback
 }
 
-// GetFrameBuffer grabs the PPU framebuffer.
+// GetFrameBuffer grabs the PPU framebuffer. Each word holds one pixel as
+// 0xAARRGGBB: alpha in the most significant byte, then red, green and blue in
+// the least significant byte. The in-memory byte order of the words depends
+// on the host; use FrameBufferRGBA for a fixed byte order.
 func (gb *Machine) GetFrameBuffer() *[160 * 144]uint32 {
 	return &gb.ppu.screen
 }
 
+// RenderInto copies the PPU framebuffer into dst, which must hold exactly
+// 160*144 pixels, in the same format as GetFrameBuffer. Unlike GetFrameBuffer,
+// the caller cannot modify the emulator's framebuffer through dst.
+func (gb *Machine) RenderInto(dst []uint32) error {
+	if len(dst) != len(gb.ppu.screen) {
+		return fmt.Errorf("framebuffer must hold %d pixels, got %d", len(gb.ppu.screen), len(dst))
+	}
+	copy(dst, gb.ppu.screen[:])
+	return nil
+}
+
+// FrameBufferRGBA returns a copy of the PPU framebuffer as bytes in R, G, B, A
+// order, four bytes per pixel, regardless of host endianness.
+func (gb *Machine) FrameBufferRGBA() []byte {
+	pix := make([]byte, len(gb.ppu.screen)*4)
+	for i, c := range gb.ppu.screen {
+		pix[i*4+0], pix[i*4+1], pix[i*4+2], pix[i*4+3] = colorRGBA(c)
+	}
+	return pix
+}
+
+// FrameHash returns a 64-bit FNV-1a hash of the PPU framebuffer, in the byte
+// order of FrameBufferRGBA. It is stable across hosts, for compact golden-image
+// tests.
+func (gb *Machine) FrameHash() uint64 {
+	h := fnv.New64a()
+	h.Write(gb.FrameBufferRGBA())
+	return h.Sum64()
+}
+
 // Read reads a byte from memory.
 func (gb *Machine) Read(addr uint16) uint8 {
+	if gb.accessStats != nil {
+		gb.accessStats.Reads[memoryRegion(addr)]++
+	}
+	return gb.Peek(addr)
+}
+
+// Peek reads a byte from memory like Read, but is not counted in
+// AccessStats. Debuggers and other tools should use it to inspect memory, so
+// that profiling counts only measure the game.
+func (gb *Machine) Peek(addr uint16) uint8 {
+	if addr == 0xFF00 && gb.sgb.enabled {
+		return gb.sgbReadP1(gb.bus.Read(addr))
+	}
 	return gb.bus.Read(addr)
 }
 
 // Write writes a byte to memory.
 func (gb *Machine) Write(addr uint16, value uint8) {
-	if addr == 0xff50 {
+	if addr == 0xff50 && !gb.bootLocked {
 		gb.lockBootROM()
+		if gb.onBootHandoff != nil {
+			gb.onBootHandoff()
+		}
+	}
+
+	if gb.history != nil {
+		gb.recordWrite(addr)
+	}
+	if gb.accessStats != nil {
+		gb.accessStats.Writes[memoryRegion(addr)]++
+	}
+
+	if addr == 0xFF00 && gb.sgb.enabled {
+		gb.sgbWriteP1(value)
 	}
 
 	gb.bus.Write(addr, value)
 }
 
-// Step increments the machine at the most atomic level.
+// ReadRange reads n bytes of memory starting at addr, without consuming any
+// cycles. Like Peek, the reads are not counted in AccessStats. The range is clamped to the end of the address space.
+func (gb *Machine) ReadRange(addr uint16, n int) []byte {
+	if n > 0x10000-int(addr) {
+		n = 0x10000 - int(addr)
+	}
+	if n < 0 {
+		n = 0
+	}
+
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = gb.Peek(addr + uint16(i))
+	}
+	return data
+}
+
+// WriteRange writes data to memory starting at addr, without consuming any
+// cycles. Bytes past the end of the address space are dropped.
+func (gb *Machine) WriteRange(addr uint16, data []byte) {
+	if len(data) > 0x10000-int(addr) {
+		data = data[:0x10000-int(addr)]
+	}
+
+	for i, value := range data {
+		gb.Write(addr+uint16(i), value)
+	}
+}
+
+// Step increments the machine at the most atomic level. With the external
+// clock enabled, it ticks the clock itself until the instruction's cycles are
+// paid, as the host would with TickCycle.
 func (gb *Machine) Step() {
+	if gb.externalClock {
+		gb.payPendingCycles()
+		gb.TickCycle()
+		gb.payPendingCycles()
+		return
+	}
 	gb.stepInstruction()
 }
 
+// StepSafe runs one instruction like Step, but recovers from panics and
+// returns them as errors. An undefined opcode returns *UndefinedOpcodeError;
+// any other error is a bug in the emulator. This allows arbitrary code to be
+// run, as when fuzzing. The machine state after an error is unspecified.
+func (gb *Machine) StepSafe() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			var ok bool
+
+			if err, ok = r.(error); ok {
+				return
+			}
+
+			err = fmt.Errorf("%s", r)
+		}
+	}()
+
+	gb.Step()
+
+	return nil
+}
+
 // StepUntilStop runs the CPU until STOP.
 func (gb *Machine) StepUntilStop() {
 	for !gb.cpu.stop {
-		gb.stepInstruction()
+		gb.Step()
 	}
 }
 
@@ -154,13 +507,91 @@ func (gb *Machine) StepFrame() uint {
 	return gb.cpu.clock - startClock
 }
 
-// stepCycle forwards the state of the Gameboy while the CPU is running.
+// endFrame is called when the PPU finishes drawing a frame.
+func (gb *Machine) endFrame() {
+	if gb.cpu.traceVBlanks > 0 {
+		gb.cpu.traceVBlanks--
+		if gb.cpu.traceVBlanks == 0 {
+			gb.SetTrace(false)
+		}
+	}
+	if gb.ghosting.factor > 0 {
+		gb.ghosting.apply(&gb.ppu.screen)
+	}
+	if gb.sgb.enabled {
+		gb.sgbEndFrame()
+	}
+	if gb.gif != nil {
+		gb.gif.addFrame(&gb.ppu.screen)
+	}
+	gb.finishFrame()
+}
+
+// stepCycle forwards the state of the Gameboy while the CPU is running. With
+// an external clock, the cycle is left for TickCycle to run instead.
 func (gb *Machine) stepCycle() {
+	if gb.externalClock {
+		gb.cpu.pendingCycles += 4
+		return
+	}
 	for i := 0; i < 4; i++ {
-		gb.stepDMA()
-		gb.stepPixel()
-		gb.stepAudio()
-		gb.checkTimers()
-		gb.cpu.clock++
+		gb.tick()
+	}
+	gb.checkPad()
+}
+
+// tick forwards everything but the CPU by one clock cycle.
+func (gb *Machine) tick() {
+	gb.stepDMA()
+	gb.stepPixel()
+	gb.stepAudio()
+	gb.checkTimers()
+	gb.cpu.clock++
+}
+
+// SetExternalClock enables or disables driving the machine from an external
+// clock, for lockstep co-simulation. While enabled, the host advances the
+// machine with TickCycle. Step, and the functions built on it, keep working:
+// they tick the clock themselves until the instruction's cycles are paid.
+// Disabling the external clock runs any cycles left over from the last
+// instruction.
+func (gb *Machine) SetExternalClock(enabled bool) {
+	if !enabled {
+		gb.payPendingCycles()
+	}
+	gb.externalClock = enabled
+}
+
+// payPendingCycles ticks the external clock until the cycles of the last
+// instruction are paid.
+func (gb *Machine) payPendingCycles() {
+	for gb.cpu.pendingCycles > 0 {
+		gb.TickCycle()
+	}
+}
+
+// TickCycle advances the machine by one clock cycle while the external clock
+// is enabled. The PPU, APU, timers and OAM DMA advance by exactly one cycle.
+// The CPU runs an instruction at a time: each instruction runs in full on the
+// tick that starts it, and the following ticks pay for its cycles. This is
+// coarser than running with the external clock disabled: all of an
+// instruction's memory accesses happen on its first tick, and see the PPU,
+// timers and DMA up to 20 cycles earlier than on hardware. TickCycle does nothing while the external clock
+// is disabled.
+func (gb *Machine) TickCycle() {
+	if !gb.externalClock {
+		return
+	}
+
+	if gb.cpu.pendingCycles == 0 {
+		gb.stepInstruction()
+	}
+	if gb.cpu.pendingCycles > 0 {
+		gb.cpu.pendingCycles--
+	}
+
+	gb.tick()
+	if gb.cpu.clock%4 == 0 {
+		gb.checkPad()
 	}
 }
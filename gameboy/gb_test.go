@@ -0,0 +1,336 @@
+package gameboy
+
+import (
+	"bytes"
+	"hash/crc32"
+	"testing"
+)
+
+func TestColorRGBA(t *testing.T) {
+	r, g, b, a := colorRGBA(0xFFD7E894)
+	if r != 0xD7 || g != 0xE8 || b != 0x94 || a != 0xFF {
+		t.Errorf("expected rgba=d7e894ff, got rgba=%02x%02x%02x%02x", r, g, b, a)
+	}
+}
+
+func TestFrameBufferRGBA(t *testing.T) {
+	gb := NewMachine(ROM(nil), false)
+	gb.ppu.screen[0] = 0x80112233
+	gb.ppu.screen[160*144-1] = rgbColors[3]
+
+	pix := gb.FrameBufferRGBA()
+	if len(pix) != 160*144*4 {
+		t.Fatalf("expected %d bytes, got %d", 160*144*4, len(pix))
+	}
+	if pix[0] != 0x11 || pix[1] != 0x22 || pix[2] != 0x33 || pix[3] != 0x80 {
+		t.Errorf("expected first pixel 11 22 33 80, got % 02x", pix[0:4])
+	}
+	if last := pix[len(pix)-4:]; last[0] != 0x20 || last[1] != 0x46 || last[2] != 0x31 || last[3] != 0xFF {
+		t.Errorf("expected last pixel 20 46 31 ff, got % 02x", last)
+	}
+}
+
+func TestRenderInto(t *testing.T) {
+	gb := NewMachine(ROM(nil), false)
+	gb.ppu.screen[0] = 0x80112233
+	gb.ppu.screen[160*144-1] = rgbColors[3]
+
+	dst := make([]uint32, 160*144)
+	if err := gb.RenderInto(dst); err != nil {
+		t.Fatal(err)
+	}
+	if dst[0] != 0x80112233 || dst[160*144-1] != rgbColors[3] {
+		t.Errorf("expected framebuffer to be copied, got %08x, %08x", dst[0], dst[160*144-1])
+	}
+
+	dst[0] = 0
+	if gb.ppu.screen[0] != 0x80112233 {
+		t.Error("expected framebuffer not to be modified through dst")
+	}
+
+	for _, n := range []int{0, 160*144 - 1, 160*144 + 1} {
+		if err := gb.RenderInto(make([]uint32, n)); err == nil {
+			t.Errorf("expected error for %d pixel buffer", n)
+		}
+	}
+}
+
+func TestFrameHash(t *testing.T) {
+	draw := func() *Machine {
+		gb := NewMachine(ROM(nil), false)
+		for i := range gb.ppu.screen {
+			gb.ppu.screen[i] = rgbColors[i%7%4]
+		}
+		return gb
+	}
+
+	a, b := draw(), draw()
+	if a.FrameHash() != b.FrameHash() {
+		t.Errorf("expected equal hashes, got %016x and %016x", a.FrameHash(), b.FrameHash())
+	}
+
+	b.ppu.screen[160*72+80] = rgbColors[(72*160+80)%7%4^1]
+	if a.FrameHash() == b.FrameHash() {
+		t.Errorf("expected changed pixel to change hash %016x", a.FrameHash())
+	}
+}
+
+func TestPostBootPPUState(t *testing.T) {
+	gb := NewMachine(ROM(nil), false)
+
+	regs := []struct {
+		addr  uint16
+		value uint8
+	}{
+		{0xFF40, 0x91}, // LCDC
+		{0xFF42, 0x00}, // SCY
+		{0xFF43, 0x00}, // SCX
+		{0xFF45, 0x00}, // LYC
+		{0xFF47, 0xFC}, // BGP
+		{0xFF48, 0xFF}, // OBP0
+		{0xFF49, 0xFF}, // OBP1
+	}
+	for _, reg := range regs {
+		if v := gb.Read(reg.addr); v != reg.value {
+			t.Errorf("expected (%04x)=%02x, got %02x", reg.addr, reg.value, v)
+		}
+	}
+}
+
+func TestNewMachineWithOptions(t *testing.T) {
+	dmg := NewMachine(newTestROM(), false)
+	cgb := NewMachineWithOptions(newTestROM(), Options{Model: ModelCGB})
+
+	// The boot ROM hands off with A=$11 on CGB.
+	if a := dmg.GetCPUState().A; a != 0x01 {
+		t.Errorf("DMG: expected A=$01, got $%02x", a)
+	}
+	if a := cgb.GetCPUState().A; a != 0x11 {
+		t.Errorf("CGB: expected A=$11, got $%02x", a)
+	}
+
+	// VBK only exists on CGB.
+	dmg.Write(0xFF4F, 0x01)
+	cgb.Write(0xFF4F, 0x01)
+	if v := dmg.Read(0xFF4F); v != 0xFF {
+		t.Errorf("DMG: expected VBK=$ff, got $%02x", v)
+	}
+	if v := cgb.Read(0xFF4F); v != 0xFF {
+		t.Errorf("CGB: expected VBK=$ff, got $%02x", v)
+	}
+	cgb.Write(0xFF4F, 0x00)
+	if v := cgb.Read(0xFF4F); v != 0xFE {
+		t.Errorf("CGB: expected VBK=$fe, got $%02x", v)
+	}
+
+	ones := NewMachineWithOptions(newTestROM(), Options{RAMInit: RAMInitOnes})
+	if v := ones.Read(0xC000); v != 0xFF {
+		t.Errorf("RAMInitOnes: expected $ff, got $%02x", v)
+	}
+}
+
+func TestTraceNextFrame(t *testing.T) {
+	gb := NewMachine(newTestROM(0x18, 0xFE), false)
+	gb.StepFrame()
+
+	var buf bytes.Buffer
+	gb.TraceNextFrame(&buf)
+	gb.StepFrame()
+	gb.StepFrame()
+
+	// jr takes 12 cycles; the trace covers one frame of them, give or take
+	// the instruction crossing each VBlank boundary.
+	lines := bytes.Count(buf.Bytes(), []byte("\n"))
+	if want := int(70224 / 12); lines < want-2 || lines > want+2 {
+		t.Errorf("expected about %d lines, got %d", want, lines)
+	}
+	if gb.cpu.trace {
+		t.Error("expected tracing to be disabled")
+	}
+	if !bytes.HasPrefix(buf.Bytes(), []byte("18 fe")) {
+		t.Errorf("expected trace of jr, got %q", buf.String()[:20])
+	}
+}
+
+func TestReadWriteRange(t *testing.T) {
+	gb := NewMachine(newTestROM(), false)
+
+	pattern := make([]byte, 0x100)
+	for i := range pattern {
+		pattern[i] = uint8(i * 7)
+	}
+
+	gb.WriteRange(0xC080, pattern)
+	if data := gb.ReadRange(0xC080, len(pattern)); !bytes.Equal(data, pattern) {
+		t.Errorf("expected pattern to read back, got % x", data)
+	}
+	if data := gb.ReadRange(0xC07F, 1); data[0] != 0x00 {
+		t.Errorf("expected write not to touch $c07f, got $%02x", data[0])
+	}
+
+	// Ranges are clamped at the end of the address space.
+	gb.WriteRange(0xFFFE, []byte{0x12, 0x1F, 0x34})
+	if data := gb.ReadRange(0xFFFE, 4); !bytes.Equal(data, []byte{0x12, 0x1F}) {
+		t.Errorf("expected 12 1f, got % x", data)
+	}
+}
+
+// newBootableTestROM creates a test ROM with a header that passes the boot
+// ROM's logo and checksum verification.
+func newBootableTestROM(program ...byte) ROM {
+	rom := newTestROM(program...)
+
+	// The boot ROM carries its own copy of the logo to compare against.
+	copy(rom[0x104:0x134], dmgBootROM[0xA8:0xD8])
+
+	var checksum uint8
+	for _, b := range rom[0x134:0x14D] {
+		checksum = checksum - b - 1
+	}
+	rom[0x14D] = checksum
+
+	return rom
+}
+
+func TestBootLogo(t *testing.T) {
+	gb := NewMachine(newBootableTestROM(), true)
+
+	for gb.cpu.pc != 0x100 {
+		gb.Step()
+		if gb.cpu.clock > 400*70224 {
+			t.Fatal("boot ROM did not hand off to the cartridge")
+		}
+	}
+
+	// The logo has finished scrolling into the center of the screen.
+	if scy := gb.Read(0xFF42); scy != 0 {
+		t.Errorf("expected SCY 0 at handoff, got %d", scy)
+	}
+	for y := 0; y < 144; y++ {
+		lit := false
+		for x := 0; x < 160; x++ {
+			lit = lit || pixelAt(gb, x, y) != 0
+		}
+		if lit != (y >= 64 && y < 80) {
+			t.Errorf("line %d: expected logo only on lines 64-79", y)
+		}
+	}
+
+	if crc := crc32.ChecksumIEEE(gb.FrameBufferRGBA()); crc != 0x776a686e {
+		t.Errorf("expected framebuffer CRC 776a686e, got %08x", crc)
+	}
+}
+
+func TestBootHandoffCallback(t *testing.T) {
+	rom := newTestROM()
+	rom[0x0000] = 0x5A
+	gb := NewMachine(rom, true)
+
+	calls := 0
+	gb.SetBootHandoffCallback(func() {
+		calls++
+		if gb.Read(0x0000) != 0x5A {
+			t.Error("expected cartridge to be mapped when the callback fires")
+		}
+	})
+
+	gb.Write(0xFF50, 0x01)
+	gb.Write(0xFF50, 0x01)
+
+	if calls != 1 {
+		t.Errorf("expected callback to fire once, got %d calls", calls)
+	}
+}
+
+func TestExternalClock(t *testing.T) {
+	// Count in WRAM, forever.
+	rom := newTestROM(
+		0x21, 0x00, 0xC0, // ld hl, $c000
+		0x34,       // inc (hl)
+		0x18, 0xFD, // jr $0103
+	)
+
+	gb := NewMachine(rom, false)
+	gb.Write(0xFF41, 0x40) // STAT interrupt on LYC
+	gb.Write(0xFF45, 100)
+	gb.Write(0xFF0F, 0x00)
+
+	frames := 0
+	gb.SetFrameHook(func(info FrameInfo) {
+		frames++
+	})
+
+	gb.SetExternalClock(true)
+	for i := 0; i < 70224; i++ {
+		gb.TickCycle()
+	}
+
+	if frames != 1 {
+		t.Errorf("expected 1 frame, got %d", frames)
+	}
+	if gb.cpu.clock != 70224 {
+		t.Errorf("expected 70224 cycles, got %d", gb.cpu.clock)
+	}
+	if gb.ppu.clock != 0 {
+		t.Errorf("expected the PPU to be back at the start of the frame, got dot %d", gb.ppu.clock)
+	}
+	if irq := gb.Read(0xFF0F) & 0x1F; irq != intVBlank|intLCDStat {
+		t.Errorf("expected VBlank and STAT interrupts requested, got IF=%02x", irq)
+	}
+
+	// The CPU runs the same instructions as when stepped normally.
+	ref := NewMachine(rom, false)
+	for ref.cpu.clock < 70224 {
+		ref.Step()
+	}
+	if a, b := gb.Read(0xC000), ref.Read(0xC000); a != b {
+		t.Errorf("expected counter %02x, got %02x", b, a)
+	}
+	if pending := gb.cpu.pendingCycles; gb.cpu.clock+pending != ref.cpu.clock {
+		t.Errorf("expected %d cycles run by the CPU, got %d", ref.cpu.clock, gb.cpu.clock+pending)
+	}
+
+	gb.SetExternalClock(false)
+	if gb.cpu.pendingCycles != 0 || gb.cpu.clock != ref.cpu.clock {
+		t.Errorf("expected pending cycles to be run, got clock=%d pending=%d", gb.cpu.clock, gb.cpu.pendingCycles)
+	}
+
+	// Step ticks the external clock itself, so StepFrame still finishes.
+	gb.SetExternalClock(true)
+	gb.StepFrame()
+	if gb.ppu.clock < 65664 {
+		t.Errorf("expected StepFrame to stop in VBlank, got dot %d", gb.ppu.clock)
+	}
+	if gb.cpu.pendingCycles != 0 {
+		t.Errorf("expected no pending cycles after Step, got %d", gb.cpu.pendingCycles)
+	}
+}
+
+func TestExternalClockAccessTiming(t *testing.T) {
+	rom := newTestROM(
+		0x3E, 0x55, // ld a, $55
+		0xEA, 0x00, 0xC0, // ld ($c000), a
+		0x18, 0xFE, // jr -2
+	)
+	gb := NewMachine(rom, false)
+	gb.Write(0xC000, 0x00)
+	gb.SetExternalClock(true)
+
+	// Run ld a, $55.
+	for i := 0; i < 8; i++ {
+		gb.TickCycle()
+	}
+	if gb.Read(0xC000) != 0x00 || gb.cpu.pendingCycles != 0 {
+		t.Fatalf("expected ld a to be paid, got pending=%d", gb.cpu.pendingCycles)
+	}
+
+	// The store happens on hardware in its last M-cycle, but is seen on the
+	// first tick of the instruction.
+	gb.TickCycle()
+	if v := gb.Read(0xC000); v != 0x55 {
+		t.Errorf("expected the write on the first tick, got %02x", v)
+	}
+	if gb.cpu.pendingCycles != 15 {
+		t.Errorf("expected 15 cycles left to pay, got %d", gb.cpu.pendingCycles)
+	}
+}
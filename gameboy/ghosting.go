@@ -0,0 +1,58 @@
+package gameboy
+
+// lcdGhosting emulates the slow response of the DMG LCD by blending each frame
+// with the previous output.
+type lcdGhosting struct {
+	factor float64
+	primed bool // out holds a frame
+	out    [160 * 144]uint32
+}
+
+// blendChannel blends one 8-bit channel of cur towards prev.
+func blendChannel(cur, prev uint32, shift uint, factor float64) uint32 {
+	c, p := float64(cur>>shift&0xFF), float64(prev>>shift&0xFF)
+	return uint32(c+(p-c)*factor+0.5) << shift
+}
+
+// apply blends the finished frame in screen into the previous output. screen
+// is left untouched.
+func (g *lcdGhosting) apply(screen *[160 * 144]uint32) {
+	if !g.primed {
+		g.out = *screen
+		g.primed = true
+		return
+	}
+
+	for i, c := range screen {
+		p := g.out[i]
+		g.out[i] = 0xFF000000 |
+			blendChannel(c, p, 16, g.factor) |
+			blendChannel(c, p, 8, g.factor) |
+			blendChannel(c, p, 0, g.factor)
+	}
+}
+
+// SetLCDGhosting blends each frame with the previous output, emulating the
+// slow response of the original LCD. The factor is the weight of the previous
+// output, from 0 to 1; 0 disables ghosting. The blended frames go to a
+// separate buffer, returned by GetDisplayFrameBuffer; GetFrameBuffer and the
+// other framebuffer functions keep returning the frame the PPU drew.
+func (gb *Machine) SetLCDGhosting(factor float64) {
+	if factor < 0 {
+		factor = 0
+	} else if factor > 1 {
+		factor = 1
+	}
+	gb.ghosting = lcdGhosting{factor: factor}
+}
+
+// GetDisplayFrameBuffer grabs the frame to show to the user. With LCD ghosting
+// enabled, it holds the blended output, updated once each frame is finished;
+// otherwise it is the PPU framebuffer returned by GetFrameBuffer. The pixel
+// format is the same as GetFrameBuffer.
+func (gb *Machine) GetDisplayFrameBuffer() *[160 * 144]uint32 {
+	if gb.ghosting.factor > 0 {
+		return &gb.ghosting.out
+	}
+	return &gb.ppu.screen
+}
@@ -0,0 +1,39 @@
+package gameboy
+
+import "testing"
+
+func TestLCDGhosting(t *testing.T) {
+	gb := NewMachine(ROM(nil), false)
+	gb.SetLCDGhosting(0.5)
+
+	fill := func(c uint32) {
+		for i := range gb.ppu.screen {
+			gb.ppu.screen[i] = c
+		}
+		gb.endFrame()
+		if s := gb.ppu.screen[0]; s != c {
+			t.Errorf("expected PPU framebuffer %08x, got %08x", c, s)
+		}
+	}
+
+	fill(0xFF000000)
+	if c := gb.GetDisplayFrameBuffer()[0]; c != 0xFF000000 {
+		t.Errorf("expected first frame unchanged, got %08x", c)
+	}
+
+	fill(0xFF80FF40)
+	if c := gb.GetDisplayFrameBuffer()[0]; c != 0xFF408020 {
+		t.Errorf("expected blended pixel ff408020, got %08x", c)
+	}
+
+	// The output keeps converging on the new color.
+	fill(0xFF80FF40)
+	if c := gb.GetDisplayFrameBuffer()[0]; c != 0xFF60C030 {
+		t.Errorf("expected blended pixel ff60c030, got %08x", c)
+	}
+
+	gb.SetLCDGhosting(0)
+	if gb.GetDisplayFrameBuffer() != gb.GetFrameBuffer() {
+		t.Errorf("expected the PPU framebuffer with ghosting disabled")
+	}
+}
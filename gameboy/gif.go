@@ -0,0 +1,72 @@
+package gameboy
+
+// This file implements recording of the screen to animated GIFs.
+
+import (
+	"image"
+	"image/color"
+	"image/gif"
+	"io"
+)
+
+// gifRecorder collects frames for an animated GIF.
+type gifRecorder struct {
+	w     io.Writer
+	every int
+	count int
+	anim  gif.GIF
+}
+
+// gifPalette returns the framebuffer shades as a palette.
+func gifPalette() color.Palette {
+	palette := make(color.Palette, len(rgbColors))
+	for i, c := range rgbColors {
+		r, g, b, a := colorRGBA(c)
+		palette[i] = color.RGBA{r, g, b, a}
+	}
+	return palette
+}
+
+// addFrame adds the framebuffer to the animation, if it is due.
+func (rec *gifRecorder) addFrame(screen *[160 * 144]uint32) {
+	rec.count++
+	if (rec.count-1)%rec.every != 0 {
+		return
+	}
+
+	img := image.NewPaletted(image.Rect(0, 0, 160, 144), gifPalette())
+	for i, c := range screen {
+		img.Pix[i] = uint8(img.Palette.Index(color.RGBA{
+			R: uint8(c >> 16),
+			G: uint8(c >> 8),
+			B: uint8(c >> 0),
+			A: uint8(c >> 24),
+		}))
+	}
+
+	// GIF delays are in hundredths of a second.
+	delay := (rec.every*70224*100 + apuClockRate/2) / apuClockRate
+
+	rec.anim.Image = append(rec.anim.Image, img)
+	rec.anim.Delay = append(rec.anim.Delay, delay)
+}
+
+// StartGIFRecording starts recording every nth frame to an animated GIF, which
+// is written to w when the recording is stopped.
+func (gb *Machine) StartGIFRecording(w io.Writer, everyNFrames int) {
+	if everyNFrames < 1 {
+		everyNFrames = 1
+	}
+	gb.gif = &gifRecorder{w: w, every: everyNFrames}
+}
+
+// StopGIFRecording stops recording and writes the animated GIF.
+func (gb *Machine) StopGIFRecording() error {
+	rec := gb.gif
+	if rec == nil {
+		return nil
+	}
+	gb.gif = nil
+
+	return gif.EncodeAll(rec.w, &rec.anim)
+}
@@ -0,0 +1,47 @@
+package gameboy
+
+import (
+	"bytes"
+	"image/gif"
+	"testing"
+)
+
+func TestGIFRecording(t *testing.T) {
+	gb := newPPUTestMachine(0x91)
+
+	// BG tile 0: vertical stripes of each color.
+	writeTile(gb, 0x8000, 0x33, 0x0F)
+	gb.Write(0xFF47, 0xE4)
+
+	var buf bytes.Buffer
+	gb.StartGIFRecording(&buf, 2)
+	gb.RunFrames(6, nil)
+	if err := gb.StopGIFRecording(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Frames after stopping are not recorded.
+	gb.StepFrame()
+
+	anim, err := gif.DecodeAll(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(anim.Image) != 3 {
+		t.Fatalf("expected 3 frames, got %d", len(anim.Image))
+	}
+
+	img := anim.Image[2]
+	if len(img.Palette) != 4 {
+		t.Errorf("expected 4 color palette, got %d", len(img.Palette))
+	}
+	for x := 0; x < 8; x++ {
+		if index := int(img.ColorIndexAt(x, 0)); index != pixelAt(gb, x, 0) {
+			t.Errorf("x=%d: expected shade %d, got %d", x, pixelAt(gb, x, 0), index)
+		}
+	}
+	if anim.Delay[0] != 3 {
+		t.Errorf("expected delay of 3, got %d", anim.Delay[0])
+	}
+}
@@ -0,0 +1,166 @@
+package gameboy
+
+// This file implements helpers for running the GameBoy without a display.
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// InputScript maps frame numbers to the gamepad state held from that frame
+// onwards.
+type InputScript map[int]Gamepad
+
+// ParseInputScript parses an input script. Each line contains a frame number
+// followed by the buttons held from that frame on, e.g. "120 start a". A line
+// with only a frame number releases all buttons. Blank lines and lines
+// starting with # are ignored.
+func ParseInputScript(r io.Reader) (InputScript, error) {
+	script := InputScript{}
+	scanner := bufio.NewScanner(r)
+	line := 0
+
+	for scanner.Scan() {
+		line++
+
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		frame, err := strconv.Atoi(fields[0])
+		if err != nil || frame < 0 {
+			return nil, fmt.Errorf("line %d: invalid frame number %q", line, fields[0])
+		}
+
+		var pad Gamepad
+		for _, button := range fields[1:] {
+			switch strings.ToLower(button) {
+			case "down":
+				pad.Down = true
+			case "up":
+				pad.Up = true
+			case "left":
+				pad.Left = true
+			case "right":
+				pad.Right = true
+			case "start":
+				pad.Start = true
+			case "select":
+				pad.Select = true
+			case "b":
+				pad.B = true
+			case "a":
+				pad.A = true
+			default:
+				return nil, fmt.Errorf("line %d: unknown button %q", line, button)
+			}
+		}
+
+		script[frame] = pad
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return script, nil
+}
+
+// RunFrames steps the given number of frames, applying the input script. Frame
+// numbers in the script are relative to the first frame run.
+func (gb *Machine) RunFrames(frames int, script InputScript) {
+	for i := 0; i < frames; i++ {
+		if pad, ok := script[i]; ok {
+			gb.UpdatePad(pad)
+		}
+		gb.StepFrame()
+	}
+}
+
+// FrameImage returns a copy of the PPU framebuffer as an image.
+func (gb *Machine) FrameImage() *image.RGBA {
+	return &image.RGBA{
+		Pix:    gb.FrameBufferRGBA(),
+		Stride: 160 * 4,
+		Rect:   image.Rect(0, 0, 160, 144),
+	}
+}
+
+// stableFrames is the number of times a frame must repeat before
+// StepUntilStableFrame considers it stable.
+const stableFrames = 8
+
+// StepUntilStableFrame steps at least minFrames frames, then until the frame
+// has repeated unchanged stableFrames times, or until maxFrames frames have
+// run, and returns the last frame. This is useful for capturing test ROMs that
+// draw a static screen after setting up; requiring several repeats keeps the
+// blank frames drawn while a ROM sets up from being mistaken for its result.
+func (gb *Machine) StepUntilStableFrame(minFrames, maxFrames int) *image.RGBA {
+	var last uint64
+	stable := 0
+	for i := 0; i < maxFrames; i++ {
+		gb.StepFrame()
+		hash := gb.FrameHash()
+		if i > 0 && hash == last {
+			stable++
+		} else {
+			stable = 0
+		}
+		last = hash
+		if i+1 >= minFrames && stable >= stableFrames {
+			break
+		}
+	}
+	return gb.FrameImage()
+}
+
+// RunToFrame creates a machine for the given ROM and runs it headlessly for
+// the given number of frames, returning the machine and the final frame. It is
+// useful for smoke tests checking that a ROM reaches its title screen.
+func RunToFrame(rom []byte, frame int) (*Machine, *image.RGBA, error) {
+	cart, err := NewCartridge(rom)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	gb := NewMachine(cart, false)
+	gb.RunFrames(frame, nil)
+	return gb, gb.FrameImage(), nil
+}
+
+// CaptureAudio runs the machine until it has produced the given number of
+// audio samples, and returns them, each the mix of the left and right
+// channels. Samples are produced at the rate set by SetAudioSampleRate. The
+// audio sink does not receive the captured samples.
+func (gb *Machine) CaptureAudio(samples int) []float32 {
+	if samples <= 0 {
+		return nil
+	}
+	buf := make([]float32, 0, samples)
+
+	sink := gb.apu.sink
+	defer func() { gb.apu.sink = sink }()
+	gb.apu.sink = func(left, right float32) {
+		if len(buf) < samples {
+			buf = append(buf, (left+right)/2)
+		}
+	}
+	for len(buf) < samples {
+		gb.Step()
+	}
+
+	return buf
+}
+
+// Screenshot runs the given number of frames headlessly, applying the input
+// script, then writes the final frame to w as a PNG.
+func Screenshot(w io.Writer, gb *Machine, frames int, script InputScript) error {
+	gb.RunFrames(frames, script)
+	return png.Encode(w, gb.FrameImage())
+}
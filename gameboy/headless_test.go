@@ -0,0 +1,329 @@
+package gameboy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestROM creates a ROM with the given program at the entry point.
+func newTestROM(program ...byte) ROM {
+	rom := make(ROM, 0x8000)
+	copy(rom[0x100:], program)
+	return rom
+}
+
+func TestParseInputScript(t *testing.T) {
+	script, err := ParseInputScript(strings.NewReader("# intro\n0 start\n\n10 A right\n20\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(script) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(script))
+	}
+	if script[0] != (Gamepad{Start: true}) {
+		t.Errorf("frame 0: expected start, got %+v", script[0])
+	}
+	if script[10] != (Gamepad{A: true, Right: true}) {
+		t.Errorf("frame 10: expected a+right, got %+v", script[10])
+	}
+	if script[20] != (Gamepad{}) {
+		t.Errorf("frame 20: expected no buttons, got %+v", script[20])
+	}
+
+	if _, err := ParseInputScript(strings.NewReader("5 turbo\n")); err == nil {
+		t.Error("expected error for unknown button")
+	}
+}
+
+func TestScreenshot(t *testing.T) {
+	// ld a, $03; ldh (BGP), a; ld a, $91; ldh (LCDC), a; jr -2
+	rom := newTestROM(0x3E, 0x03, 0xE0, 0x47, 0x3E, 0x91, 0xE0, 0x40, 0x18, 0xFE)
+	gb := NewMachine(rom, false)
+
+	var buf bytes.Buffer
+	if err := Screenshot(&buf, gb, 3, InputScript{1: {Start: true}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if gb.cpu.gamepad != (Gamepad{Start: true}) {
+		t.Errorf("expected scripted input to be applied, got %+v", gb.cpu.gamepad)
+	}
+
+	img, err := png.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b := img.Bounds(); b.Dx() != 160 || b.Dy() != 144 {
+		t.Fatalf("expected 160x144 image, got %dx%d", b.Dx(), b.Dy())
+	}
+
+	r, g, b, _ := img.At(80, 72).RGBA()
+	if r>>8 != 0x20 || g>>8 != 0x46 || b>>8 != 0x31 {
+		t.Errorf("expected darkest shade, got %02x%02x%02x", r>>8, g>>8, b>>8)
+	}
+}
+
+func TestDeterministic(t *testing.T) {
+	// Copy the button state into BGP, forever.
+	rom := newTestROM(
+		0x3E, 0x10, // ld a, $10
+		0xE0, 0x00, // ldh ($00), a
+		0xF0, 0x00, // ldh a, ($00)
+		0xE0, 0x47, // ldh ($47), a
+		0x18, 0xF6, // jr $0100
+	)
+
+	run := func(script string) []byte {
+		s, err := ParseInputScript(strings.NewReader(script))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		gb := NewMachineWithOptions(rom, Options{RAMInit: RAMInitDMG})
+		gb.RunFrames(30, s)
+		return gb.FrameBufferRGBA()
+	}
+
+	script := "0\n5 A\n12 start B\n"
+	first, second := run(script), run(script)
+	if !bytes.Equal(first, second) {
+		t.Error("expected identical framebuffers from identical runs")
+	}
+
+	if other := run("0\n5 A\n12 start\n"); bytes.Equal(first, other) {
+		t.Error("expected input to affect the framebuffer")
+	}
+}
+
+func TestStepUntilStableFrame(t *testing.T) {
+	// Step BGP through a shade per frame, then stop.
+	rom := newTestROM(
+		0x21, 0x0F, 0xFF, // ld hl, $ff0f
+		0x3E, 0xE4, // ld a, $e4
+		0xE0, 0x47, // ldh ($47), a
+		0x36, 0x00, // ld (hl), $00
+		0x76,       // halt
+		0x00,       // nop
+		0x3C,       // inc a
+		0xE0, 0x47, // ldh ($47), a
+		0xFE, 0xE8, // cp $e8
+		0x20, 0xF5, // jr nz, $0107
+		0x18, 0xFE, // jr -2
+	)
+	gb := NewMachine(rom, false)
+	gb.Write(0xFFFF, intVBlank)
+
+	img := gb.StepUntilStableFrame(0, 20)
+	if v := gb.Read(0xFF47); v != 0xE8 {
+		t.Errorf("expected BGP=e8, got %02x", v)
+	}
+
+	r, g, b, _ := colorRGBA(rgbColors[0])
+	if c := img.RGBAAt(80, 72); c.R != r || c.G != g || c.B != b {
+		t.Errorf("expected lightest shade, got %02x%02x%02x", c.R, c.G, c.B)
+	}
+}
+
+func TestStepUntilStableFrameSetup(t *testing.T) {
+	// Wait ten frames, then invert BGP.
+	rom := newTestROM(
+		0x21, 0x0F, 0xFF, // ld hl, $ff0f
+		0x0E, 0x0A, // ld c, $0a
+		0x36, 0x00, // ld (hl), $00
+		0x76,       // halt
+		0x00,       // nop
+		0x0D,       // dec c
+		0x20, 0xF9, // jr nz, $0105
+		0x3E, 0x1B, // ld a, $1b
+		0xE0, 0x47, // ldh ($47), a
+		0x18, 0xFE, // jr -2
+	)
+
+	tests := []struct {
+		minFrames int
+		shade     int
+	}{
+		{0, 0},  // the blank frames look stable
+		{12, 3}, // past the setup
+	}
+	for _, test := range tests {
+		gb := NewMachine(rom, false)
+		gb.Write(0xFFFF, intVBlank)
+
+		img := gb.StepUntilStableFrame(test.minFrames, 60)
+		if shade := frameShade(img.At(80, 72)); shade != test.shade {
+			t.Errorf("(min=%d) expected shade %d, got %d", test.minFrames, test.shade, shade)
+		}
+	}
+}
+
+func TestAcid2(t *testing.T) {
+	rom, err := os.ReadFile(filepath.Join("testdata", "dmg-acid2.gb"))
+	if os.IsNotExist(err) {
+		t.Skip("testdata/dmg-acid2.gb not found; run testdata/fetch-acid2.sh")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(filepath.Join("testdata", "dmg-acid2.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	want, err := png.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cart, err := NewCartridge(rom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// dmg-acid2 draws its screen within a few frames; run a fixed count.
+	gb := NewMachine(cart, false)
+	gb.RunFrames(60, nil)
+	got := gb.FrameImage()
+
+	// The reference is greyscale, so compare shades rather than colors.
+	mismatches := 0
+	for y := 0; y < 144; y++ {
+		for x := 0; x < 160; x++ {
+			if frameShade(got.At(x, y)) != referenceShade(want.At(x, y)) {
+				mismatches++
+			}
+		}
+	}
+	if mismatches != 0 {
+		t.Errorf("expected frame to match reference, got %d mismatched pixels", mismatches)
+	}
+}
+
+// frameShade returns the shade drawn as the given framebuffer color, or -1 if
+// it is not one of rgbColors.
+func frameShade(c color.Color) int {
+	r, g, b, _ := c.RGBA()
+	for shade, rgb := range rgbColors {
+		cr, cg, cb, _ := colorRGBA(rgb)
+		if uint8(r>>8) == cr && uint8(g>>8) == cg && uint8(b>>8) == cb {
+			return shade
+		}
+	}
+	return -1
+}
+
+// referenceShade returns the shade of a greyscale reference image pixel, from
+// 0 for white to 3 for black.
+func referenceShade(c color.Color) int {
+	y := color.GrayModel.Convert(c).(color.Gray).Y
+	return (0xFF - int(y) + 0x2A) / 0x55
+}
+
+func TestRunToFrame(t *testing.T) {
+	// Fill tile 0 with stripes, then turn on the LCD.
+	rom := newTestROM(
+		0xAF,       // xor a
+		0xE0, 0x40, // ldh ($40), a
+		0x21, 0x00, 0x80, // ld hl, $8000
+		0x3E, 0xAA, // ld a, $aa
+		0x06, 0x08, // ld b, $08
+		0x22,       // ld (hl+), a
+		0x22,       // ld (hl+), a
+		0x2F,       // cpl
+		0x05,       // dec b
+		0x20, 0xFA, // jr nz, $010a
+		0x3E, 0x91, // ld a, $91
+		0xE0, 0x40, // ldh ($40), a
+		0x18, 0xFE, // jr -2
+	)
+
+	gb, img, err := RunToFrame(rom, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const want = 0x9596f73b4bdefb25
+	if hash := gb.FrameHash(); hash != want {
+		t.Errorf("expected frame hash %016x, got %016x", uint64(want), hash)
+	}
+	if b := img.Bounds(); b.Dx() != 160 || b.Dy() != 144 {
+		t.Fatalf("expected 160x144 image, got %dx%d", b.Dx(), b.Dy())
+	}
+	if a, b := img.RGBAAt(0, 0), img.RGBAAt(1, 0); a == b {
+		t.Errorf("expected stripes, got %v at both (0, 0) and (1, 0)", a)
+	}
+
+	if _, _, err := RunToFrame(newTestROM(), 1); err != nil {
+		t.Errorf("expected ROM only cartridge to run, got %v", err)
+	}
+	bad := newTestROM()
+	bad[0x0147] = 0xFC
+	if _, _, err := RunToFrame(bad, 1); err == nil {
+		t.Error("expected error for unsupported cartridge type")
+	}
+}
+
+func TestCaptureAudio(t *testing.T) {
+	gb := NewMachine(newTestROM(0x18, 0xFE), false)
+
+	sinkCalled := false
+	gb.SetAudioSink(func(left, right float32) {
+		sinkCalled = true
+	})
+
+	// A 512 Hz square wave at full volume on square 1.
+	gb.Write(0xFF11, 0x80)
+	gb.Write(0xFF12, 0xF0)
+	gb.Write(0xFF13, 0x00)
+	gb.Write(0xFF14, 0x87)
+
+	samples := gb.CaptureAudio(4410)
+	if len(samples) != 4410 {
+		t.Fatalf("expected 4410 samples, got %d", len(samples))
+	}
+	if sinkCalled {
+		t.Error("expected captured samples not to reach the sink")
+	}
+
+	lo, hi := samples[0], samples[0]
+	for _, s := range samples {
+		if s < lo {
+			lo = s
+		}
+		if s > hi {
+			hi = s
+		}
+	}
+	if hi-lo < 0.1 {
+		t.Errorf("expected a square wave, got samples from %f to %f", lo, hi)
+	}
+
+	var buf []byte
+	for _, s := range samples {
+		buf = binary.LittleEndian.AppendUint32(buf, math.Float32bits(s))
+	}
+	const want = 0x66cf1568
+	if crc := crc32.ChecksumIEEE(buf); crc != want {
+		t.Errorf("expected samples with CRC %08x, got %08x", uint32(want), crc)
+	}
+
+	gb.StepFrame()
+	if !sinkCalled {
+		t.Error("expected the sink to be restored")
+	}
+
+	// A rate of 0 restores the default rather than stalling the capture.
+	gb.SetAudioSampleRate(0)
+	if samples := gb.CaptureAudio(10); len(samples) != 10 {
+		t.Errorf("expected 10 samples at the default rate, got %d", len(samples))
+	}
+}
@@ -0,0 +1,103 @@
+package gameboy
+
+// stepRecord holds what is needed to undo one instruction: the CPU registers
+// before it ran, and the previous value of each byte of memory it wrote.
+type stepRecord struct {
+	a, f, b, c, d, e, h, l uint8
+	sp, pc                 uint16
+	ie, irq                uint8
+	ime, imeScheduled      bool
+	halt, haltBug, stop    bool
+
+	writes []MemoryByte
+}
+
+// stepHistory is a bounded journal of recently executed instructions.
+type stepHistory struct {
+	records   []stepRecord
+	depth     int
+	recording bool
+}
+
+// begin starts a new record before an instruction runs, dropping the oldest
+// record if the history is full.
+func (h *stepHistory) begin(cpu *CPU) {
+	if len(h.records) == h.depth {
+		copy(h.records, h.records[1:])
+		h.records = h.records[:len(h.records)-1]
+	}
+
+	h.records = append(h.records, stepRecord{
+		a: cpu.a, f: cpu.f, b: cpu.b, c: cpu.c,
+		d: cpu.d, e: cpu.e, h: cpu.h, l: cpu.l,
+		sp: cpu.sp, pc: cpu.pc,
+		ie: cpu.ie, irq: cpu.irq,
+		ime: cpu.ime, imeScheduled: cpu.imeScheduled,
+		halt: cpu.halt, haltBug: cpu.haltBug, stop: cpu.stop,
+	})
+	h.recording = true
+}
+
+// end stops recording writes once the instruction is done.
+func (h *stepHistory) end() {
+	h.recording = false
+}
+
+// journaled returns whether writes to addr are undone by StepBack. Writes to
+// the cartridge mapper and I/O registers have side effects, so they are not.
+func journaled(addr uint16) bool {
+	if addr < 0x8000 || addr == 0xFFFF {
+		return false
+	}
+	return addr < 0xFF00 || addr >= 0xFF80
+}
+
+// recordWrite saves the value at addr before the current instruction writes it.
+func (gb *Machine) recordWrite(addr uint16) {
+	h := gb.history
+	if !h.recording || !journaled(addr) {
+		return
+	}
+
+	r := &h.records[len(h.records)-1]
+	r.writes = append(r.writes, MemoryByte{addr, gb.bus.Read(addr)})
+}
+
+// SetStepHistory enables recording of the last depth instructions, so they
+// can be undone with StepBack. A depth of 0 disables recording and discards
+// the history.
+func (gb *Machine) SetStepHistory(depth int) {
+	if depth <= 0 {
+		gb.history = nil
+		return
+	}
+	gb.history = &stepHistory{depth: depth}
+}
+
+// StepBack undoes the last recorded instruction, restoring the CPU registers
+// and any RAM it wrote. I/O registers, the PPU, APU and timers are not
+// rewound. It returns false if there is nothing to undo.
+func (gb *Machine) StepBack() bool {
+	h := gb.history
+	if h == nil || len(h.records) == 0 {
+		return false
+	}
+
+	r := h.records[len(h.records)-1]
+	h.records = h.records[:len(h.records)-1]
+
+	// Undo writes in reverse, in case an address was written twice.
+	for i := len(r.writes) - 1; i >= 0; i-- {
+		gb.bus.Write(r.writes[i].Addr, r.writes[i].Value)
+	}
+
+	cpu := &gb.cpu
+	cpu.a, cpu.f, cpu.b, cpu.c = r.a, r.f, r.b, r.c
+	cpu.d, cpu.e, cpu.h, cpu.l = r.d, r.e, r.h, r.l
+	cpu.sp, cpu.pc = r.sp, r.pc
+	cpu.ie, cpu.irq = r.ie, r.irq
+	cpu.ime, cpu.imeScheduled = r.ime, r.imeScheduled
+	cpu.halt, cpu.haltBug, cpu.stop = r.halt, r.haltBug, r.stop
+
+	return true
+}
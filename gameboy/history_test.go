@@ -0,0 +1,78 @@
+package gameboy
+
+import "testing"
+
+func TestStepBack(t *testing.T) {
+	gb := NewMachine(newTestROM(
+		0x3E, 0x42, // ld a, $42
+		0xEA, 0x00, 0xC0, // ld ($c000), a
+		0x3C, // inc a
+		0xC5, // push bc
+	), false)
+	gb.Write(0xC000, 0x99)
+	gb.SetStepHistory(8)
+
+	if gb.StepBack() {
+		t.Error("expected nothing to undo")
+	}
+
+	for i := 0; i < 4; i++ {
+		gb.Step()
+	}
+
+	s := gb.GetCPUState()
+	if s.PC != 0x0107 || s.A != 0x43 || s.SP != 0xFFFC {
+		t.Fatalf("expected pc=0107 a=43 sp=fffc, got pc=%04x a=%02x sp=%04x", s.PC, s.A, s.SP)
+	}
+
+	// Undo push bc and inc a.
+	gb.StepBack()
+	gb.StepBack()
+
+	s = gb.GetCPUState()
+	if s.PC != 0x0105 || s.A != 0x42 || s.SP != 0xFFFE {
+		t.Errorf("expected pc=0105 a=42 sp=fffe, got pc=%04x a=%02x sp=%04x", s.PC, s.A, s.SP)
+	}
+	if v := gb.Read(0xFFFC); v != 0x00 {
+		t.Errorf("expected ($fffc)=00, got %02x", v)
+	}
+	if v := gb.Read(0xC000); v != 0x42 {
+		t.Errorf("expected ($c000)=42, got %02x", v)
+	}
+
+	// Undo ld ($c000), a and ld a, $42.
+	gb.StepBack()
+	gb.StepBack()
+
+	s = gb.GetCPUState()
+	if s.PC != 0x0100 || s.A != 0x01 {
+		t.Errorf("expected pc=0100 a=01, got pc=%04x a=%02x", s.PC, s.A)
+	}
+	if v := gb.Read(0xC000); v != 0x99 {
+		t.Errorf("expected ($c000)=99, got %02x", v)
+	}
+
+	if gb.StepBack() {
+		t.Error("expected history to be exhausted")
+	}
+}
+
+func TestStepHistoryBounded(t *testing.T) {
+	gb := NewMachine(newTestROM(0x00, 0x00, 0x00, 0x00), false)
+	gb.SetStepHistory(2)
+
+	for i := 0; i < 4; i++ {
+		gb.Step()
+	}
+
+	undone := 0
+	for gb.StepBack() {
+		undone++
+	}
+	if undone != 2 {
+		t.Errorf("expected 2 instructions undone, got %d", undone)
+	}
+	if pc := gb.GetCPUState().PC; pc != 0x0102 {
+		t.Errorf("expected pc=0102, got %04x", pc)
+	}
+}
@@ -20,9 +20,65 @@ var (
 		0x01: 0x0800,
 		0x02: 0x2000,
 		0x03: 0x8000,
+		0x04: 0x20000,
+		0x05: 0x10000,
 	}
 )
 
+// romBankAddr returns the offset in rom of an address in the switchable ROM
+// area, with the given bank mapped. Banks past the end of the ROM wrap around,
+// as the unused bank select lines are not connected. It returns false if the
+// ROM has no switchable bank.
+func romBankAddr(rom []byte, bank uint, addr uint16) (uint, bool) {
+	banks := uint(len(rom)) >> 14
+	if banks == 0 {
+		return 0, false
+	}
+	return uint(addr&0x3fff) + bank%banks<<14, true
+}
+
+// wrapROMBank returns the bank of rom selected by bank, which wraps around
+// past the end of the ROM like romBankAddr.
+func wrapROMBank(rom []byte, bank uint) uint {
+	if banks := uint(len(rom)) >> 14; banks > 0 {
+		return bank % banks
+	}
+	return bank
+}
+
+// RAMInit selects the contents of RAM at power-on.
+type RAMInit int
+
+const (
+	// RAMInitZero fills RAM with $00.
+	RAMInitZero RAMInit = iota
+
+	// RAMInitOnes fills RAM with $FF.
+	RAMInitOnes
+
+	// RAMInitDMG fills RAM with a pattern resembling a DMG at power-on:
+	// alternating 8 byte runs of $00 and $FF, inverted every 256 bytes.
+	RAMInitDMG
+)
+
+// fill fills mem with the pattern.
+func (pattern RAMInit) fill(mem []byte) {
+	for i := range mem {
+		switch pattern {
+		case RAMInitZero:
+			mem[i] = 0x00
+		case RAMInitOnes:
+			mem[i] = 0xFF
+		case RAMInitDMG:
+			if (i>>3^i>>8)&1 == 0 {
+				mem[i] = 0x00
+			} else {
+				mem[i] = 0xFF
+			}
+		}
+	}
+}
+
 // WRAM represents the work RAM.
 type WRAM [0x2000]byte
 
@@ -52,13 +108,24 @@ func (rom ROM) Write(addr uint16, value uint8) {
 	return
 }
 
+// HasBattery returns false, as cartridges without a MBC chip have no RAM.
+func (rom ROM) HasBattery() bool {
+	return false
+}
+
+// Reset does nothing, as cartridges without a MBC chip have no registers.
+func (rom ROM) Reset() {}
+
 // MBC1Cartridge implements a cartridge containing the MBC1 mapper.
 type MBC1Cartridge struct {
 	rom []byte
 	ram []byte
 
 	enableram bool
+	battery   bool
 
+	// The 5 bit ROM bank register, and the 2 bit secondary register, which
+	// selects the RAM bank and the upper bits of the ROM bank.
 	rombank uint
 	rambank uint
 }
@@ -74,6 +141,24 @@ func NewMBC1Cartridge(rom []byte) *MBC1Cartridge {
 	}
 }
 
+// HasBattery returns whether the cartridge RAM is battery-backed, and so
+// should be saved. This is only known for cartridges created by NewCartridge.
+func (cart *MBC1Cartridge) HasBattery() bool {
+	return cart.battery
+}
+
+// Reset returns the mapper registers to their power-on state, keeping the
+// contents of RAM.
+func (cart *MBC1Cartridge) Reset() {
+	cart.enableram = false
+	cart.rombank = 0
+	cart.rambank = 0
+}
+
+func (cart *MBC1Cartridge) ramBytes() []byte {
+	return cart.ram
+}
+
 // Read reads a byte from memory.
 func (cart *MBC1Cartridge) Read(addr uint16) uint8 {
 	switch {
@@ -85,15 +170,8 @@ func (cart *MBC1Cartridge) Read(addr uint16) uint8 {
 		return cart.rom[addr]
 
 	case addr >= 0x4000 && addr < 0x8000:
-		romaddr := uint(addr & 0x3fff)
-
-		bank := cart.rombank
-		if bank&0x1f == 0 {
-			bank++
-		}
-
-		romaddr += bank << 14
-		if int(romaddr) >= len(cart.rom) {
+		romaddr, ok := romBankAddr(cart.rom, cart.CurrentROMBank(), addr)
+		if !ok {
 			break
 		}
 
@@ -120,6 +198,171 @@ func (cart *MBC1Cartridge) Write(addr uint16, value uint8) {
 	case addr >= 0x0000 && addr < 0x2000:
 		cart.enableram = value&0xf == 0xa
 	case addr >= 0x2000 && addr < 0x4000:
-		cart.rombank = uint(value)
+		cart.rombank = uint(value & 0x1f)
+	case addr >= 0x4000 && addr < 0x6000:
+		cart.rambank = uint(value & 0x3)
+	}
+}
+
+// CurrentROMBank returns the ROM bank mapped at 0x4000-0x7FFF, combining the
+// ROM bank register with the secondary register as the upper 2 bits. A ROM
+// bank register of 0 selects 1 instead, so banks $00, $20, $40 and $60 cannot
+// be mapped there. Banks past the end of the ROM wrap around.
+func (cart *MBC1Cartridge) CurrentROMBank() uint {
+	bank := cart.rombank
+	if bank == 0 {
+		bank++
+	}
+	return wrapROMBank(cart.rom, cart.rambank<<5|bank)
+}
+
+// CurrentRAMBank returns the RAM bank mapped at 0xA000-0xBFFF.
+func (cart *MBC1Cartridge) CurrentRAMBank() uint {
+	return cart.rambank
+}
+
+// MBC5Cartridge implements a cartridge containing the MBC5 mapper.
+type MBC5Cartridge struct {
+	rom []byte
+	ram []byte
+
+	enableram bool
+	battery   bool
+
+	rombank uint
+	rambank uint
+
+	rumble   bool
+	motor    bool
+	onRumble func(on bool)
+}
+
+// NewMBC5Cartridge creates a new MBC5Cartridge with the given ROM. The RAM
+// size and rumble motor are determined from the ROM header.
+func NewMBC5Cartridge(rom []byte) *MBC5Cartridge {
+	cart := &MBC5Cartridge{
+		rom:     rom,
+		rombank: 1,
+	}
+
+	if len(rom) >= 0x150 {
+		cart.ram = make([]byte, ramSize[rom[0x149]])
+		switch rom[0x147] {
+		case 0x1C, 0x1D, 0x1E:
+			cart.rumble = true
+		}
+	}
+
+	return cart
+}
+
+// HasBattery returns whether the cartridge RAM is battery-backed, and so
+// should be saved. This is only known for cartridges created by NewCartridge.
+func (cart *MBC5Cartridge) HasBattery() bool {
+	return cart.battery
+}
+
+// CurrentROMBank returns the ROM bank mapped at 0x4000-0x7FFF.
+func (cart *MBC5Cartridge) CurrentROMBank() uint {
+	return cart.rombank
+}
+
+// CurrentRAMBank returns the RAM bank mapped at 0xA000-0xBFFF.
+func (cart *MBC5Cartridge) CurrentRAMBank() uint {
+	return cart.rambank
+}
+
+// Reset returns the mapper registers to their power-on state, keeping the
+// contents of RAM. The rumble motor is switched off.
+func (cart *MBC5Cartridge) Reset() {
+	cart.enableram = false
+	cart.rombank = 1
+	cart.rambank = 0
+	if cart.motor {
+		cart.motor = false
+		if cart.onRumble != nil {
+			cart.onRumble(false)
+		}
+	}
+}
+
+// SetRumbleCallback sets a function to be called when the rumble motor is
+// switched on or off. It is only called for cartridges with a rumble motor.
+func (cart *MBC5Cartridge) SetRumbleCallback(callback func(on bool)) {
+	cart.onRumble = callback
+}
+
+func (cart *MBC5Cartridge) ramBytes() []byte {
+	return cart.ram
+}
+
+// Read reads a byte from memory.
+func (cart *MBC5Cartridge) Read(addr uint16) uint8 {
+	switch {
+	case addr >= 0x0000 && addr < 0x4000:
+		if int(addr) >= len(cart.rom) {
+			break
+		}
+
+		return cart.rom[addr]
+
+	case addr >= 0x4000 && addr < 0x8000:
+		romaddr, ok := romBankAddr(cart.rom, cart.rombank, addr)
+		if !ok {
+			break
+		}
+
+		return cart.rom[romaddr]
+
+	case addr >= 0xa000 && addr < 0xc000:
+		if !cart.enableram {
+			break
+		}
+
+		ramaddr := uint(addr&0x1fff) + cart.rambank<<13
+		if int(ramaddr) >= len(cart.ram) {
+			break
+		}
+
+		return cart.ram[ramaddr]
+	}
+
+	return 0xff
+}
+
+// Write writes a byte to memory.
+func (cart *MBC5Cartridge) Write(addr uint16, value uint8) {
+	switch {
+	case addr >= 0x0000 && addr < 0x2000:
+		cart.enableram = value&0xf == 0xa
+	case addr >= 0x2000 && addr < 0x3000:
+		cart.rombank = cart.rombank&0x100 | uint(value)
+	case addr >= 0x3000 && addr < 0x4000:
+		cart.rombank = cart.rombank&0xff | uint(value&1)<<8
+	case addr >= 0x4000 && addr < 0x6000:
+		if !cart.rumble {
+			cart.rambank = uint(value & 0xf)
+			break
+		}
+
+		// Bit 3 drives the rumble motor on rumble cartridges.
+		cart.rambank = uint(value & 0x7)
+		if motor := value&0x8 != 0; motor != cart.motor {
+			cart.motor = motor
+			if cart.onRumble != nil {
+				cart.onRumble(motor)
+			}
+		}
+	case addr >= 0xa000 && addr < 0xc000:
+		if !cart.enableram {
+			break
+		}
+
+		ramaddr := uint(addr&0x1fff) + cart.rambank<<13
+		if int(ramaddr) >= len(cart.ram) {
+			break
+		}
+
+		cart.ram[ramaddr] = value
 	}
 }
@@ -0,0 +1,105 @@
+package gameboy
+
+import "testing"
+
+// newTestCartROM creates a ROM of the given number of 16 KiB banks, with the
+// cartridge and RAM size header bytes set. The first byte of each bank holds
+// the bank number.
+func newTestCartROM(banks int, cartType, ramType uint8) []byte {
+	rom := make([]byte, banks*0x4000)
+	for bank := 0; bank < banks; bank++ {
+		rom[bank*0x4000] = uint8(bank)
+	}
+	rom[0x147] = cartType
+	for size := 2; size < banks; size <<= 1 {
+		rom[0x148]++
+	}
+	rom[0x149] = ramType
+	return rom
+}
+
+func TestMBC5Banking(t *testing.T) {
+	cart := NewMBC5Cartridge(newTestCartROM(4, 0x1B, 0x03))
+
+	// MBC5 can map bank 0 into the switchable area.
+	cart.Write(0x2000, 0x00)
+	if bank := cart.Read(0x4000); bank != 0 {
+		t.Errorf("expected bank 0, got %d", bank)
+	}
+	cart.Write(0x2000, 0x03)
+	if bank := cart.Read(0x4000); bank != 3 {
+		t.Errorf("expected bank 3, got %d", bank)
+	}
+
+	// RAM is only accessible when enabled.
+	cart.Write(0x4000, 0x02)
+	cart.Write(0xA000, 0x55)
+	if value := cart.Read(0xA000); value != 0xFF {
+		t.Errorf("expected disabled RAM to read $ff, got $%02x", value)
+	}
+	cart.Write(0x0000, 0x0A)
+	cart.Write(0xA000, 0x55)
+	if cart.ram[0x4000] != 0x55 {
+		t.Error("expected write to RAM bank 2")
+	}
+}
+
+func TestMBC5Rumble(t *testing.T) {
+	cart := NewMBC5Cartridge(newTestCartROM(4, 0x1E, 0x03))
+
+	var events []bool
+	cart.SetRumbleCallback(func(on bool) {
+		events = append(events, on)
+	})
+
+	cart.Write(0x0000, 0x0A)
+	cart.Write(0x4000, 0x0A)
+	cart.Write(0xA000, 0x42)
+	cart.Write(0x4000, 0x02)
+
+	if len(events) != 2 || !events[0] || events[1] {
+		t.Errorf("expected rumble on then off, got %v", events)
+	}
+	if cart.rambank != 2 {
+		t.Errorf("expected RAM bank 2, got %d", cart.rambank)
+	}
+	if cart.ram[0x4000] != 0x42 {
+		t.Error("expected write with rumble on to go to RAM bank 2")
+	}
+
+	// Without a rumble motor, bit 3 selects a RAM bank.
+	cart = NewMBC5Cartridge(newTestCartROM(4, 0x1B, 0x04))
+	cart.SetRumbleCallback(func(on bool) {
+		t.Error("unexpected rumble callback")
+	})
+	cart.Write(0x4000, 0x0A)
+	if cart.rambank != 10 {
+		t.Errorf("expected RAM bank 10, got %d", cart.rambank)
+	}
+}
+
+func TestRAMInitPattern(t *testing.T) {
+	tests := []struct {
+		pattern RAMInit
+		values  map[uint16]uint8
+	}{
+		{RAMInitZero, map[uint16]uint8{0xC000: 0x00, 0xC008: 0x00, 0xFF80: 0x00, 0x8000: 0x00}},
+		{RAMInitOnes, map[uint16]uint8{0xC000: 0xFF, 0xC008: 0xFF, 0xFF80: 0xFF, 0x8000: 0xFF}},
+		{RAMInitDMG, map[uint16]uint8{
+			0xC000: 0x00, 0xC007: 0x00, 0xC008: 0xFF, 0xC00F: 0xFF, 0xC010: 0x00,
+			0xC100: 0xFF, 0xC108: 0x00,
+			0xFF80: 0x00, 0xFF88: 0xFF,
+			0x8000: 0x00, 0x8008: 0xFF,
+		}},
+	}
+
+	for _, test := range tests {
+		gb := NewMachineWithOptions(newTestROM(), Options{UseBootROM: true, RAMInit: test.pattern})
+
+		for addr, value := range test.values {
+			if got := gb.Read(addr); got != value {
+				t.Errorf("pattern %d, $%04x: expected $%02x, got $%02x", test.pattern, addr, value, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package gameboy
+
+// This file implements the DMG OAM corruption bug. While the PPU is scanning
+// OAM in mode 2, it reads one 8-byte row of OAM each M-cycle. If the CPU puts
+// an address in 0xFE00-0xFEFF on the bus at the same time, as the 16-bit
+// increment and decrement instructions do, the row being read is corrupted.
+
+// oamRow returns the index of the OAM row the PPU is reading, and whether it
+// is scanning OAM at all.
+func (ppu *PPU) oamRow() (int, bool) {
+	if ppu.cgb || !ppu.lcdDisplayEnable || ppu.clock >= 65664 {
+		return 0, false
+	}
+
+	hclock := ppu.clock % 456
+	if hclock >= 80 {
+		return 0, false
+	}
+
+	return hclock / 4, true
+}
+
+// oamWord returns the 16-bit word at the given byte offset in OAM.
+func (ppu *PPU) oamWord(offset int) uint16 {
+	return uint16(ppu.oam[offset]) | uint16(ppu.oam[offset+1])<<8
+}
+
+// setOAMWord sets the 16-bit word at the given byte offset in OAM.
+func (ppu *PPU) setOAMWord(offset int, value uint16) {
+	ppu.oam[offset] = uint8(value)
+	ppu.oam[offset+1] = uint8(value >> 8)
+}
+
+// oamBugWrite corrupts OAM as a write would, if addr is in OAM and the PPU is
+// scanning it. The first word of the row is mixed with the first and third
+// words of the preceding row, and the remaining words are copied from it. The
+// first row is never corrupted.
+func (gb *Machine) oamBugWrite(addr uint16) {
+	ppu := &gb.ppu
+
+	if addr < 0xFE00 || addr > 0xFEFF {
+		return
+	}
+
+	row, ok := ppu.oamRow()
+	if !ok || row == 0 {
+		return
+	}
+
+	cur, prev := row*8, (row-1)*8
+
+	a := ppu.oamWord(cur)
+	b := ppu.oamWord(prev)
+	c := ppu.oamWord(prev + 4)
+	ppu.setOAMWord(cur, ((a^c)&(b^c))^c)
+
+	copy(ppu.oam[cur+2:cur+8], ppu.oam[prev+2:prev+8])
+}
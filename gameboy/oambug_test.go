@@ -0,0 +1,52 @@
+package gameboy
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestOAMBug(t *testing.T) {
+	tests := []struct {
+		name    string
+		cgb     bool
+		hclock  int
+		hl      uint16
+		corrupt bool
+	}{
+		{"mode 2, row 5", false, 20, 0xFE10, true},
+		{"mode 2, row 0", false, 0, 0xFE10, false},
+		{"mode 3", false, 100, 0xFE10, false},
+		{"outside OAM", false, 20, 0xFD10, false},
+		{"CGB", true, 20, 0xFE10, false},
+	}
+
+	for _, test := range tests {
+		gb := newPPUTestMachine(0x91)
+		gb.ppu.cgb = test.cgb
+
+		for i := range gb.ppu.oam {
+			gb.ppu.oam[i] = uint8(i)
+		}
+		// Row 4: a=$00ff, c=$0f0f. Row 5: a=$3333.
+		copy(gb.ppu.oam[32:], []byte{0xFF, 0x00, 0x22, 0x23, 0x0F, 0x0F, 0x26, 0x27})
+		copy(gb.ppu.oam[40:], []byte{0x33, 0x33})
+		before := gb.ppu.oam
+
+		for gb.ppu.clock < 3*456+test.hclock {
+			gb.stepPixel()
+		}
+
+		gb.cpu.setHL(test.hl)
+		gb.cpuOpIncrementRR(&gb.cpu.h, &gb.cpu.l)
+
+		want := before
+		if test.corrupt {
+			// ((a ^ c) & (b ^ c)) ^ c = $033f, then the rest of row 4.
+			copy(want[40:], []byte{0x3F, 0x03, 0x22, 0x23, 0x0F, 0x0F, 0x26, 0x27})
+		}
+
+		if !bytes.Equal(gb.ppu.oam[:], want[:]) {
+			t.Errorf("%s: expected OAM\n% x\ngot\n% x", test.name, want[32:48], gb.ppu.oam[32:48])
+		}
+	}
+}
@@ -23,13 +23,13 @@ func (cpu *CPU) setZeroFlag(val uint8)     { setBit(&cpu.f, 7, val == 0) }
 func (cpu *CPU) clearFlags(flags uint8)    { cpu.f &= ^flags }
 
 func (gb *Machine) fetchAt(reg uint16) uint8 {
-	value := gb.Read(reg)
+	value := gb.cpuRead(reg)
 	gb.stepCycle()
 	return value
 }
 
 func (gb *Machine) writeAt(reg uint16, value uint8) {
-	gb.Write(reg, value)
+	gb.cpuWrite(reg, value)
 	gb.stepCycle()
 }
 
@@ -45,9 +45,16 @@ func (gb *Machine) cpuOpStop() {
 }
 
 func (gb *Machine) cpuOpHalt() {
-	// TODO(john): This should only happen with DMG/SGB.
-	// Skip next instruction (glitch.)
-	gb.cpu.pc++
+	// An interrupt is already pending, so HALT exits immediately. With IME
+	// clear, the CPU fails to increment PC after the next opcode fetch, so
+	// the byte after HALT is read twice (HALT bug.) This happens on both the
+	// DMG and the CGB.
+	if gb.cpu.ie&gb.cpu.irq&0x1f != 0 {
+		if !gb.cpu.ime {
+			gb.cpu.haltBug = true
+		}
+		return
+	}
 
 	// Do not halt if there are no interrupts enabled.
 	if gb.cpu.ie&0x1f == 0 {
@@ -77,7 +84,8 @@ func (gb *Machine) cpuOpReturnInterrupt() {
 }
 
 func (gb *Machine) cpuOpUndefined() {
-	panic("undefined opcode")
+	pc := gb.cpu.oppc
+	panic(&UndefinedOpcodeError{pc, gb.bus.Read(pc), gb.crashReport("undefined opcode")})
 }
 
 // ============================================================================
@@ -126,6 +134,7 @@ func (gb *Machine) cpuOpIncrementAt(reg uint16) {
 }
 
 func (gb *Machine) cpuOpIncrementRR(r1 *uint8, r2 *uint8) {
+	gb.oamBugWrite(wide(*r1, *r2))
 	*r2++
 	if *r2 == 0x00 {
 		*r1++
@@ -134,6 +143,7 @@ func (gb *Machine) cpuOpIncrementRR(r1 *uint8, r2 *uint8) {
 }
 
 func (gb *Machine) cpuOpIncrement16(reg *uint16) {
+	gb.oamBugWrite(*reg)
 	*reg++
 	gb.stepCycle()
 }
@@ -154,6 +164,7 @@ func (gb *Machine) cpuOpDecrementAt(reg uint16) {
 }
 
 func (gb *Machine) cpuOpDecrementRR(r1 *uint8, r2 *uint8) {
+	gb.oamBugWrite(wide(*r1, *r2))
 	*r2--
 	if *r2 == 0xff {
 		*r1--
@@ -162,6 +173,7 @@ func (gb *Machine) cpuOpDecrementRR(r1 *uint8, r2 *uint8) {
 }
 
 func (gb *Machine) cpuOpDecrement16(reg *uint16) {
+	gb.oamBugWrite(*reg)
 	*reg--
 	gb.stepCycle()
 }
@@ -293,15 +305,33 @@ func (gb *Machine) cpuOpAdd(reg *uint8, value uint8, carry bool) {
 	gb.cpu.setCarryFlag(rn > 0xff)
 }
 
-func (gb *Machine) cpuOpAddSP(value int8) {
-	sp := int(gb.cpu.sp)
-	rn := sp + int(value)
-	rh := sp&0xfff + int(value)
-	gb.cpu.sp = uint16(rn)
+// cpuAddSPSigned adds a signed offset to sp and returns the result. The half
+// carry and carry flags come from adding the offset to the low byte of sp,
+// as an unsigned byte.
+func (gb *Machine) cpuAddSPSigned(value int8) uint16 {
+	sp := gb.cpu.sp
+	lo := uint(sp & 0xff)
+	rh := lo&0xf + uint(uint8(value))&0xf
+	rc := lo + uint(uint8(value))
 
 	gb.cpu.clearFlags(allFlags)
-	gb.cpu.setHalfCarryFlag(rh > 0x0fff)
-	gb.cpu.setCarryFlag(rn > 0xffff)
+	gb.cpu.setHalfCarryFlag(rh > 0x0f)
+	gb.cpu.setCarryFlag(rc > 0xff)
+
+	return uint16(int(sp) + int(value))
+}
+
+// cpuOpAddSP implements ADD SP,e8, which takes two internal cycles.
+func (gb *Machine) cpuOpAddSP(value int8) {
+	gb.cpu.sp = gb.cpuAddSPSigned(value)
+	gb.stepCycle()
+	gb.stepCycle()
+}
+
+// cpuOpLoadHLSP implements LD HL,SP+e8, which takes one internal cycle.
+func (gb *Machine) cpuOpLoadHLSP(value int8) {
+	gb.cpu.setHL(gb.cpuAddSPSigned(value))
+	gb.stepCycle()
 }
 
 func (gb *Machine) cpuOpSub(reg *uint8, value uint8, carry bool) {
@@ -34,3 +34,72 @@ func TestCBOps(t *testing.T) {
 		}
 	}
 }
+
+func TestCBMemoryOperandCycles(t *testing.T) {
+	tests := []struct {
+		op     uint8
+		cycles uint
+		writes bool
+	}{
+		{0x06, 16, true},  // rlc (hl)
+		{0x0E, 16, true},  // rrc (hl)
+		{0x16, 16, true},  // rl (hl)
+		{0x1E, 16, true},  // rr (hl)
+		{0x26, 16, true},  // sla (hl)
+		{0x2E, 16, true},  // sra (hl)
+		{0x36, 16, true},  // swap (hl)
+		{0x3E, 16, true},  // srl (hl)
+		{0x46, 12, false}, // bit 0, (hl)
+		{0x4E, 12, false}, // bit 1, (hl)
+		{0x56, 12, false}, // bit 2, (hl)
+		{0x5E, 12, false}, // bit 3, (hl)
+		{0x66, 12, false}, // bit 4, (hl)
+		{0x6E, 12, false}, // bit 5, (hl)
+		{0x76, 12, false}, // bit 6, (hl)
+		{0x7E, 12, false}, // bit 7, (hl)
+		{0x86, 16, true},  // res 0, (hl)
+		{0xBE, 16, true},  // res 7, (hl)
+		{0xC6, 16, true},  // set 0, (hl)
+		{0xFE, 16, true},  // set 7, (hl)
+		{0x00, 8, false},  // rlc b
+		{0x09, 8, false},  // rrc c
+		{0x12, 8, false},  // rl d
+		{0x1B, 8, false},  // rr e
+		{0x24, 8, false},  // sla h
+		{0x2D, 8, false},  // sra l
+		{0x37, 8, false},  // swap a
+		{0x38, 8, false},  // srl b
+		{0x40, 8, false},  // bit 0, b
+		{0x7F, 8, false},  // bit 7, a
+		{0x85, 8, false},  // res 0, l
+		{0xFC, 8, false},  // set 7, h
+	}
+
+	for _, test := range tests {
+		// ld hl, $c000; prefix cb op
+		gb, ram := newFlatMachine()
+		copy(ram.mem[0x100:], []byte{0x21, 0x00, 0xC0, 0xCB, test.op})
+		gb.cpu.pc = 0x100
+		ram.mem[0xC000] = 0x5A
+		gb.Step()
+
+		ram.record = true
+		clock := gb.cpu.clock
+		gb.Step()
+
+		if cycles := gb.cpu.clock - clock; cycles != test.cycles {
+			t.Errorf("(op=cb %02x) expected %d cycles, got %d", test.op, test.cycles, cycles)
+		}
+		if gb.cpu.pc != 0x105 {
+			t.Errorf("(op=cb %02x) expected pc=0105, got %04x", test.op, gb.cpu.pc)
+		}
+
+		writes := false
+		for _, access := range ram.accesses {
+			writes = writes || access.write
+		}
+		if writes != test.writes {
+			t.Errorf("(op=cb %02x) expected write %v, got %v", test.op, test.writes, writes)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package gameboy
+
+import "testing"
+
+func TestRestart(t *testing.T) {
+	for _, vector := range []uint16{0x00, 0x08, 0x10, 0x18, 0x20, 0x28, 0x30, 0x38} {
+		// ld sp, $d000; rst vector
+		gb := NewMachine(newTestROM(0x31, 0x00, 0xD0, 0xC7|uint8(vector)), false)
+		gb.Step()
+
+		clock := gb.cpu.clock
+		gb.Step()
+
+		if gb.cpu.pc != vector {
+			t.Errorf("rst $%02x: expected pc=%04x, got pc=%04x", vector, vector, gb.cpu.pc)
+		}
+		if gb.cpu.sp != 0xCFFE {
+			t.Errorf("rst $%02x: expected sp=cffe, got sp=%04x", vector, gb.cpu.sp)
+		}
+		if ret := wide(gb.Read(0xCFFF), gb.Read(0xCFFE)); ret != 0x0104 {
+			t.Errorf("rst $%02x: expected return address 0104, got %04x", vector, ret)
+		}
+		if cycles := gb.cpu.clock - clock; cycles != 16 {
+			t.Errorf("rst $%02x: expected 16 cycles, got %d", vector, cycles)
+		}
+	}
+}
+
+func TestAddSPSigned(t *testing.T) {
+	tests := []struct {
+		op     uint8
+		sp     uint16
+		offset uint8
+		result uint16
+		f      uint8
+		cycles uint
+	}{
+		// add sp, e8
+		{0xE8, 0xFFF8, 0x08, 0x0000, halfCarryFlag | carryFlag, 16},
+		{0xE8, 0x1000, 0xFF, 0x0FFF, 0, 16},
+		{0xE8, 0x10FF, 0xFF, 0x10FE, halfCarryFlag | carryFlag, 16},
+		{0xE8, 0xD00F, 0x01, 0xD010, halfCarryFlag, 16},
+		// ld hl, sp+e8
+		{0xF8, 0xFFF8, 0x08, 0x0000, halfCarryFlag | carryFlag, 12},
+		{0xF8, 0x1000, 0xFF, 0x0FFF, 0, 12},
+		{0xF8, 0xD0F0, 0x10, 0xD100, carryFlag, 12},
+	}
+
+	for _, test := range tests {
+		gb := NewMachine(newTestROM(test.op, test.offset), false)
+		gb.cpu.sp = test.sp
+		gb.cpu.f = allFlags
+
+		clock := gb.cpu.clock
+		gb.Step()
+
+		result := gb.cpu.sp
+		if test.op == 0xF8 {
+			result = gb.cpu.hl()
+			if gb.cpu.sp != test.sp {
+				t.Errorf("%02x %02x: expected sp unchanged, got %04x", test.op, test.offset, gb.cpu.sp)
+			}
+		}
+
+		if result != test.result {
+			t.Errorf("%02x %02x with sp=%04x: expected %04x, got %04x", test.op, test.offset, test.sp, test.result, result)
+		}
+		if gb.cpu.f != test.f {
+			t.Errorf("%02x %02x with sp=%04x: expected f=%08b, got f=%08b", test.op, test.offset, test.sp, test.f, gb.cpu.f)
+		}
+		if cycles := gb.cpu.clock - clock; cycles != test.cycles {
+			t.Errorf("%02x %02x: expected %d cycles, got %d", test.op, test.offset, test.cycles, cycles)
+		}
+	}
+}
+
+func TestReturnInterruptServicesPending(t *testing.T) {
+	// reti, returning to $0200.
+	gb := NewMachine(newTestROM(0xD9), false)
+	gb.cpu.sp = 0xCFFE
+	gb.Write(0xCFFE, 0x00)
+	gb.Write(0xCFFF, 0x02)
+
+	// A timer interrupt is pending and enabled, with interrupts disabled.
+	gb.cpu.ime = false
+	gb.cpu.ie = intTimer
+	gb.cpu.irq = intTimer
+
+	gb.Step()
+	if gb.cpu.pc != 0x0200 || !gb.cpu.ime {
+		t.Fatalf("expected pc=0200 with ime set after reti, got pc=%04x ime=%v", gb.cpu.pc, gb.cpu.ime)
+	}
+
+	// The interrupt is serviced before the instruction at $0200.
+	gb.Step()
+	recent := gb.RecentInstructions()
+	if last := recent[len(recent)-1]; last.PC != 0x0050 {
+		t.Errorf("expected the timer handler to run next, got pc=%04x", last.PC)
+	}
+	if ret := wide(gb.Read(0xCFFF), gb.Read(0xCFFE)); ret != 0x0200 {
+		t.Errorf("expected return address 0200, got %04x", ret)
+	}
+	if gb.cpu.ime || gb.cpu.irq&intTimer != 0 {
+		t.Errorf("expected ime and the timer request to be cleared, got ime=%v if=%02x", gb.cpu.ime, gb.cpu.irq)
+	}
+}
+
+func TestHaltBug(t *testing.T) {
+	rom := newTestROM(
+		0xF3,       // di
+		0x3E, 0x01, // ld a, $01
+		0xE0, 0xFF, // ldh (IE), a
+		0xE0, 0x0F, // ldh (IF), a
+		0xAF, // xor a
+		0x76, // halt
+		0x3C, // inc a
+		0x00, // nop
+	)
+
+	tests := []struct {
+		model Model
+		a     uint8
+		pc    uint16
+	}{
+		// The byte after HALT is read twice, so inc a runs twice.
+		{ModelDMG, 0x02, 0x010A},
+		{ModelCGB, 0x02, 0x010A},
+	}
+
+	for _, test := range tests {
+		gb := NewMachineWithOptions(rom, Options{Model: test.model})
+		for i := 0; i < 8; i++ {
+			gb.Step()
+		}
+
+		s := gb.GetCPUState()
+		if s.A != test.a || s.PC != test.pc {
+			t.Errorf("model %d: expected a=%02x pc=%04x, got a=%02x pc=%04x", test.model, test.a, test.pc, s.A, s.PC)
+		}
+		if gb.cpu.halt {
+			t.Errorf("model %d: expected HALT to exit with an interrupt pending", test.model)
+		}
+	}
+}
+
+func TestLoadHighPageC(t *testing.T) {
+	for _, c := range []uint8{0x85, 0x47, 0x05} {
+		gb := NewMachine(newTestROM(
+			0x0E, c, // ld c, n
+			0x3E, 0x5A, // ld a, $5a
+			0xE2, // ld (c), a
+			0xAF, // xor a
+			0xF2, // ld a, (c)
+		), false)
+		for i := 0; i < 3; i++ {
+			gb.Step()
+		}
+
+		addr := 0xFF00 + uint16(c)
+		if v := gb.Read(addr); v != 0x5A {
+			t.Errorf("c=%02x: expected ($%04x)=5a, got %02x", c, addr, v)
+		}
+
+		gb.Step()
+		gb.Step()
+		if a := gb.GetCPUState().A; a != 0x5A {
+			t.Errorf("c=%02x: expected ld a, (c) to read 5a, got %02x", c, a)
+		}
+	}
+}
+
+func TestRotateAccumulatorClearsZero(t *testing.T) {
+	ops := []struct {
+		name string
+		op   uint8 // Same opcode for the CB form, which rotates a register.
+	}{
+		{"rlca", 0x07},
+		{"rrca", 0x0F},
+		{"rla", 0x17},
+		{"rra", 0x1F},
+	}
+	inputs := []uint16{0x0000, 0x0010, 0x0100, 0x0110, 0x8000, 0x8010, 0x5AF0, 0xFF00}
+
+	run := func(program []byte, af uint16) uint16 {
+		gb := NewMachine(newTestROM(append(program, 0x10)...), false)
+		gb.cpu.setAF(af)
+		gb.StepUntilStop()
+		return gb.cpu.af()
+	}
+
+	for _, op := range ops {
+		for _, af := range inputs {
+			got := run([]byte{op.op}, af)
+			cb := run([]byte{0xCB, op.op}, af)
+
+			if got&zeroFlag != 0 {
+				t.Errorf("%s (af=%04x): expected z clear, got af=%04x", op.name, af, got)
+			}
+			if cb>>8 == 0 && cb&zeroFlag == 0 {
+				t.Errorf("%s (af=%04x): expected cb form to set z, got af=%04x", op.name, af, cb)
+			}
+			if want := cb &^ zeroFlag; got != want {
+				t.Errorf("%s (af=%04x): expected af=%04x, got af=%04x", op.name, af, want, got)
+			}
+		}
+	}
+}
+
+func TestAddHLHalfCarry(t *testing.T) {
+	values := []uint16{
+		0x0000, 0x0001, 0x00FF, 0x0100, 0x07FF, 0x0800, 0x0F00, 0x0FFF,
+		0x1000, 0x1234, 0x7FFF, 0x8000, 0x8FFF, 0xF000, 0xF0FF, 0xFFFF,
+	}
+
+	for _, hl := range values {
+		for _, bc := range values {
+			for _, f := range []uint8{0x00, 0xF0} {
+				gb := NewMachine(newTestROM(0x09, 0x10), false) // add hl, bc; stop
+				gb.cpu.setHL(hl)
+				gb.cpu.setBC(bc)
+				gb.cpu.f = f
+				gb.StepUntilStop()
+
+				want := f & zeroFlag
+				if hl&0xFFF+bc&0xFFF > 0xFFF {
+					want |= halfCarryFlag
+				}
+				if uint(hl)+uint(bc) > 0xFFFF {
+					want |= carryFlag
+				}
+
+				if got := gb.cpu.hl(); got != hl+bc {
+					t.Errorf("(hl=%04x, bc=%04x) expected hl=%04x, got %04x", hl, bc, hl+bc, got)
+				}
+				if gb.cpu.f != want {
+					t.Errorf("(hl=%04x, bc=%04x, f=%02x) expected f=%02x, got %02x", hl, bc, f, want, gb.cpu.f)
+				}
+			}
+		}
+	}
+}
+
+func TestEnableInterruptsDelay(t *testing.T) {
+	tests := []struct {
+		name    string
+		program []byte
+		steps   int    // Instructions run before the interrupt can be serviced
+		ret     uint16 // Return address pushed by the interrupt, or 0 if none
+	}{
+		{"ei; nop", []byte{0xFB, 0x00, 0x00}, 2, 0x0102},
+		{"ei; ret", []byte{0xFB, 0xC9}, 2, 0x0200},
+		{"ei; di", []byte{0xFB, 0xF3, 0x00, 0x00}, 4, 0},
+		{"ei; ei; nop", []byte{0xFB, 0xFB, 0x00}, 2, 0x0102},
+		// The interrupt is pending, so HALT exits at once, and the
+		// interrupt returns to the HALT.
+		{"ei; halt", []byte{0xFB, 0x76, 0x00}, 2, 0x0101},
+	}
+
+	for _, test := range tests {
+		// The timer handler runs inc b.
+		rom := newTestROM(test.program...)
+		rom[0x0050] = 0x04
+		gb := NewMachine(rom, false)
+		gb.cpu.sp = 0xCFFE
+		gb.Write(0xCFFE, 0x00)
+		gb.Write(0xCFFF, 0x02)
+
+		// A timer interrupt is pending and enabled, with interrupts disabled.
+		gb.cpu.ime = false
+		gb.cpu.ie = intTimer
+		gb.cpu.irq = intTimer
+
+		gb.Step()
+		if gb.cpu.ime {
+			t.Errorf("%s: expected ime to be clear after ei", test.name)
+		}
+		for i := 1; i < test.steps; i++ {
+			gb.Step()
+		}
+		if gb.cpu.irq&intTimer == 0 {
+			t.Errorf("%s: expected the interrupt not to be serviced yet", test.name)
+		}
+		if ime := test.ret != 0; gb.cpu.ime != ime {
+			t.Errorf("%s: expected ime=%v, got %v", test.name, ime, gb.cpu.ime)
+		}
+
+		gb.Step()
+		if test.ret == 0 {
+			if gb.cpu.irq&intTimer == 0 {
+				t.Errorf("%s: expected the interrupt not to be serviced", test.name)
+			}
+			continue
+		}
+		if gb.cpu.irq&intTimer != 0 {
+			t.Errorf("%s: expected the interrupt to be serviced", test.name)
+		}
+		if ret := wide(gb.Read(gb.cpu.sp+1), gb.Read(gb.cpu.sp)); ret != test.ret {
+			t.Errorf("%s: expected return address %04x, got %04x", test.name, test.ret, ret)
+		}
+		if pc, b := gb.cpu.pc, gb.cpu.b; pc != 0x0051 || b != 0x01 {
+			t.Errorf("%s: expected the handler to run once, got pc=%04x b=%02x", test.name, pc, b)
+		}
+	}
+}
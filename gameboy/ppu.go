@@ -3,15 +3,23 @@ package gameboy
 import "sort"
 
 var (
+	// rgbColors maps shades to framebuffer colors, stored as 0xAARRGGBB.
 	rgbColors = [4]uint32{0xFFD7E894, 0xFFAEC440, 0xFF527F39, 0xFF204631}
 )
 
+// colorRGBA splits a 0xAARRGGBB framebuffer color into its components.
+func colorRGBA(c uint32) (r, g, b, a uint8) {
+	return uint8(c >> 16), uint8(c >> 8), uint8(c >> 0), uint8(c >> 24)
+}
+
 // Object contains the state of an object.
 type Object struct {
 	x, y, tile, attr, data uint
 }
 
-type Objects [10]Object
+// Objects sorts objects into DMG drawing priority: by X coordinate, then by
+// OAM index.
+type Objects []Object
 
 func (s Objects) Len() int {
 	return len(s)
@@ -27,7 +35,7 @@ func (s Objects) Swap(i, j int) {
 
 // PPU implements the Gameboy display controller.
 type PPU struct {
-	vram [0x2000]uint8
+	vram [0x4000]uint8
 	oam  [160]uint8
 	bgp  [4]uint8
 	obp  [2][4]uint8
@@ -37,12 +45,19 @@ type PPU struct {
 	bgColor, bgPalette uint16
 	fgColor, fgPalette uint16
 	fgPriority         bool
+	fgVisible          bool
+	bgPriority         bool
+
+	// CGB mode
+	cgb      bool
+	vramBank uint8 // 0xFF4F
 
 	clock      int
 	lx         uint
 	screen     [160 * 144]uint32
-	objects    Objects
+	objects    [10]Object
 	numObjects uint
+	overflow   SpriteOverflowStats
 
 	// LCD Control Register (0xFF40)
 	lcdDisplayEnable    bool // 0xFF40 << 7
@@ -63,12 +78,22 @@ type PPU struct {
 	modeHi          bool // 0xFF41 << 1
 	modeLo          bool // 0xFF41 << 0
 
+	// STAT interrupt line, the OR of all enabled STAT sources
+	statLine bool
+
 	// LCD Positioning and Scrolling
 	scrollY uint8 // 0xFF42
 	scrollX uint8 // 0xFF43
 	ly      uint8 // 0xFF44
 	lyComp  uint8 // 0xFF45
 
+	// SCY and the fine part of SCX, latched at the start of each line
+	lineScrollY uint8
+	lineFineX   uint8
+
+	// Pixels left to discard at the start of mode 3 for the fine scroll
+	discard uint8
+
 	// LCD OAM DMA Transfers
 	dmaAddr   uint8 // 0xFF46
 	dmaEnable bool
@@ -78,6 +103,9 @@ type PPU struct {
 	winYPos uint8 // 0xFF4A
 	winXPos uint8 // 0xFF4B
 
+	// Whether the window has been drawn on the current line
+	windowActive bool
+
 	// background
 	backgroundData uint
 	backgroundAttr uint
@@ -92,10 +120,25 @@ func (ppu *PPU) Reset() {
 	ppu.obp[1] = [4]uint8{3, 3, 3, 3}
 }
 
+// accessible returns whether the CPU can access addr in the current PPU mode.
+// The PPU uses VRAM during mode 3, and OAM during modes 2 and 3.
+func (ppu *PPU) accessible(addr uint16) bool {
+	if !ppu.lcdDisplayEnable {
+		return true
+	}
+	switch {
+	case addr >= 0x8000 && addr < 0xA000:
+		return !(ppu.modeHi && ppu.modeLo)
+	case addr >= 0xFE00 && addr < 0xFEA0:
+		return !ppu.modeHi
+	}
+	return true
+}
+
 func (ppu *PPU) Read(addr uint16) uint8 {
 	switch {
 	case addr >= 0x8000 && addr < 0xA000:
-		return ppu.vram[addr&0x1fff]
+		return ppu.vram[uint(ppu.vramBank)<<13|uint(addr&0x1fff)]
 	case addr >= 0xFE00 && addr < 0xFEA0:
 		return ppu.oam[addr-0xFE00]
 	case addr == 0xFF40:
@@ -135,6 +178,8 @@ func (ppu *PPU) Read(addr uint16) uint8 {
 		return ppu.winYPos
 	case addr == 0xFF4B:
 		return ppu.winXPos
+	case addr == 0xFF4F && ppu.cgb:
+		return 0xFE | ppu.vramBank
 	}
 
 	return 0xFF
@@ -143,7 +188,7 @@ func (ppu *PPU) Read(addr uint16) uint8 {
 func (ppu *PPU) Write(addr uint16, value uint8) {
 	switch {
 	case addr >= 0x8000 && addr < 0xA000:
-		ppu.vram[addr&0x1fff] = value
+		ppu.vram[uint(ppu.vramBank)<<13|uint(addr&0x1fff)] = value
 	case addr >= 0xFE00 && addr < 0xFEA0:
 		ppu.oam[addr-0xFE00] = value
 	case addr == 0xFF40:
@@ -179,6 +224,8 @@ func (ppu *PPU) Write(addr uint16, value uint8) {
 		ppu.winYPos = value
 	case addr == 0xFF4B:
 		ppu.winXPos = value
+	case addr == 0xFF4F && ppu.cgb:
+		ppu.vramBank = value & 1
 	}
 }
 
@@ -207,7 +254,7 @@ func (ppu *PPU) setLCDControlReg(value uint8) {
 }
 
 func (ppu *PPU) lcdStatusReg() uint8 {
-	result := uint8(0)
+	result := uint8(0x80) // Bit 7 is unused and reads as 1.
 	if ppu.lycInterrupt {
 		result |= 1 << 6
 	}
@@ -233,13 +280,11 @@ func (ppu *PPU) lcdStatusReg() uint8 {
 }
 
 func (ppu *PPU) setLCDStatusReg(v uint8) {
+	// Bits 0-2 (mode and coincidence) are read-only.
 	ppu.lycInterrupt = v&(1<<6) != 0
 	ppu.oamInterrupt = v&(1<<5) != 0
 	ppu.vblankInterrupt = v&(1<<4) != 0
 	ppu.hblankInterrupt = v&(1<<3) != 0
-	ppu.lyCoincidence = v&(1<<2) != 0
-	ppu.modeHi = v&(1<<1) != 0
-	ppu.modeLo = v&(1<<0) != 0
 }
 
 func (ppu *PPU) initScanline() {
@@ -250,17 +295,38 @@ func (ppu *PPU) initScanline() {
 		objHeight = 16
 	}
 
+	ppu.lineScrollY = ppu.scrollY
+	ppu.lineFineX = ppu.scrollX & 7
+	ppu.discard = ppu.lineFineX
+
+	ppu.windowActive = false
 	ppu.numObjects = 0
+	if ppu.ly == 0 {
+		ppu.overflow = SpriteOverflowStats{}
+	}
 
+	dropped := 0
 	for n := 0; n < 40; n++ {
+		y := uint(ppu.ly) - (uint(ppu.oam[n*4+0]) - 16)
+		if y >= objHeight {
+			continue
+		}
+
+		// Only the first 10 objects on a line are drawn.
+		if ppu.numObjects == 10 {
+			dropped++
+			continue
+		}
+
 		s := &ppu.objects[ppu.numObjects]
-		s.y = uint(ppu.ly) - (uint(ppu.oam[n*4+0]) - 16)
+		s.y = y
 		s.x = uint(ppu.oam[n*4+1]) - 8
 		s.tile = uint(ppu.oam[n*4+2])
 		s.attr = uint(ppu.oam[n*4+3])
 
-		if s.y >= objHeight {
-			continue
+		// 8x16 objects use a pair of tiles; bit 0 of the index is ignored.
+		if ppu.objSize {
+			s.tile &^= 1
 		}
 
 		if s.attr&0x40 != 0 {
@@ -272,22 +338,37 @@ func (ppu *PPU) initScanline() {
 		s.data |= uint(ppu.vram[tileDataAddr+1]) << 8
 
 		if s.attr&0x20 != 0 {
-			// Bit twiddling hack.
-			s.data = ((s.data >> 1) & 0x5555) | ((s.data & 0x5555) << 1)
-			s.data = ((s.data >> 2) & 0x3333) | ((s.data & 0x3333) << 2)
-			s.data = ((s.data >> 4) & 0x0F0F) | ((s.data & 0x0F0F) << 4)
+			s.data = flipTileLine(s.data)
 		}
 
 		ppu.numObjects++
-		if ppu.numObjects == 10 {
-			break
-		}
 	}
 
-	sort.Stable(ppu.objects)
+	if dropped > 0 {
+		ppu.overflow.Lines++
+		ppu.overflow.Dropped += dropped
+		ppu.overflow.PerLine[ppu.ly] = dropped
+	}
+
+	// Objects are selected in OAM order. On CGB, that is also the drawing
+	// priority, regardless of X.
+	if !ppu.cgb {
+		sort.Stable(Objects(ppu.objects[:ppu.numObjects]))
+	}
 }
 
-func (ppu *PPU) readTileLine(sel bool, x, y uint) uint {
+// flipTileLine mirrors a line of tile data horizontally.
+func flipTileLine(data uint) uint {
+	// Bit twiddling hack.
+	data = ((data >> 1) & 0x5555) | ((data & 0x5555) << 1)
+	data = ((data >> 2) & 0x3333) | ((data & 0x3333) << 2)
+	data = ((data >> 4) & 0x0F0F) | ((data & 0x0F0F) << 4)
+	return data
+}
+
+// readTileLine reads a line of tile data and the tile's CGB attributes from
+// the given tilemap.
+func (ppu *PPU) readTileLine(sel bool, x, y uint) (data, attr uint) {
 	var tileMapBase, tileMapAddr, tileDataAddr uint
 
 	// Determine tilemap base
@@ -301,26 +382,47 @@ func (ppu *PPU) readTileLine(sel bool, x, y uint) uint {
 	tileX, tileY := x/8, y/8
 	tileMapAddr = tileMapBase + ((tileY<<5)+tileX)&0x03FF
 
+	// CGB attributes live in the second VRAM bank
+	if ppu.cgb {
+		attr = uint(ppu.vram[0x2000+tileMapAddr])
+	}
+
+	// Determine row in tile
+	row := y & 0x7
+	if attr&0x40 != 0 {
+		row ^= 0x7
+	}
+
 	// Determine address of tile data
 	if ppu.bgTileDataSelect {
-		tileDataAddr = 0x0000 + uint(ppu.vram[tileMapAddr])<<4 + ((y & 0x7) << 1)
+		tileDataAddr = 0x0000 + uint(ppu.vram[tileMapAddr])<<4 + (row << 1)
 	} else {
-		tileDataAddr = uint(0x1000+int(int8(ppu.vram[tileMapAddr]))<<4) + ((y & 0x7) << 1)
+		tileDataAddr = uint(0x1000+int(int8(ppu.vram[tileMapAddr]))<<4) + (row << 1)
+	}
+	if attr&0x08 != 0 {
+		tileDataAddr += 0x2000
 	}
 
 	// Get data from tile data address
-	data := uint(ppu.vram[tileDataAddr+0]) << 0
+	data = uint(ppu.vram[tileDataAddr+0]) << 0
 	data |= uint(ppu.vram[tileDataAddr+1]) << 8
 
-	return data
+	if attr&0x20 != 0 {
+		data = flipTileLine(data)
+	}
+
+	return data, attr
 }
 
 func (ppu *PPU) pixel() {
 	ppu.bgColor = 0
 	ppu.bgPalette = 0
+	ppu.bgPriority = false
 
 	ppu.fgColor = 0
 	ppu.fgPalette = 0
+	ppu.fgPriority = false
+	ppu.fgVisible = false
 
 	color := uint16(0)
 
@@ -331,13 +433,17 @@ func (ppu *PPU) pixel() {
 	// stored in a register. the side-effect is that we can count cycles
 	// more accurately.
 
-	if ppu.bgDisplay {
-		scrolly := uint(ppu.ly+ppu.scrollY) & 0xFF
-		scrollx := uint(uint(ppu.scrollX)+ppu.lx) & 0xFF
-		scrollBit := scrollx & 0x7
+	// On CGB, LCDC bit 0 is the BG priority master switch instead.
+	if ppu.bgDisplay || ppu.cgb {
+		// SCY and the fine scroll are latched for the line, but the tile
+		// column is taken from SCX as each tile is fetched.
+		scrolly := uint(ppu.ly+ppu.lineScrollY) & 0xFF
+		pos := ppu.lx + uint(ppu.lineFineX)
+		scrollBit := pos & 0x7
 
 		if scrollBit == 0 || ppu.lx == 0 {
-			ppu.backgroundData = ppu.readTileLine(ppu.bgTileMapSelect, scrollx, scrolly)
+			scrollx := (uint(ppu.scrollX&^7) + pos) & 0xFF
+			ppu.backgroundData, ppu.backgroundAttr = ppu.readTileLine(ppu.bgTileMapSelect, scrollx, scrolly)
 		}
 
 		index := uint(0)
@@ -350,6 +456,7 @@ func (ppu *PPU) pixel() {
 
 		ppu.bgColor = uint16(ppu.bgp[index])
 		ppu.bgPalette = uint16(index)
+		ppu.bgPriority = ppu.backgroundAttr&0x80 != 0
 	}
 
 	if ppu.windowDisplayEnable {
@@ -358,8 +465,9 @@ func (ppu *PPU) pixel() {
 		scrollBit := scrollx & 0x7
 
 		if scrolly < 144 && scrollx < 160 {
+			ppu.windowActive = true
 			if scrollBit == 0 || ppu.lx == 0 {
-				ppu.windowData = ppu.readTileLine(ppu.windowTilemapEnable, scrollx, scrolly)
+				ppu.windowData, ppu.windowAttr = ppu.readTileLine(ppu.windowTilemapEnable, scrollx, scrolly)
 			}
 
 			index := uint(0)
@@ -372,9 +480,13 @@ func (ppu *PPU) pixel() {
 
 			ppu.bgColor = uint16(ppu.bgp[index])
 			ppu.bgPalette = uint16(index)
+			ppu.bgPriority = ppu.windowAttr&0x80 != 0
 		}
 	}
 
+	// OBJ display is sampled for each pixel, so toggling it mid-line only
+	// affects the pixels that follow. Objects are still selected during OAM
+	// scan while it is disabled.
 	if ppu.objDisplay {
 		for n := int(ppu.numObjects) - 1; n >= 0; n-- {
 			s := &ppu.objects[n]
@@ -402,14 +514,19 @@ func (ppu *PPU) pixel() {
 			}
 			ppu.fgPalette = uint16(index)
 			ppu.fgPriority = s.attr&0x80 == 0
+			ppu.fgVisible = true
 		}
 	}
 
 	// Implement priority/transparency
-	if ppu.fgPalette == 0 {
+	if !ppu.fgVisible {
 		color = ppu.bgColor
+	} else if ppu.cgb && !ppu.bgDisplay {
+		color = ppu.fgColor
 	} else if ppu.bgPalette == 0 {
 		color = ppu.fgColor
+	} else if ppu.bgPriority {
+		color = ppu.bgColor
 	} else if ppu.fgPriority {
 		color = ppu.fgColor
 	} else {
@@ -429,33 +546,33 @@ func (gb *Machine) stepPixel() {
 	case ppu.clock < 65664:
 		switch {
 		case hclock == 0:
-			ppu.lyCoincidence = ppu.ly == ppu.lyComp
-			if ppu.lcdDisplayEnable && ppu.lyCoincidence && ppu.lycInterrupt {
-				gb.Interrupt(intLCDStat)
-			}
-
 			ppu.modeHi, ppu.modeLo = true, false
 
 			ppu.lx = 0
+			ppu.discard = 0
 
 			if ppu.lcdDisplayEnable {
 				ppu.initScanline()
 			}
 
-		case hclock >= 80 && hclock < 80+160:
+		case hclock >= 80 && ppu.lx < 160:
 			ppu.modeHi, ppu.modeLo = true, true
 
+			// The fetcher first discards SCX mod 8 pixels of the first
+			// tile, so fine scrolling lengthens mode 3.
+			if ppu.discard > 0 {
+				ppu.discard--
+				break
+			}
+
 			if ppu.lcdDisplayEnable {
 				ppu.pixel()
 			}
 
 			ppu.lx++
 
-		case hclock == 80+160:
+		case hclock >= 80 && ppu.modeHi:
 			ppu.modeHi, ppu.modeLo = false, false
-			if ppu.lcdDisplayEnable && ppu.hblankInterrupt {
-				gb.Interrupt(intLCDStat)
-			}
 			// TODO(john): DMA should be handled here
 
 		case hclock == 455:
@@ -464,14 +581,14 @@ func (gb *Machine) stepPixel() {
 		break
 	case ppu.clock == 65664:
 		ppu.modeHi, ppu.modeLo = false, true
+		ppu.windowActive = false
 
 		// Entering VBlank period.
 		if ppu.lcdDisplayEnable {
 			gb.Interrupt(intVBlank)
-			if ppu.vblankInterrupt {
-				gb.Interrupt(intLCDStat)
-			}
+			gb.frameCounter.vblank = true
 		}
+		gb.endFrame()
 
 	case ppu.clock < 70223:
 		switch {
@@ -484,5 +601,97 @@ func (gb *Machine) stepPixel() {
 		ppu.ly = 0
 	}
 
+	gb.updateStatLine()
+
 	ppu.clock++
 }
+
+// updateStatLine updates the STAT interrupt line. The interrupt is requested
+// only on a rising edge of the line, so a source becoming active while another
+// already holds the line high does not request another interrupt.
+func (gb *Machine) updateStatLine() {
+	ppu := &gb.ppu
+
+	ppu.lyCoincidence = ppu.ly == ppu.lyComp
+
+	line := false
+	if ppu.lcdDisplayEnable {
+		line = ppu.lycInterrupt && ppu.lyCoincidence
+		switch {
+		case !ppu.modeHi && !ppu.modeLo:
+			line = line || ppu.hblankInterrupt
+		case !ppu.modeHi && ppu.modeLo:
+			line = line || ppu.vblankInterrupt
+		case ppu.modeHi && !ppu.modeLo:
+			line = line || ppu.oamInterrupt
+		}
+	}
+
+	if line && !ppu.statLine {
+		gb.Interrupt(intLCDStat)
+		gb.frameCounter.stat = true
+	}
+	ppu.statLine = line
+}
+
+// SpriteEntry is a decoded OAM entry. Y and X are as stored in OAM, offset by
+// 16 and 8 pixels from the screen position.
+type SpriteEntry struct {
+	Y, X uint8
+	Tile uint8
+
+	Priority bool // Drawn behind BG colors 1-3
+	YFlip    bool
+	XFlip    bool
+	Palette  uint8 // DMG palette, OBP0 or OBP1
+
+	// CGB only
+	Bank       uint8
+	CGBPalette uint8
+}
+
+// Sprites decodes the entries of the sprite attribute table.
+func (gb *Machine) Sprites() [40]SpriteEntry {
+	var sprites [40]SpriteEntry
+
+	for n := range sprites {
+		attr := gb.ppu.oam[n*4+3]
+		sprites[n] = SpriteEntry{
+			Y:          gb.ppu.oam[n*4+0],
+			X:          gb.ppu.oam[n*4+1],
+			Tile:       gb.ppu.oam[n*4+2],
+			Priority:   attr&0x80 != 0,
+			YFlip:      attr&0x40 != 0,
+			XFlip:      attr&0x20 != 0,
+			Palette:    (attr >> 4) & 1,
+			Bank:       (attr >> 3) & 1,
+			CGBPalette: attr & 0x7,
+		}
+	}
+
+	return sprites
+}
+
+// SpriteOverflowStats counts the objects dropped by the 10 objects per line
+// limit during a frame.
+type SpriteOverflowStats struct {
+	Lines   int      // Lines with more than 10 objects
+	Dropped int      // Objects dropped on all lines
+	PerLine [144]int // Objects dropped on each line
+}
+
+// SpriteOverflowStats returns the objects dropped by the 10 objects per line
+// limit in the current frame, up to the last line drawn. The stats are reset
+// when the PPU starts drawing a frame, so after StepFrame they cover the whole
+// frame.
+func (gb *Machine) SpriteOverflowStats() SpriteOverflowStats {
+	return gb.ppu.overflow
+}
+
+// WindowActive returns whether the window is being drawn on the current
+// scanline: the window is enabled, WY <= LY, and WX is on screen. It becomes
+// true from the first window pixel drawn on the line, and is false during
+// VBlank or while the LCD is off.
+func (gb *Machine) WindowActive() bool {
+	return gb.ppu.lcdDisplayEnable && gb.ppu.windowActive
+}
@@ -0,0 +1,724 @@
+package gameboy
+
+import "testing"
+
+// newPPUTestMachine creates a machine running an idle loop, with the LCD
+// configured by the given LCDC value.
+func newPPUTestMachine(lcdc uint8) *Machine {
+	gb := NewMachine(newTestROM(0x18, 0xFE), false)
+	gb.Write(0xFF40, lcdc)
+	return gb
+}
+
+// writeTile writes a tile to VRAM at the given address, using the same low
+// and high bit planes for every row.
+func writeTile(gb *Machine, addr uint16, lo, hi uint8) {
+	for row := uint16(0); row < 8; row++ {
+		gb.Write(addr+row*2+0, lo)
+		gb.Write(addr+row*2+1, hi)
+	}
+}
+
+// writeObject writes an OAM entry.
+func writeObject(gb *Machine, n int, y, x, tile, attr uint8) {
+	addr := uint16(0xFE00 + n*4)
+	gb.Write(addr+0, y)
+	gb.Write(addr+1, x)
+	gb.Write(addr+2, tile)
+	gb.Write(addr+3, attr)
+}
+
+// pixelAt returns the shade of the framebuffer pixel at the given position.
+func pixelAt(gb *Machine, x, y int) int {
+	c := gb.ppu.screen[y*160+x]
+	for shade, rgb := range rgbColors {
+		if rgb == c {
+			return shade
+		}
+	}
+	return -1
+}
+
+func TestObjectTransparency(t *testing.T) {
+	gb := newPPUTestMachine(0x93)
+
+	// BG tile 0: left half color 2, right half color 0.
+	writeTile(gb, 0x8000, 0x00, 0xF0)
+	// OBJ tile 1: solid color 1.
+	writeTile(gb, 0x8010, 0xFF, 0x00)
+
+	// Color 0 -> shade 3, color 2 -> shade 1.
+	gb.Write(0xFF47, 0x13)
+	// Color 1 -> shade 0, so a drawn object pixel maps to shade 0.
+	gb.Write(0xFF48, 0x00)
+
+	// Behind BG, on line 0, x=8.
+	writeObject(gb, 0, 16, 16, 1, 0x80)
+	// Above BG, on line 8, x=16.
+	writeObject(gb, 1, 24, 24, 1, 0x00)
+
+	gb.StepFrame()
+
+	tests := []struct {
+		x, y  int
+		shade int
+	}{
+		// No object: BG only.
+		{0, 0, 1}, {4, 0, 3},
+		// Object behind BG: BG color 2 wins, BG color 0 shows the object.
+		{8, 0, 1}, {11, 0, 1}, {12, 0, 0}, {15, 0, 0},
+		// Object above BG: object wins everywhere.
+		{16, 8, 0}, {19, 8, 0}, {20, 8, 0}, {23, 8, 0},
+		// Past the object.
+		{24, 8, 1}, {28, 8, 3},
+	}
+
+	for _, test := range tests {
+		if shade := pixelAt(gb, test.x, test.y); shade != test.shade {
+			t.Errorf("(%d, %d): expected shade %d, got %d", test.x, test.y, test.shade, shade)
+		}
+	}
+}
+
+func TestCGBBackgroundPriority(t *testing.T) {
+	gb := newPPUTestMachine(0x93)
+	gb.ppu.cgb = true
+
+	// BG tile 0: solid color 1.
+	writeTile(gb, 0x8000, 0xFF, 0x00)
+	// OBJ tile 1: solid color 3.
+	writeTile(gb, 0x8010, 0xFF, 0xFF)
+
+	// BG color 1 -> shade 2, OBJ color 3 -> shade 0.
+	gb.Write(0xFF47, 0x08)
+	gb.Write(0xFF48, 0x00)
+
+	// Set the BG priority attribute on the first tile only.
+	gb.Write(0xFF4F, 1)
+	gb.Write(0x9800, 0x80)
+	gb.Write(0xFF4F, 0)
+
+	// Two objects above BG, on line 0 at x=0 and x=8.
+	writeObject(gb, 0, 16, 8, 1, 0x00)
+	writeObject(gb, 1, 16, 16, 1, 0x00)
+
+	gb.StepFrame()
+
+	if shade := pixelAt(gb, 0, 0); shade != 2 {
+		t.Errorf("BG priority tile: expected BG shade 2, got %d", shade)
+	}
+	if shade := pixelAt(gb, 8, 0); shade != 0 {
+		t.Errorf("normal tile: expected OBJ shade 0, got %d", shade)
+	}
+
+	// With LCDC bit 0 clear, objects always win.
+	gb.Write(0xFF40, 0x92)
+	gb.StepFrame()
+	gb.StepFrame()
+
+	if shade := pixelAt(gb, 0, 0); shade != 0 {
+		t.Errorf("master priority off: expected OBJ shade 0, got %d", shade)
+	}
+	if shade := pixelAt(gb, 0, 8); shade != 2 {
+		t.Errorf("master priority off: expected BG still drawn with shade 2, got %d", shade)
+	}
+}
+
+func TestLCDStatusReadOnlyBits(t *testing.T) {
+	gb := newPPUTestMachine(0x91)
+	gb.Write(0xFF45, 0x50)
+
+	// Step into mode 3 of line 0.
+	for gb.ppu.clock < 100 {
+		gb.stepPixel()
+	}
+
+	gb.Write(0xFF41, 0xFF)
+	if stat := gb.Read(0xFF41); stat&0x7F != 0x7B {
+		t.Errorf("after writing ff: expected stat=7b (mode 3, no coincidence), got %02x", stat&0x7F)
+	}
+
+	gb.Write(0xFF41, 0x00)
+	if stat := gb.Read(0xFF41); stat&0x7F != 0x03 {
+		t.Errorf("after writing 00: expected stat=03 (mode 3), got %02x", stat&0x7F)
+	}
+}
+
+func TestLCDRegisterReadBack(t *testing.T) {
+	gb := newPPUTestMachine(0x00)
+
+	tests := []struct {
+		addr  uint16
+		value uint8
+		read  uint8
+	}{
+		// STAT bit 7 is unused and reads as 1. With the LCD off, the mode
+		// is 0.
+		{0xFF41, 0x00, 0x80},
+		{0xFF41, 0x78, 0xF8},
+		{0xFF42, 0xA5, 0xA5},
+		{0xFF43, 0x5A, 0x5A},
+		{0xFF45, 0x99, 0x99},
+		{0xFF46, 0xC1, 0xC1},
+		{0xFF47, 0xE4, 0xE4},
+		{0xFF4A, 0x12, 0x12},
+		{0xFF4B, 0x34, 0x34},
+	}
+
+	for _, test := range tests {
+		gb.Write(test.addr, test.value)
+		if v := gb.Read(test.addr); v != test.read {
+			t.Errorf("$%04x: wrote %02x, expected %02x, got %02x", test.addr, test.value, test.read, v)
+		}
+	}
+}
+
+func TestTallObjectFlip(t *testing.T) {
+	gb := newPPUTestMachine(0x97)
+
+	// OBJ tiles 2 and 3: each row lights a single column. Rows of the top
+	// tile use color 1, rows of the bottom tile use color 2.
+	for row := uint16(0); row < 16; row++ {
+		bit := uint8(0x80 >> (row % 8))
+		if row < 8 {
+			gb.Write(0x8020+row*2, bit)
+		} else {
+			gb.Write(0x8030+(row-8)*2+1, bit)
+		}
+	}
+
+	gb.Write(0xFF48, 0xE4)
+
+	// Odd tile index, vertically flipped, at the top left of the screen.
+	writeObject(gb, 0, 16, 8, 3, 0x40)
+
+	gb.StepFrame()
+
+	for y := 0; y < 16; y++ {
+		row := 15 - y
+		for x := 0; x < 8; x++ {
+			shade := 0
+			if x == row%8 {
+				shade = 1
+				if row >= 8 {
+					shade = 2
+				}
+			}
+			if got := pixelAt(gb, x, y); got != shade {
+				t.Errorf("(%d, %d): expected shade %d, got %d", x, y, shade, got)
+			}
+		}
+	}
+}
+
+func TestObjectPriority(t *testing.T) {
+	tests := []struct {
+		model Model
+		shade int
+	}{
+		// DMG: the object with the lower X is in front.
+		{ModelDMG, 2},
+		// CGB: the object with the lower OAM index is in front.
+		{ModelCGB, 1},
+	}
+
+	for _, test := range tests {
+		gb := NewMachineWithOptions(newTestROM(0x18, 0xFE), Options{Model: test.model})
+		gb.Write(0xFF40, 0x93)
+
+		// OBJ tile 1: solid color 1. OBJ tile 2: solid color 2.
+		writeTile(gb, 0x8010, 0xFF, 0x00)
+		writeTile(gb, 0x8020, 0x00, 0xFF)
+		gb.Write(0xFF48, 0xE4)
+
+		// Overlapping on x=12 to x=15.
+		writeObject(gb, 0, 16, 20, 1, 0x00)
+		writeObject(gb, 1, 16, 16, 2, 0x00)
+
+		gb.StepFrame()
+
+		for x := 12; x < 16; x++ {
+			if shade := pixelAt(gb, x, 0); shade != test.shade {
+				t.Errorf("model %d: (%d, 0): expected shade %d, got %d", test.model, x, test.shade, shade)
+			}
+		}
+	}
+}
+
+func TestObjectDisplayMidLine(t *testing.T) {
+	gb := newPPUTestMachine(0x93)
+
+	// OBJ tile 1: solid color 3, drawn as shade 3 over a shade 0 BG.
+	writeTile(gb, 0x8010, 0xFF, 0xFF)
+	gb.Write(0xFF47, 0x00)
+	gb.Write(0xFF48, 0xE4)
+
+	// Two objects on lines 0-7, at x=16 and x=40.
+	writeObject(gb, 0, 16, 24, 1, 0x00)
+	writeObject(gb, 1, 16, 48, 1, 0x00)
+
+	// Disable OBJ display once pixels 0-19 of line 0 are drawn.
+	for gb.ppu.clock < 80+20 {
+		gb.stepPixel()
+	}
+	gb.Write(0xFF40, 0x91)
+	for gb.ppu.clock < 2*456 {
+		gb.stepPixel()
+	}
+
+	for x := 0; x < 160; x++ {
+		shade := 0
+		if x >= 16 && x < 20 {
+			shade = 3
+		}
+		if got := pixelAt(gb, x, 0); got != shade {
+			t.Errorf("(%d, 0): expected shade %d, got %d", x, shade, got)
+		}
+		if got := pixelAt(gb, x, 1); got != 0 {
+			t.Errorf("(%d, 1): expected shade 0, got %d", x, got)
+		}
+	}
+}
+
+func TestScrollYLatchedPerLine(t *testing.T) {
+	gb := newPPUTestMachine(0x91)
+
+	// BG tile 1: solid color 3, on the third row of the tilemap.
+	writeTile(gb, 0x8010, 0xFF, 0xFF)
+	for x := uint16(0); x < 32; x++ {
+		gb.Write(0x9840+x, 1)
+	}
+
+	// Change SCY halfway through drawing line 12.
+	for gb.ppu.clock < 12*456+80+80 {
+		gb.stepPixel()
+	}
+	gb.Write(0xFF42, 8)
+	for gb.ppu.clock < 14*456 {
+		gb.stepPixel()
+	}
+
+	// Line 12 still shows the second tile row; line 13 shows the third.
+	for x := 0; x < 160; x++ {
+		if shade := pixelAt(gb, x, 12); shade != 0 {
+			t.Fatalf("(%d, 12): expected shade 0, got %d", x, shade)
+		}
+		if shade := pixelAt(gb, x, 13); shade != 3 {
+			t.Fatalf("(%d, 13): expected shade 3, got %d", x, shade)
+		}
+	}
+}
+
+func TestStatLineBlocking(t *testing.T) {
+	tests := []struct {
+		name  string
+		stat  uint8
+		count int
+	}{
+		{"lyc", 0x40, 1},
+		{"hblank", 0x08, 144},
+		// The H-blank of line 9 raises the line, and LYC holds it high
+		// through the H-blank of line 10, so they share one interrupt.
+		{"lyc and hblank", 0x48, 143},
+		{"vblank", 0x10, 1},
+	}
+
+	for _, test := range tests {
+		// di; jr -2
+		gb := NewMachine(newTestROM(0xF3, 0x18, 0xFE), false)
+		gb.Write(0xFF45, 10)
+		gb.Write(0xFF41, test.stat)
+		gb.StepFrame()
+
+		count := 0
+		for start := gb.cpu.clock; gb.cpu.clock-start < 70224; {
+			gb.cpu.irq = 0
+			gb.Step()
+			if gb.cpu.irq&intLCDStat != 0 {
+				count++
+			}
+		}
+
+		if count != test.count {
+			t.Errorf("%s: expected %d STAT interrupts per frame, got %d", test.name, test.count, count)
+		}
+	}
+}
+
+func TestSprites(t *testing.T) {
+	gb := newPPUTestMachine(0x00)
+	writeObject(gb, 5, 0x20, 0x30, 0x42, 0xFD)
+
+	sprites := gb.Sprites()
+	expected := SpriteEntry{
+		Y:          0x20,
+		X:          0x30,
+		Tile:       0x42,
+		Priority:   true,
+		YFlip:      true,
+		XFlip:      true,
+		Palette:    1,
+		Bank:       1,
+		CGBPalette: 5,
+	}
+	if sprites[5] != expected {
+		t.Errorf("expected %+v, got %+v", expected, sprites[5])
+	}
+	if sprites[4] != (SpriteEntry{}) {
+		t.Errorf("expected empty entry, got %+v", sprites[4])
+	}
+}
+
+func TestFrameWrap(t *testing.T) {
+	gb := newPPUTestMachine(0x91)
+	gb.cpu.irq = 0
+
+	var vblanks []int
+	maxLY, wraps := uint8(0), 0
+	prevLY := gb.ppu.ly
+	for dot := 0; dot < 70224*3; dot++ {
+		gb.stepPixel()
+
+		if gb.cpu.irq&intVBlank != 0 {
+			gb.cpu.irq &^= intVBlank
+			vblanks = append(vblanks, dot)
+		}
+
+		ly := gb.ppu.ly
+		if ly != prevLY {
+			switch {
+			case ly == prevLY+1:
+			case prevLY == 153 && ly == 0:
+				wraps++
+			default:
+				t.Fatalf("dot %d: unexpected LY change from %d to %d", dot, prevLY, ly)
+			}
+			prevLY = ly
+		}
+		if ly > maxLY {
+			maxLY = ly
+		}
+	}
+
+	if len(vblanks) != 3 {
+		t.Fatalf("expected 3 VBlank interrupts, got %d", len(vblanks))
+	}
+	for i := 1; i < len(vblanks); i++ {
+		if n := vblanks[i] - vblanks[i-1]; n != 70224 {
+			t.Errorf("expected 70224 cycles between VBlank interrupts, got %d", n)
+		}
+	}
+	if maxLY != 153 {
+		t.Errorf("expected LY to reach 153, got %d", maxLY)
+	}
+	if wraps < 2 {
+		t.Errorf("expected LY to wrap from 153 to 0 each frame, got %d wraps", wraps)
+	}
+}
+
+func TestStrictPPUAccess(t *testing.T) {
+	for _, strict := range []bool{true, false} {
+		gb := newPPUTestMachine(0x91)
+		gb.SetStrictPPUAccess(strict)
+		gb.Write(0x8000, 0x42)
+		gb.Write(0xFE00, 0x24)
+
+		for !(gb.ppu.modeHi && gb.ppu.modeLo) {
+			gb.Step()
+		}
+
+		vram, oam := uint8(0x42), uint8(0x24)
+		if strict {
+			vram, oam = 0xFF, 0xFF
+		}
+		if v := gb.cpuRead(0x8000); v != vram {
+			t.Errorf("strict=%v: expected VRAM read during mode 3 to return %02x, got %02x", strict, vram, v)
+		}
+		if v := gb.cpuRead(0xFE00); v != oam {
+			t.Errorf("strict=%v: expected OAM read during mode 3 to return %02x, got %02x", strict, oam, v)
+		}
+
+		gb.cpuWrite(0x8000, 0x99)
+		want := uint8(0x99)
+		if strict {
+			want = 0x42
+		}
+		if v := gb.Read(0x8000); v != want {
+			t.Errorf("strict=%v: expected VRAM write during mode 3 to leave %02x, got %02x", strict, want, v)
+		}
+	}
+}
+
+func TestVBlankStatInterrupt(t *testing.T) {
+	tests := []struct {
+		stat    uint8
+		statIRQ bool
+	}{
+		{0x00, false},
+		{0x10, true},
+	}
+
+	for _, test := range tests {
+		gb := newPPUTestMachine(0x91)
+		gb.Write(0xFF41, test.stat)
+		for gb.ppu.clock != 65664 {
+			gb.stepPixel()
+		}
+		gb.cpu.irq = 0
+
+		// Both interrupts are requested on the cycle VBlank begins.
+		gb.stepPixel()
+		if gb.cpu.irq&intVBlank == 0 {
+			t.Errorf("STAT=%02x: expected VBlank interrupt at VBlank entry", test.stat)
+		}
+		if statIRQ := gb.cpu.irq&intLCDStat != 0; statIRQ != test.statIRQ {
+			t.Errorf("STAT=%02x: expected STAT interrupt %v at VBlank entry, got %v", test.stat, test.statIRQ, statIRQ)
+		}
+	}
+}
+
+func TestTileDataAddressing(t *testing.T) {
+	// Each candidate tile has a distinct pattern in its first row.
+	tiles := []struct {
+		addr    uint16
+		pattern uint8
+	}{
+		{0x8000, 0x01},
+		{0x87F0, 0x02},
+		{0x8800, 0x03},
+		{0x8FF0, 0x04},
+		{0x9000, 0x05},
+		{0x97F0, 0x06},
+	}
+	entries := []uint8{0x00, 0x7F, 0x80, 0xFF}
+
+	tests := []struct {
+		name     string
+		lcdc     uint8
+		patterns []uint8
+	}{
+		{"8000 unsigned", 0x91, []uint8{0x01, 0x02, 0x03, 0x04}},
+		// Entries 0x80-0xFF are shared; 0x00-0x7F are based at 0x9000.
+		{"8800 signed", 0x81, []uint8{0x05, 0x06, 0x03, 0x04}},
+	}
+
+	for _, test := range tests {
+		gb := newPPUTestMachine(test.lcdc)
+		gb.Write(0xFF47, 0xE4)
+		for _, tile := range tiles {
+			writeTile(gb, tile.addr, tile.pattern, 0x00)
+		}
+		for i, entry := range entries {
+			gb.Write(0x9800+uint16(i), entry)
+		}
+
+		gb.StepFrame()
+		gb.StepFrame()
+
+		for i, entry := range entries {
+			pattern := uint8(0)
+			for x := 0; x < 8; x++ {
+				if pixelAt(gb, i*8+x, 0) == 1 {
+					pattern |= 0x80 >> uint(x)
+				}
+			}
+			if pattern != test.patterns[i] {
+				t.Errorf("%s: entry $%02x: expected pattern %02x, got %02x", test.name, entry, test.patterns[i], pattern)
+			}
+		}
+	}
+}
+
+func TestSpriteOverflowStats(t *testing.T) {
+	gb := newPPUTestMachine(0x93)
+
+	// 12 objects on lines 20-27, and 3 on lines 50-57.
+	for n := 0; n < 12; n++ {
+		writeObject(gb, n, 36, uint8(8+n*8), 0, 0x00)
+	}
+	for n := 12; n < 15; n++ {
+		writeObject(gb, n, 66, uint8(8+n*8), 0, 0x00)
+	}
+
+	gb.StepFrame()
+	gb.StepFrame()
+
+	stats := gb.SpriteOverflowStats()
+	if stats.Lines != 8 || stats.Dropped != 16 {
+		t.Errorf("expected 8 lines and 16 objects dropped, got %d lines and %d objects", stats.Lines, stats.Dropped)
+	}
+	for _, line := range []int{19, 20, 27, 28, 50} {
+		expected := 0
+		if line >= 20 && line < 28 {
+			expected = 2
+		}
+		if stats.PerLine[line] != expected {
+			t.Errorf("line %d: expected %d objects dropped, got %d", line, expected, stats.PerLine[line])
+		}
+	}
+
+	// The stats are reset each frame.
+	writeObject(gb, 11, 0, 0, 0, 0x00)
+	gb.StepFrame()
+
+	stats = gb.SpriteOverflowStats()
+	if stats.Lines != 8 || stats.Dropped != 8 || stats.PerLine[20] != 1 {
+		t.Errorf("expected 1 object dropped on 8 lines, got %d on line 20, %d in total on %d lines", stats.PerLine[20], stats.Dropped, stats.Lines)
+	}
+}
+
+func TestIncrementVRAMDuringMode3(t *testing.T) {
+	for _, strict := range []bool{true, false} {
+		// inc (hl); jr -2
+		gb := NewMachine(newTestROM(0x34, 0x18, 0xFE), false)
+		gb.SetStrictPPUAccess(strict)
+		gb.Write(0x8000, 0x41)
+		gb.cpu.h, gb.cpu.l = 0x80, 0x00
+		gb.cpu.pc = 0x0101
+
+		// Run inc (hl) at the start of mode 3, so it finishes within it.
+		for !(gb.ppu.modeHi && gb.ppu.modeLo) {
+			gb.Step()
+		}
+		gb.cpu.pc = 0x0100
+		gb.Step()
+		if !(gb.ppu.modeHi && gb.ppu.modeLo) {
+			t.Fatal("expected inc (hl) to run within mode 3")
+		}
+
+		vram, zero := uint8(0x42), false
+		if strict {
+			// The read returns 0xFF, so the result is 0, and the write
+			// is dropped.
+			vram, zero = 0x41, true
+		}
+		if v := gb.Read(0x8000); v != vram {
+			t.Errorf("strict=%v: expected ($8000)=%02x, got %02x", strict, vram, v)
+		}
+		if z := gb.cpu.f&zeroFlag != 0; z != zero {
+			t.Errorf("strict=%v: expected Z=%v, got %v", strict, zero, z)
+		}
+	}
+}
+
+func TestOAMWriteDuringMode2(t *testing.T) {
+	for _, strict := range []bool{true, false} {
+		gb := newPPUTestMachine(0x93)
+		gb.SetStrictPPUAccess(strict)
+
+		// OBJ tile 1: solid color 3, drawn as shade 3 over a shade 0 BG.
+		writeTile(gb, 0x8010, 0xFF, 0xFF)
+		gb.Write(0xFF47, 0x00)
+		gb.Write(0xFF48, 0xE4)
+
+		// An object on lines 8-15, at x=16.
+		writeObject(gb, 0, 24, 24, 1, 0x00)
+
+		// Move the object to x=40 halfway through the OAM scan of line 10.
+		for gb.ppu.clock < 10*456+40 {
+			gb.stepPixel()
+		}
+		if !gb.ppu.modeHi || gb.ppu.modeLo {
+			t.Fatal("expected mode 2")
+		}
+		gb.cpuWrite(0xFE01, 48)
+		for gb.ppu.clock < 12*456 {
+			gb.stepPixel()
+		}
+
+		// Line 10 is drawn from OAM as it was when the scan started. The write
+		// only lands, and shows on line 11, if OAM is accessible.
+		next := 40
+		if strict {
+			next = 16
+		}
+		for _, line := range []struct{ y, x int }{{10, 16}, {11, next}} {
+			for x := 0; x < 160; x++ {
+				shade := 0
+				if x >= line.x && x < line.x+8 {
+					shade = 3
+				}
+				if got := pixelAt(gb, x, line.y); got != shade {
+					t.Errorf("strict=%v (%d, %d): expected shade %d, got %d", strict, x, line.y, shade, got)
+				}
+			}
+		}
+	}
+}
+
+func TestWindowActive(t *testing.T) {
+	gb := newPPUTestMachine(0xB1)
+
+	// Window covering the lower half of the screen.
+	gb.Write(0xFF4A, 72)
+	gb.Write(0xFF4B, 7)
+
+	for y := 0; y < 144; y++ {
+		for gb.ppu.clock < y*456+80+172 {
+			gb.stepPixel()
+		}
+		if active := gb.WindowActive(); active != (y >= 72) {
+			t.Errorf("line %d: expected window active=%v, got %v", y, y >= 72, active)
+		}
+	}
+
+	for gb.ppu.clock <= 144*456 {
+		gb.stepPixel()
+	}
+	if gb.WindowActive() {
+		t.Error("expected window inactive during VBlank")
+	}
+
+	// The window is not drawn when WX is off screen.
+	gb = newPPUTestMachine(0xB1)
+	gb.Write(0xFF4A, 0)
+	gb.Write(0xFF4B, 167)
+	for gb.ppu.clock < 80+172 {
+		gb.stepPixel()
+	}
+	if gb.WindowActive() {
+		t.Error("expected window inactive with WX=167")
+	}
+}
+
+func TestFineScrollDiscard(t *testing.T) {
+	for _, scx := range []uint8{0, 5} {
+		gb := newPPUTestMachine(0x91)
+		gb.Write(0xFF47, 0xE4)
+		gb.Write(0xFF43, scx)
+
+		// Alternate BG tile 1, color 1 on its right half, and tile 2, solid
+		// color 3.
+		writeTile(gb, 0x8010, 0x0F, 0x00)
+		writeTile(gb, 0x8020, 0xFF, 0xFF)
+		for x := uint16(0); x < 32; x++ {
+			gb.Write(0x9800+x, uint8(1+x%2))
+		}
+
+		// Count the dots spent in mode 3 on line 0.
+		mode3 := 0
+		for gb.ppu.clock < 456 {
+			gb.stepPixel()
+			if gb.ppu.modeHi && gb.ppu.modeLo {
+				mode3++
+			}
+		}
+		if want := 160 + int(scx); mode3 != want {
+			t.Errorf("scx=%d: expected mode 3 to last %d dots, got %d", scx, want, mode3)
+		}
+
+		for x := 0; x < 160; x++ {
+			bgx := (x + int(scx)) % 256
+			shade := 3
+			if bgx/8%2 == 0 {
+				shade = 0
+				if bgx%8 >= 4 {
+					shade = 1
+				}
+			}
+			if got := pixelAt(gb, x, 0); got != shade {
+				t.Errorf("scx=%d (%d, 0): expected shade %d, got %d", scx, x, shade, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package gameboy
+
+// This file implements a RAM search for finding the addresses of values, as
+// used for hunting cheat codes.
+
+// ramSearchRegions lists the writable memory regions covered by a RAM search.
+var ramSearchRegions = [][2]uint16{
+	{0xA000, 0xC000}, // External RAM
+	{0xC000, 0xE000}, // Work RAM
+	{0xFF80, 0xFFFF}, // High RAM
+}
+
+// RAMSearch narrows down a set of candidate addresses by comparing their
+// values against the previous snapshot. Memory is read with Peek, so searching
+// is not counted in AccessStats.
+type RAMSearch struct {
+	gb         *Machine
+	candidates []uint16
+	values     []uint8
+}
+
+// RAMSearch starts a new search with every writable address as a candidate.
+func (gb *Machine) RAMSearch() *RAMSearch {
+	s := &RAMSearch{gb: gb}
+
+	for _, region := range ramSearchRegions {
+		for addr := region[0]; addr < region[1]; addr++ {
+			s.candidates = append(s.candidates, addr)
+			s.values = append(s.values, gb.Peek(addr))
+		}
+	}
+
+	return s
+}
+
+// filter keeps candidates for which keep returns true given the previous and
+// current values, and updates the snapshot.
+func (s *RAMSearch) filter(keep func(prev, curr uint8) bool) {
+	n := 0
+
+	for i, addr := range s.candidates {
+		curr := s.gb.Peek(addr)
+		if !keep(s.values[i], curr) {
+			continue
+		}
+
+		s.candidates[n] = addr
+		s.values[n] = curr
+		n++
+	}
+
+	s.candidates = s.candidates[:n]
+	s.values = s.values[:n]
+}
+
+// FilterEqual keeps addresses currently holding the given value.
+func (s *RAMSearch) FilterEqual(value uint8) {
+	s.filter(func(prev, curr uint8) bool { return curr == value })
+}
+
+// FilterNotEqual keeps addresses not currently holding the given value.
+func (s *RAMSearch) FilterNotEqual(value uint8) {
+	s.filter(func(prev, curr uint8) bool { return curr != value })
+}
+
+// FilterChanged keeps addresses whose value changed since the last filter.
+func (s *RAMSearch) FilterChanged() {
+	s.filter(func(prev, curr uint8) bool { return curr != prev })
+}
+
+// FilterUnchanged keeps addresses whose value is the same as at the last
+// filter.
+func (s *RAMSearch) FilterUnchanged() {
+	s.filter(func(prev, curr uint8) bool { return curr == prev })
+}
+
+// FilterLess keeps addresses whose value decreased since the last filter.
+func (s *RAMSearch) FilterLess() {
+	s.filter(func(prev, curr uint8) bool { return curr < prev })
+}
+
+// FilterGreater keeps addresses whose value increased since the last filter.
+func (s *RAMSearch) FilterGreater() {
+	s.filter(func(prev, curr uint8) bool { return curr > prev })
+}
+
+// Candidates returns the remaining candidate addresses.
+func (s *RAMSearch) Candidates() []uint16 {
+	return append([]uint16(nil), s.candidates...)
+}
@@ -0,0 +1,45 @@
+package gameboy
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRAMSearch(t *testing.T) {
+	gb := NewMachine(ROM(nil), false)
+	gb.Write(0xC123, 5)
+	gb.Write(0xD000, 5)
+	gb.Write(0xFF90, 5)
+
+	s := gb.RAMSearch()
+
+	s.FilterEqual(5)
+	if c := s.Candidates(); !reflect.DeepEqual(c, []uint16{0xC123, 0xD000, 0xFF90}) {
+		t.Fatalf("after FilterEqual: unexpected candidates %04x", c)
+	}
+
+	gb.Write(0xC123, 6)
+	gb.Write(0xD000, 4)
+	s.FilterChanged()
+	if c := s.Candidates(); !reflect.DeepEqual(c, []uint16{0xC123, 0xD000}) {
+		t.Fatalf("after FilterChanged: unexpected candidates %04x", c)
+	}
+
+	gb.Write(0xC123, 7)
+	gb.Write(0xD000, 3)
+	s.FilterGreater()
+	if c := s.Candidates(); !reflect.DeepEqual(c, []uint16{0xC123}) {
+		t.Fatalf("after FilterGreater: unexpected candidates %04x", c)
+	}
+
+	s.FilterUnchanged()
+	if c := s.Candidates(); !reflect.DeepEqual(c, []uint16{0xC123}) {
+		t.Fatalf("after FilterUnchanged: unexpected candidates %04x", c)
+	}
+
+	gb.Write(0xC123, 1)
+	s.FilterLess()
+	if c := s.Candidates(); !reflect.DeepEqual(c, []uint16{0xC123}) {
+		t.Fatalf("after FilterLess: unexpected candidates %04x", c)
+	}
+}
@@ -0,0 +1,157 @@
+package gameboy
+
+import "math"
+
+// ResampleMode selects how APU output is resampled to the audio sample rate.
+type ResampleMode int
+
+const (
+	// ResampleNearest takes the APU output at each sample point. It is the
+	// fastest mode, but tones above the Nyquist frequency alias.
+	ResampleNearest ResampleMode = iota
+
+	// ResampleLinear interpolates between the APU output on either side of
+	// each sample point.
+	ResampleLinear
+
+	// ResampleLowPass averages the APU output down to an intermediate rate,
+	// then applies a windowed-sinc low-pass filter below the Nyquist
+	// frequency of the sample rate.
+	ResampleLowPass
+)
+
+const (
+	// lowPassDecimation is the number of clocks averaged into each sample at
+	// the intermediate rate.
+	lowPassDecimation = 32
+
+	// lowPassRate is the intermediate rate of the low-pass resampler.
+	lowPassRate = apuClockRate / lowPassDecimation
+
+	// lowPassTaps is the length of the low-pass filter kernel.
+	lowPassTaps = 63
+
+	// lowPassCutoff is the filter cutoff, relative to the sample rate.
+	lowPassCutoff = 0.45
+)
+
+// resampler holds the state of the audio resampler.
+type resampler struct {
+	mode ResampleMode
+
+	// Previous output, for linear interpolation.
+	prevLeft, prevRight float32
+
+	// Running sums of the output, for decimation.
+	sumLeft, sumRight float32
+	sumCount          int
+
+	// Decimated output history and filter kernel.
+	histLeft, histRight [lowPassTaps]float32
+	histPos             int
+	kernel              [lowPassTaps]float32
+}
+
+// setKernel computes the low-pass filter kernel for the given sample rate,
+// using a Blackman window.
+func (rs *resampler) setKernel(sampleRate int) {
+	fc := math.Min(lowPassCutoff*float64(sampleRate)/lowPassRate, 0.5)
+	mid := float64(lowPassTaps-1) / 2
+
+	sum := 0.0
+	kernel := [lowPassTaps]float64{}
+	for i := range kernel {
+		n := float64(i) - mid
+
+		sinc := 2 * fc
+		if n != 0 {
+			sinc = math.Sin(2*math.Pi*fc*n) / (math.Pi * n)
+		}
+
+		phase := 2 * math.Pi * float64(i) / (lowPassTaps - 1)
+		window := 0.42 - 0.5*math.Cos(phase) + 0.08*math.Cos(2*phase)
+
+		kernel[i] = sinc * window
+		sum += kernel[i]
+	}
+
+	// Normalize for unity gain at DC.
+	for i := range kernel {
+		rs.kernel[i] = float32(kernel[i] / sum)
+	}
+}
+
+// push adds the output for one clock to the decimation and filter history.
+func (rs *resampler) push(left, right float32) {
+	rs.sumLeft += left
+	rs.sumRight += right
+	rs.sumCount++
+	if rs.sumCount < lowPassDecimation {
+		return
+	}
+
+	rs.histLeft[rs.histPos] = rs.sumLeft / lowPassDecimation
+	rs.histRight[rs.histPos] = rs.sumRight / lowPassDecimation
+	rs.histPos = (rs.histPos + 1) % lowPassTaps
+	rs.sumLeft, rs.sumRight, rs.sumCount = 0, 0, 0
+}
+
+// filter applies the low-pass filter to the history.
+func (rs *resampler) filter() (left, right float32) {
+	for i, k := range rs.kernel {
+		j := (rs.histPos + i) % lowPassTaps
+		left += rs.histLeft[j] * k
+		right += rs.histRight[j] * k
+	}
+	return left, right
+}
+
+// setResampler sets the resample mode, clearing any resampler history.
+func (apu *APU) setResampler(mode ResampleMode) {
+	apu.resampler = resampler{mode: mode}
+	apu.resampler.setKernel(apu.sampleRate)
+}
+
+// setSampleRate sets the audio sample rate, in Hz. Rates of 0 or less select
+// the default rate.
+func (apu *APU) setSampleRate(hz int) {
+	if hz <= 0 {
+		hz = defaultSampleRate
+	}
+	apu.sampleRate = hz
+	apu.sampleClock = 0
+	apu.resampler.setKernel(hz)
+}
+
+// stepOutput resamples the APU output, emitting a sample to the sink whenever
+// one is due at the current sample rate.
+func (apu *APU) stepOutput() {
+	apu.sampleClock += apu.sampleRate
+	due := apu.sampleClock >= apuClockRate
+	if due {
+		apu.sampleClock -= apuClockRate
+	}
+
+	rs := &apu.resampler
+	switch rs.mode {
+	case ResampleNearest:
+		if due && apu.sink != nil {
+			apu.sink(apu.mix())
+		}
+
+	case ResampleLinear:
+		left, right := apu.mix()
+		if due && apu.sink != nil {
+			// The sample point lies this far back towards the previous clock.
+			t := float32(apu.sampleClock) / float32(apu.sampleRate)
+			apu.sink(left+(rs.prevLeft-left)*t, right+(rs.prevRight-right)*t)
+		}
+		rs.prevLeft, rs.prevRight = left, right
+
+	case ResampleLowPass:
+		rs.push(apu.mix())
+		if due && apu.sink != nil {
+			apu.sink(rs.filter())
+		}
+	}
+}
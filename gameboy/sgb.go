@@ -0,0 +1,291 @@
+package gameboy
+
+// This file implements Super GameBoy borders. The game sends command packets
+// to the SGB by pulsing the P1 select lines. The border is loaded through SGB
+// VRAM transfers: CHR_TRN transfers border tiles, and PCT_TRN transfers the
+// border tilemap and palettes. MLT_REQ is supported so that games detect the
+// SGB, and the PAL commands set the backdrop color.
+
+const (
+	sgbWidth  = 256
+	sgbHeight = 224
+
+	// Position of the game screen within the border
+	sgbScreenX = 48
+	sgbScreenY = 40
+
+	// SGB power-on color 0, shared by all palettes, in SNES BGR555
+	sgbDefaultBackdrop = 0x67BF
+)
+
+// SGB commands
+const (
+	sgbPAL01  = 0x00
+	sgbPAL23  = 0x01
+	sgbPAL03  = 0x02
+	sgbPAL12  = 0x03
+	sgbMLTREQ = 0x11
+	sgbCHRTRN = 0x13
+	sgbPCTTRN = 0x14
+)
+
+// sgbBorder contains the state of the Super GameBoy border.
+type sgbBorder struct {
+	enabled bool
+
+	// Command packet being received over P1. bit is -1 while waiting for a
+	// reset pulse, -2 until the stop bit pulse ends, and 128 while waiting
+	// for the stop bit.
+	lines  uint8
+	packet [16]byte
+	bit    int
+
+	// Data of a command sent over several packets
+	command []byte
+	packets int
+
+	// Multiplayer joypad selection, set by MLT_REQ
+	players uint8
+	player  uint8
+
+	// VRAM transfer to run at the end of the frame, if any
+	transfer    uint8
+	transferArg uint8
+
+	// 256 SNES 4bpp tiles
+	tiles [0x2000]byte
+
+	// 32x28 tilemap, palettes 4-7 and the backdrop color, as 0xAARRGGBB
+	// colors
+	tileMap  [32 * 28]uint16
+	palettes [4][16]uint32
+	backdrop uint32
+
+	screen [sgbWidth * sgbHeight]uint32
+}
+
+// reset sets the SGB to its power-on state.
+func (sgb *sgbBorder) reset() {
+	enabled := sgb.enabled
+	*sgb = sgbBorder{enabled: enabled}
+	sgb.lines = 0x30
+	sgb.bit = -1
+	sgb.players = 1
+	sgb.backdrop = sgbColor(sgbDefaultBackdrop)
+}
+
+// sgbWriteP1 handles a write to P1 while the SGB is enabled. A pulse of both
+// select lines low starts a packet; after that, each pulse of P14 low sends a
+// 0 bit, and each pulse of P15 low sends a 1 bit, LSB first. A packet is 128
+// bits, followed by a 0 stop bit.
+func (gb *Machine) sgbWriteP1(value uint8) {
+	sgb := &gb.sgb
+	lines := value & 0x30
+	if lines == sgb.lines {
+		return
+	}
+	prev := sgb.lines
+	sgb.lines = lines
+
+	switch lines {
+	case 0x00:
+		sgb.packet = [16]byte{}
+		sgb.bit = 0
+		return
+	case 0x30:
+		// Releasing both lines outside of a packet selects the next joypad.
+		if sgb.bit == -1 && prev != 0x00 {
+			sgb.player = (sgb.player + 1) % sgb.players
+		}
+		if sgb.bit == -2 {
+			sgb.bit = -1
+		}
+		return
+	}
+	if prev != 0x30 || sgb.bit < 0 {
+		return
+	}
+
+	one := lines == 0x10
+	if sgb.bit == 128 {
+		sgb.bit = -2
+		if !one {
+			gb.sgbPacket()
+		}
+		return
+	}
+	if one {
+		sgb.packet[sgb.bit/8] |= 1 << uint(sgb.bit%8)
+	}
+	sgb.bit++
+}
+
+// sgbPacket handles a received packet, running the command once all of its
+// packets are received.
+func (gb *Machine) sgbPacket() {
+	sgb := &gb.sgb
+	if sgb.packets == 0 {
+		sgb.command = sgb.command[:0]
+		sgb.packets = int(sgb.packet[0] & 7)
+		if sgb.packets == 0 {
+			sgb.packets = 1
+		}
+	}
+	sgb.command = append(sgb.command, sgb.packet[:]...)
+	sgb.packets--
+	if sgb.packets > 0 {
+		return
+	}
+
+	data := sgb.command
+	switch data[0] >> 3 {
+	case sgbPAL01, sgbPAL23, sgbPAL03, sgbPAL12:
+		sgb.backdrop = sgbColor(uint16(data[1]) | uint16(data[2])<<8)
+	case sgbMLTREQ:
+		sgb.players = [4]uint8{1, 2, 1, 4}[data[1]&3]
+		sgb.player = 0
+	case sgbCHRTRN, sgbPCTTRN:
+		// The SGB captures the next frame sent to the screen.
+		sgb.transfer, sgb.transferArg = data[0]>>3, data[1]
+	}
+}
+
+// sgbReadP1 returns the value read from P1, given the value read from the
+// joypad. With several joypads selected by MLT_REQ and neither select line
+// low, the low bits read the current joypad number: $F for joypad 1, $E for
+// joypad 2 and so on.
+func (gb *Machine) sgbReadP1(value uint8) uint8 {
+	sgb := &gb.sgb
+	if sgb.players > 1 && value&0x30 == 0x30 {
+		return value&0xF0 | 0xF - sgb.player
+	}
+	return value
+}
+
+// sgbEndFrame runs a pending VRAM transfer and draws the border.
+func (gb *Machine) sgbEndFrame() {
+	sgb := &gb.sgb
+	switch sgb.transfer {
+	case sgbCHRTRN:
+		gb.sgbCharTransfer(sgb.transferArg&1 != 0)
+	case sgbPCTTRN:
+		gb.sgbPictureTransfer()
+	}
+	sgb.transfer = 0
+
+	sgb.compose(gb.GetDisplayFrameBuffer())
+}
+
+// sgbColor converts a SNES BGR555 color to 0xAARRGGBB.
+func sgbColor(c uint16) uint32 {
+	expand := func(v uint16) uint32 {
+		v &= 0x1f
+		return uint32(v<<3 | v>>2)
+	}
+	return 0xFF000000 | expand(c)<<16 | expand(c>>5)<<8 | expand(c>>10)
+}
+
+// sgbTransferData returns the 4 KiB of data sent by an SGB VRAM transfer. The
+// SGB captures the screen, so the data is read from the first 256 BG tiles in
+// tilemap order.
+func (gb *Machine) sgbTransferData() []byte {
+	ppu := &gb.ppu
+	data := make([]byte, 0, 0x1000)
+
+	mapBase := uint(0x1800)
+	if ppu.bgTileMapSelect {
+		mapBase = 0x1C00
+	}
+
+	for i := uint(0); i < 256; i++ {
+		tile := uint(ppu.vram[mapBase+i/20*32+i%20])
+
+		var addr uint
+		if ppu.bgTileDataSelect {
+			addr = tile << 4
+		} else {
+			addr = uint(0x1000 + int(int8(tile))<<4)
+		}
+
+		data = append(data, ppu.vram[addr:addr+16]...)
+	}
+
+	return data
+}
+
+// sgbCharTransfer handles CHR_TRN, loading the lower or upper 128 border tiles.
+func (gb *Machine) sgbCharTransfer(upper bool) {
+	offset := 0
+	if upper {
+		offset = 0x1000
+	}
+	copy(gb.sgb.tiles[offset:], gb.sgbTransferData())
+}
+
+// sgbPictureTransfer handles PCT_TRN, loading the border tilemap and palettes.
+func (gb *Machine) sgbPictureTransfer() {
+	data := gb.sgbTransferData()
+
+	for i := range gb.sgb.tileMap {
+		gb.sgb.tileMap[i] = uint16(data[i*2]) | uint16(data[i*2+1])<<8
+	}
+
+	for p := range gb.sgb.palettes {
+		for c := range gb.sgb.palettes[p] {
+			offset := 0x800 + p*32 + c*2
+			gb.sgb.palettes[p][c] = sgbColor(uint16(data[offset]) | uint16(data[offset+1])<<8)
+		}
+	}
+}
+
+// compose draws the border with the game screen in the center.
+func (sgb *sgbBorder) compose(screen *[160 * 144]uint32) {
+	for y := 0; y < sgbHeight; y++ {
+		for x := 0; x < sgbWidth; x++ {
+			entry := sgb.tileMap[y/8*32+x/8]
+
+			tx, ty := uint(x%8), uint(y%8)
+			if entry&0x4000 != 0 {
+				tx = 7 - tx
+			}
+			if entry&0x8000 != 0 {
+				ty = 7 - ty
+			}
+
+			// SNES 4bpp tiles store planes 0 and 1, then planes 2 and 3.
+			tile := sgb.tiles[uint(entry&0xff)*32:]
+			bit := uint8(0x80 >> tx)
+			index := 0
+			for plane, b := range [4]byte{tile[ty*2], tile[ty*2+1], tile[16+ty*2], tile[16+ty*2+1]} {
+				if b&bit != 0 {
+					index |= 1 << uint(plane)
+				}
+			}
+
+			// Color 0 is transparent, showing the backdrop.
+			color := sgb.backdrop
+			if index != 0 {
+				color = sgb.palettes[(entry>>10)&0x3][index]
+			}
+			sgb.screen[y*sgbWidth+x] = color
+		}
+	}
+
+	for y := 0; y < 144; y++ {
+		copy(sgb.screen[(sgbScreenY+y)*sgbWidth+sgbScreenX:], screen[y*160:(y+1)*160])
+	}
+}
+
+// SetSGBBorder enables or disables Super GameBoy border support. While
+// enabled, the machine decodes SGB command packets sent by the game, and
+// renders the border it loads.
+func (gb *Machine) SetSGBBorder(enabled bool) {
+	gb.sgb.enabled = enabled
+}
+
+// GetBorderFrameBuffer grabs the 256x224 framebuffer containing the Super
+// GameBoy border, with the game screen in the center. It is updated each
+// frame while the border is enabled, in the same format as GetFrameBuffer.
+func (gb *Machine) GetBorderFrameBuffer() *[sgbWidth * sgbHeight]uint32 {
+	return &gb.sgb.screen
+}
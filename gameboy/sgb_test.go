@@ -0,0 +1,114 @@
+package gameboy
+
+import "testing"
+
+// writeSGBTransfer lays out VRAM so that an SGB VRAM transfer sends data.
+func writeSGBTransfer(gb *Machine, data []byte) {
+	for i := uint16(0); i < 256; i++ {
+		gb.Write(0x9800+i/20*32+i%20, uint8(i))
+	}
+	gb.WriteRange(0x8000, data)
+}
+
+// sendSGBPacket sends a command packet to the SGB over P1.
+func sendSGBPacket(gb *Machine, packet ...byte) {
+	var data [16]byte
+	copy(data[:], packet)
+
+	gb.Write(0xFF00, 0x00)
+	gb.Write(0xFF00, 0x30)
+	for bit := 0; bit < 129; bit++ {
+		if bit < 128 && data[bit/8]&(1<<uint(bit%8)) != 0 {
+			gb.Write(0xFF00, 0x10)
+		} else {
+			gb.Write(0xFF00, 0x20)
+		}
+		gb.Write(0xFF00, 0x30)
+	}
+}
+
+func TestSGBBorder(t *testing.T) {
+	// LCD off, with unsigned tile data addressing for the transfers.
+	gb := newPPUTestMachine(0x10)
+	gb.SetSGBBorder(true)
+
+	// PAL01 with blue as the shared color 0.
+	sendSGBPacket(gb, sgbPAL01<<3|1, 0x00, 0x7C)
+
+	// Border tile 1: row 0 is color 1, row 1 is color 0.
+	chr := make([]byte, 0x1000)
+	chr[32] = 0xFF
+	writeSGBTransfer(gb, chr)
+	sendSGBPacket(gb, sgbCHRTRN<<3|1, 0x00)
+	gb.StepFrame()
+	gb.StepFrame()
+
+	// Tile 1 with palette 4 in the top left, red as palette 4 color 1.
+	pct := make([]byte, 0x1000)
+	pct[0], pct[1] = 0x01, 0x10
+	pct[0x802], pct[0x803] = 0x1F, 0x00
+	writeSGBTransfer(gb, pct)
+	sendSGBPacket(gb, sgbPCTTRN<<3|1)
+	gb.StepFrame()
+	gb.StepFrame()
+
+	gb.Write(0xFF40, 0x91)
+	gb.Write(0xFF47, 0x1B)
+	gb.StepFrame()
+	gb.StepFrame()
+
+	border := gb.GetBorderFrameBuffer()
+	if len(border) != 256*224 {
+		t.Fatalf("expected 256x224 border, got %d pixels", len(border))
+	}
+
+	tests := []struct {
+		x, y  int
+		color uint32
+	}{
+		{0, 0, 0xFFFF0000},
+		{7, 0, 0xFFFF0000},
+		{8, 0, 0xFF0000FF},
+		{0, 1, 0xFF0000FF},
+		{48 + 10, 40 + 10, gb.ppu.screen[10*160+10]},
+		{48 + 159, 40 + 143, gb.ppu.screen[143*160+159]},
+	}
+
+	for _, test := range tests {
+		if color := border[test.y*256+test.x]; color != test.color {
+			t.Errorf("(%d, %d): expected %08x, got %08x", test.x, test.y, test.color, color)
+		}
+	}
+}
+
+func TestSGBBorderDisabled(t *testing.T) {
+	gb := newPPUTestMachine(0x10)
+
+	// Packets are ignored without the SGB.
+	sendSGBPacket(gb, sgbMLTREQ<<3|1, 0x01)
+	gb.Write(0xFF00, 0x30)
+	if v := gb.Read(0xFF00); v&0xF != 0xF {
+		t.Errorf("expected joypad 1 without the SGB, got %02x", v)
+	}
+}
+
+func TestSGBMultiplayer(t *testing.T) {
+	gb := newPPUTestMachine(0x91)
+	gb.SetSGBBorder(true)
+
+	gb.Write(0xFF00, 0x30)
+	if v := gb.Read(0xFF00); v&0xF != 0xF {
+		t.Fatalf("expected joypad 1 before MLT_REQ, got %02x", v)
+	}
+
+	// MLT_REQ for two players; each pulse of a select line then selects the
+	// next joypad.
+	sendSGBPacket(gb, sgbMLTREQ<<3|1, 0x01)
+	for _, id := range []uint8{0xE, 0xF, 0xE} {
+		gb.Write(0xFF00, 0x20)
+		gb.Write(0xFF00, 0x30)
+		if v := gb.Read(0xFF00); v&0xF != id {
+			t.Errorf("expected joypad id %x, got %x", id, v&0xF)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package gameboy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// singleStepTest is a test vector in the SM83 SingleStepTests format.
+type singleStepTest struct {
+	Name    string              `json:"name"`
+	Initial jsmooState          `json:"initial"`
+	Final   jsmooState          `json:"final"`
+	Cycles  [][]json.RawMessage `json:"cycles"`
+}
+
+// busActivity decodes the cycle-by-cycle bus activity of the vector.
+// Internal cycles, which do not access the bus, are nil.
+func (test singleStepTest) busActivity() ([]*busAccess, error) {
+	activity := make([]*busAccess, len(test.Cycles))
+
+	for i, cycle := range test.Cycles {
+		if len(cycle) != 3 {
+			continue
+		}
+
+		var addr, value *uint16
+		var kind string
+		if err := json.Unmarshal(cycle[0], &addr); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(cycle[1], &value); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(cycle[2], &kind); err != nil {
+			return nil, err
+		}
+		if addr == nil || value == nil || strings.Trim(kind, "-") == "" {
+			continue
+		}
+
+		activity[i] = &busAccess{*addr, uint8(*value), strings.Contains(kind, "w")}
+	}
+
+	return activity, nil
+}
+
+// runSingleStepTest runs a single vector and returns a description of each
+// mismatch against the expected final state and bus activity.
+func runSingleStepTest(test singleStepTest) []string {
+	var mismatches []string
+
+	activity, err := test.busActivity()
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	gb, ram := newFlatMachine()
+	gb.SetCPUState(test.Initial.cpuState())
+
+	ram.record = true
+	clock := gb.cpu.clock
+	gb.Step()
+	ram.record = false
+
+	// Registers
+	expect := test.Final.cpuState()
+	actual := gb.GetCPUState()
+	expect.RAM, actual.RAM = nil, nil
+	if !reflect.DeepEqual(actual, expect) {
+		mismatches = append(mismatches, fmt.Sprintf("expected state %+v, got %+v", expect, actual))
+	}
+
+	// Memory
+	for _, b := range test.Final.cpuState().RAM {
+		if v := gb.Read(b.Addr); v != b.Value {
+			mismatches = append(mismatches, fmt.Sprintf("expected (%04x)=%02x, got %02x", b.Addr, b.Value, v))
+		}
+	}
+
+	// Cycles
+	if cycles := int(gb.cpu.clock-clock) / 4; cycles != len(activity) {
+		mismatches = append(mismatches, fmt.Sprintf("expected %d cycles, got %d", len(activity), cycles))
+	}
+
+	// Bus activity. The vectors begin after the opcode fetch and end with
+	// the fetch of the next opcode, so the first and last accesses differ.
+	var expectBus []busAccess
+	for _, a := range activity[:len(activity)-1] {
+		if a != nil {
+			expectBus = append(expectBus, *a)
+		}
+	}
+	actualBus := ram.accesses[1:]
+	if len(expectBus) == 0 && len(actualBus) == 0 {
+		return mismatches
+	}
+	if !reflect.DeepEqual(actualBus, expectBus) {
+		mismatches = append(mismatches, fmt.Sprintf("expected bus activity %+v, got %+v", expectBus, actualBus))
+	}
+
+	return mismatches
+}
+
+func TestSingleStepRunner(t *testing.T) {
+	// A nop, and the same vector with a wrong final pc.
+	const vector = `{"name": "00 0000",
+		"initial": {"pc": 49152, "sp": 65534, "a": 1, "b": 2, "c": 3, "d": 4, "e": 5, "f": 176, "h": 6, "l": 7, "ime": 0, "ie": 0, "ram": [[49152, 0]]},
+		"final": {"pc": %d, "sp": 65534, "a": 1, "b": 2, "c": 3, "d": 4, "e": 5, "f": 176, "h": 6, "l": 7, "ime": 0, "ie": 0, "ram": [[49152, 0]]},
+		"cycles": [[49153, null, "r-m"]]}`
+
+	tests := []struct {
+		pc         int
+		mismatches int
+	}{
+		{49153, 0},
+		{49154, 1},
+	}
+	for _, test := range tests {
+		var vec singleStepTest
+		if err := json.Unmarshal([]byte(fmt.Sprintf(vector, test.pc)), &vec); err != nil {
+			t.Fatal(err)
+		}
+		if mismatches := runSingleStepTest(vec); len(mismatches) != test.mismatches {
+			t.Errorf("(pc=%04x) expected %d mismatches, got %q", test.pc, test.mismatches, mismatches)
+		}
+	}
+}
+
+func TestSingleStep(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "sm83", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Skip("no test vectors in testdata/sm83; run testdata/fetch-sm83.sh")
+	}
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var tests []singleStepTest
+		if err := json.Unmarshal(data, &tests); err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+
+		for _, test := range tests {
+			for _, mismatch := range runSingleStepTest(test) {
+				t.Errorf("%s: %s", test.Name, mismatch)
+			}
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package gameboy
+
+// Snapshot is a saved copy of the emulated state of a machine: the CPU, PPU,
+// APU including channel timers, envelopes and the frame sequencer, RAM and the
+// cartridge.
+type Snapshot struct {
+	gb *Machine
+}
+
+// Snapshot saves the emulated state of the machine, to be restored later with
+// Restore. It returns an error if the cartridge cannot be copied.
+func (gb *Machine) Snapshot() (*Snapshot, error) {
+	c, err := gb.Clone()
+	if err != nil {
+		return nil, err
+	}
+	return &Snapshot{c}, nil
+}
+
+// Restore returns the machine to the emulated state saved in s. Host-side
+// settings, such as callbacks, tracing, audio output and the border, are
+// kept. The step history is cleared. A snapshot can be restored any number of
+// times.
+func (gb *Machine) Restore(s *Snapshot) error {
+	c, err := s.gb.Clone()
+	if err != nil {
+		return err
+	}
+
+	gb.load(c)
+	return nil
+}
+
+// Reset power cycles the machine, as if it were newly created with the same
+// options. The cartridge mapper is reset, but the contents of cartridge RAM
+// are kept. Host-side settings are kept, as with Restore.
+func (gb *Machine) Reset() {
+	if cart, ok := gb.cart.(Cartridge); ok {
+		cart.Reset()
+	}
+
+	c := NewMachineWithOptions(gb.cart, gb.opts)
+	c.apu.setSampleRate(gb.apu.sampleRate)
+	c.apu.setResampler(gb.apu.resampler.mode)
+	gb.load(c)
+}
+
+// load replaces the emulated state of the machine with that of c, keeping
+// host-side settings.
+func (gb *Machine) load(c *Machine) {
+	cpu := c.cpu
+	cpu.trace, cpu.traceOut, cpu.traceVBlanks = gb.cpu.trace, gb.cpu.traceOut, gb.cpu.traceVBlanks
+	cpu.traceWriter = gb.cpu.traceWriter
+	cpu.stackCheck, cpu.stackLo, cpu.stackHi = gb.cpu.stackCheck, gb.cpu.stackLo, gb.cpu.stackHi
+	cpu.onStackViolation = gb.cpu.onStackViolation
+
+	apu := c.apu
+	apu.sink = gb.apu.sink
+
+	sgb := c.sgb
+	sgb.enabled = gb.sgb.enabled
+
+	if old, ok := gb.cart.(*MBC5Cartridge); ok {
+		if cart, ok := c.cart.(*MBC5Cartridge); ok {
+			cart.onRumble = old.onRumble
+		}
+	}
+
+	gb.cpu, gb.ppu, gb.apu, gb.wram, gb.sgb = cpu, c.ppu, apu, c.wram, sgb
+	gb.cart = c.cart
+	gb.frameCounter = c.frameCounter
+	gb.bootLocked = c.bootLocked
+	gb.mapCartridge()
+
+	if gb.history != nil {
+		gb.history = &stepHistory{depth: gb.history.depth}
+	}
+}
+
+// mapCartridge maps the cartridge to the bus, and the boot ROM over it while
+// the boot ROM is mapped.
+func (gb *Machine) mapCartridge() {
+	for i := 0x0000; i < 0x8000; i++ {
+		gb.bus.io[i] = gb.cart
+	}
+	for i := 0xA000; i < 0xC000; i++ {
+		gb.bus.io[i] = gb.cart
+	}
+	if !gb.bootLocked {
+		for i := range gb.bootROM {
+			gb.bus.io[i] = gb.bootROM
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package gameboy
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSnapshotAudio(t *testing.T) {
+	gb := NewMachine(newTestROM(0x18, 0xFE), false)
+
+	var samples []float32
+	gb.SetAudioSink(func(left, right float32) {
+		samples = append(samples, left, right)
+	})
+
+	// Square 1 with a decaying envelope and sweep, and noise.
+	gb.Write(0xFF10, 0x15)
+	gb.Write(0xFF11, 0x80)
+	gb.Write(0xFF12, 0xF3)
+	gb.Write(0xFF13, 0x00)
+	gb.Write(0xFF14, 0x87)
+	gb.Write(0xFF21, 0xA2)
+	gb.Write(0xFF22, 0x31)
+	gb.Write(0xFF23, 0x80)
+
+	// Snapshot mid-note, and at an odd point in the frame.
+	gb.StepFrame()
+	for i := 0; i < 1000; i++ {
+		gb.Step()
+	}
+	snap, err := gb.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	samples = nil
+	gb.StepFrame()
+	gb.StepFrame()
+	expected := samples
+
+	if err := gb.Restore(snap); err != nil {
+		t.Fatal(err)
+	}
+	samples = nil
+	gb.StepFrame()
+	gb.StepFrame()
+
+	if len(expected) == 0 {
+		t.Fatal("expected samples")
+	}
+	if !reflect.DeepEqual(samples, expected) {
+		t.Error("expected restored run to produce the same samples")
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	rom := newTestCartROM(4, 0x1B, 0x02)
+	copy(rom[0x100:], []byte{
+		0x3E, 0x0A, // ld a, $0a
+		0xEA, 0x00, 0x00, // ld ($0000), a
+		0x21, 0x00, 0xA0, // ld hl, $a000
+		0x34,       // inc (hl)
+		0x18, 0xFD, // jr $0108
+	})
+	cart, err := NewCartridge(rom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gb := NewMachine(cart, false)
+	for i := 0; i < 10; i++ {
+		gb.Step()
+	}
+
+	snap, err := gb.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, counter := gb.GetCPUState(), gb.Read(0xA000)
+
+	for i := 0; i < 100; i++ {
+		gb.Step()
+	}
+	gb.Write(0xC000, 0x55)
+
+	// Restore twice, to check the snapshot is not modified.
+	for i := 0; i < 2; i++ {
+		if err := gb.Restore(snap); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(gb.GetCPUState(), state) {
+			t.Errorf("expected CPU state %+v, got %+v", state, gb.GetCPUState())
+		}
+		if v := gb.Read(0xA000); v != counter {
+			t.Errorf("expected cartridge RAM %02x, got %02x", counter, v)
+		}
+		if v := gb.Read(0xC000); v == 0x55 {
+			t.Error("expected work RAM to be restored")
+		}
+		for i := 0; i < 100; i++ {
+			gb.Step()
+		}
+	}
+}
+
+func TestReset(t *testing.T) {
+	rom := newTestCartROM(4, 0x1B, 0x03)
+	copy(rom[0x100:], []byte{
+		0x3E, 0x0A, // ld a, $0a
+		0xEA, 0x00, 0x00, // ld ($0000), a
+		0x3E, 0x03, // ld a, $03
+		0xEA, 0x00, 0x20, // ld ($2000), a
+		0x3E, 0x02, // ld a, $02
+		0xEA, 0x00, 0x40, // ld ($4000), a
+		0x3E, 0x42, // ld a, $42
+		0xEA, 0x00, 0xA0, // ld ($a000), a
+		0x18, 0xFE, // jr -2
+	})
+	cart, err := NewCartridge(rom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gb := NewMachine(cart, false)
+	for i := 0; i < 20; i++ {
+		gb.Step()
+	}
+	gb.Write(0xC000, 0x55)
+
+	if state := gb.CartridgeState(); state != (CartridgeState{3, 2}) {
+		t.Fatalf("expected banks {3 2} before reset, got %+v", state)
+	}
+
+	gb.Reset()
+
+	if state := gb.CartridgeState(); state != (CartridgeState{ROMBank: 1}) {
+		t.Errorf("expected banks {1 0} after reset, got %+v", state)
+	}
+	if pc := gb.GetCPUState().PC; pc != 0x0100 {
+		t.Errorf("expected pc=0100 after reset, got %04x", pc)
+	}
+	if v := gb.Read(0xC000); v != 0x00 {
+		t.Errorf("expected work RAM to be cleared, got %02x", v)
+	}
+	if v := gb.Read(0xA000); v != 0xFF {
+		t.Errorf("expected cartridge RAM to be disabled, got %02x", v)
+	}
+
+	gb.Write(0x0000, 0x0A)
+	gb.Write(0x4000, 0x02)
+	if v := gb.Read(0xA000); v != 0x42 {
+		t.Errorf("expected cartridge RAM to survive reset, got %02x", v)
+	}
+}
@@ -0,0 +1,102 @@
+package gameboy
+
+import "fmt"
+
+// MemoryByte is a single byte of memory at a given address.
+type MemoryByte struct {
+	Addr  uint16
+	Value uint8
+}
+
+// CPUState contains the full architectural state of the CPU.
+type CPUState struct {
+	A, F uint8
+	B, C uint8
+	D, E uint8
+	H, L uint8
+
+	SP uint16
+	PC uint16
+
+	IME bool
+	IE  uint8
+
+	// RAM contains the bytes of memory relevant to the state. When setting
+	// state, each byte is written through the bus. When getting state, the
+	// addresses given in the last call to SetCPUState are read back.
+	RAM []MemoryByte
+}
+
+// SetCPUState sets the CPU registers and writes the given bytes to memory.
+func (gb *Machine) SetCPUState(s CPUState) {
+	gb.cpu.a, gb.cpu.f = s.A, s.F&0xf0
+	gb.cpu.b, gb.cpu.c = s.B, s.C
+	gb.cpu.d, gb.cpu.e = s.D, s.E
+	gb.cpu.h, gb.cpu.l = s.H, s.L
+	gb.cpu.sp = s.SP
+	gb.cpu.pc = s.PC
+	gb.cpu.ime = s.IME
+	gb.cpu.imeScheduled = false
+	gb.cpu.ie = s.IE
+
+	gb.stateAddrs = gb.stateAddrs[:0]
+	for _, b := range s.RAM {
+		gb.bus.Write(b.Addr, b.Value)
+		gb.stateAddrs = append(gb.stateAddrs, b.Addr)
+	}
+}
+
+// GetCPUState returns the CPU registers and the memory at the addresses
+// passed to the last call to SetCPUState.
+func (gb *Machine) GetCPUState() CPUState {
+	s := CPUState{
+		A: gb.cpu.a, F: gb.cpu.f,
+		B: gb.cpu.b, C: gb.cpu.c,
+		D: gb.cpu.d, E: gb.cpu.e,
+		H: gb.cpu.h, L: gb.cpu.l,
+
+		SP: gb.cpu.sp,
+		PC: gb.cpu.pc,
+
+		IME: gb.cpu.ime,
+		IE:  gb.cpu.ie,
+	}
+
+	for _, addr := range gb.stateAddrs {
+		s.RAM = append(s.RAM, MemoryByte{addr, gb.bus.Read(addr)})
+	}
+
+	return s
+}
+
+// CPUIdle returns whether the CPU is halted, waiting for an interrupt, or
+// stopped, waiting for a button press.
+func (gb *Machine) CPUIdle() (halted, stopped bool) {
+	return gb.cpu.halt, gb.cpu.stop
+}
+
+// LoadVRAM copies data to the start of video RAM, bypassing the bus and PPU
+// access timing. On CGB, data may hold both 8 KiB banks.
+func (gb *Machine) LoadVRAM(data []byte) error {
+	return loadRegion("VRAM", gb.ppu.vram[:], data)
+}
+
+// LoadOAM copies data to the start of OAM, bypassing the bus, PPU access
+// timing and OAM DMA.
+func (gb *Machine) LoadOAM(data []byte) error {
+	return loadRegion("OAM", gb.ppu.oam[:], data)
+}
+
+// LoadWRAM copies data to the start of work RAM, bypassing the bus.
+func (gb *Machine) LoadWRAM(data []byte) error {
+	return loadRegion("WRAM", gb.wram[:], data)
+}
+
+// loadRegion copies data into a memory region, if it fits.
+func loadRegion(name string, region, data []byte) error {
+	if len(data) > len(region) {
+		return fmt.Errorf("%s holds %d bytes, got %d", name, len(region), len(data))
+	}
+	copy(region, data)
+	return nil
+}
@@ -0,0 +1,235 @@
+package gameboy
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// busAccess is a single read or write seen on the bus.
+type busAccess struct {
+	addr  uint16
+	value uint8
+	write bool
+}
+
+// flatRAM is a 64 KiB RAM that covers the whole address space, as assumed by
+// the SingleStepTests vectors. Accesses are recorded while record is set.
+type flatRAM struct {
+	mem [0x10000]byte
+
+	record   bool
+	accesses []busAccess
+}
+
+func (ram *flatRAM) Read(addr uint16) uint8 {
+	if ram.record {
+		ram.accesses = append(ram.accesses, busAccess{addr, ram.mem[addr], false})
+	}
+	return ram.mem[addr]
+}
+
+func (ram *flatRAM) Write(addr uint16, value uint8) {
+	if ram.record {
+		ram.accesses = append(ram.accesses, busAccess{addr, value, true})
+	}
+	ram.mem[addr] = value
+}
+
+// newFlatMachine creates a machine with RAM mapped to every address except
+// the interrupt enable register.
+func newFlatMachine() (*Machine, *flatRAM) {
+	gb := NewMachine(ROM(nil), false)
+
+	ram := &flatRAM{}
+	for i := 0x0000; i < 0xFFFF; i++ {
+		gb.bus.io[i] = ram
+	}
+
+	return gb, ram
+}
+
+// jsmooState is a CPU state in the SingleStepTests (jsmoo) JSON format.
+type jsmooState struct {
+	PC  uint16      `json:"pc"`
+	SP  uint16      `json:"sp"`
+	A   uint8       `json:"a"`
+	B   uint8       `json:"b"`
+	C   uint8       `json:"c"`
+	D   uint8       `json:"d"`
+	E   uint8       `json:"e"`
+	F   uint8       `json:"f"`
+	H   uint8       `json:"h"`
+	L   uint8       `json:"l"`
+	IME uint8       `json:"ime"`
+	IE  uint8       `json:"ie"`
+	RAM [][2]uint16 `json:"ram"`
+}
+
+// cpuState converts the vector state to a CPUState. The vectors are taken
+// with the opcode already prefetched, so PC is one past the opcode.
+func (s jsmooState) cpuState() CPUState {
+	c := CPUState{
+		A: s.A, F: s.F,
+		B: s.B, C: s.C,
+		D: s.D, E: s.E,
+		H: s.H, L: s.L,
+
+		SP: s.SP,
+		PC: s.PC - 1,
+
+		IME: s.IME != 0,
+		IE:  s.IE,
+	}
+
+	for _, b := range s.RAM {
+		c.RAM = append(c.RAM, MemoryByte{b[0], uint8(b[1])})
+	}
+
+	return c
+}
+
+func TestCPUStateVector(t *testing.T) {
+	const vector = `{
+		"name": "80 0000",
+		"initial": {
+			"pc": 4097, "sp": 53248,
+			"a": 58, "b": 198, "c": 0, "d": 0, "e": 0, "f": 0, "h": 0, "l": 0,
+			"ime": 0, "ie": 0,
+			"ram": [[4096, 128], [4097, 0]]
+		},
+		"final": {
+			"pc": 4098, "sp": 53248,
+			"a": 0, "b": 198, "c": 0, "d": 0, "e": 0, "f": 176, "h": 0, "l": 0,
+			"ime": 0, "ie": 0,
+			"ram": [[4096, 128], [4097, 0]]
+		},
+		"cycles": [[4097, 0, "r-m"]]
+	}`
+
+	var test struct {
+		Name    string     `json:"name"`
+		Initial jsmooState `json:"initial"`
+		Final   jsmooState `json:"final"`
+	}
+	if err := json.Unmarshal([]byte(vector), &test); err != nil {
+		t.Fatal(err)
+	}
+
+	gb, _ := newFlatMachine()
+	gb.SetCPUState(test.Initial.cpuState())
+	gb.Step()
+
+	expect := test.Final.cpuState()
+	actual := gb.GetCPUState()
+
+	expect.RAM, actual.RAM = nil, nil
+	if !reflect.DeepEqual(actual, expect) {
+		t.Errorf("%s: expected state %+v, got %+v", test.Name, expect, actual)
+	}
+
+	for _, b := range test.Final.cpuState().RAM {
+		if v := gb.Read(b.Addr); v != b.Value {
+			t.Errorf("%s: expected (%04x)=%02x, got %02x", test.Name, b.Addr, b.Value, v)
+		}
+	}
+}
+
+func TestCPUIdle(t *testing.T) {
+	gb := NewMachine(newTestROM(
+		0x3E, 0x01, // ld a, $01
+		0xE0, 0xFF, // ldh (ie), a
+		0xAF,       // xor a
+		0xE0, 0x0F, // ldh (if), a
+		0xFB, // ei
+		0x76, // halt
+		0x10, // stop
+	), false)
+
+	for i := 0; i < 5; i++ {
+		gb.Step()
+	}
+	if halted, stopped := gb.CPUIdle(); halted || stopped {
+		t.Fatalf("expected running before halt, got halted=%v stopped=%v", halted, stopped)
+	}
+
+	gb.Step()
+	steps := 0
+	for {
+		halted, stopped := gb.CPUIdle()
+		if stopped {
+			t.Fatal("expected not stopped while halted")
+		}
+		if !halted {
+			break
+		}
+		if steps++; steps > 100000 {
+			t.Fatal("expected VBlank interrupt to wake the CPU")
+		}
+		gb.Step()
+	}
+	if steps < 2 {
+		t.Errorf("expected the CPU to stay halted until VBlank, woke after %d steps", steps)
+	}
+	gb.Step()
+	if gb.cpu.irq&intVBlank != 0 {
+		t.Error("expected VBlank interrupt to be serviced")
+	}
+
+	gb.cpu.pc = 0x0109
+	gb.Step()
+	if halted, stopped := gb.CPUIdle(); halted || !stopped {
+		t.Errorf("expected stopped after stop, got halted=%v stopped=%v", halted, stopped)
+	}
+}
+
+func TestLoadVRAMAndOAM(t *testing.T) {
+	// Tile 1 has stripes of colors 1 and 2, and tile 2 is solid color 3.
+	vram := make([]byte, 0x2000)
+	for row := 0; row < 8; row++ {
+		vram[0x10+row*2], vram[0x10+row*2+1] = 0xAA, 0x55
+		vram[0x20+row*2], vram[0x20+row*2+1] = 0xFF, 0xFF
+	}
+
+	// A checkerboard of tile 1 and tile 0 in the BG map.
+	for i := 0; i < 32*32; i++ {
+		vram[0x1800+i] = uint8((i + i/32) % 2)
+	}
+
+	// Two objects using tile 2.
+	oam := []byte{
+		40, 40, 2, 0x00,
+		80, 100, 2, 0x10,
+	}
+
+	gb := newPPUTestMachine(0x93)
+	gb.Write(0xFF47, 0xE4)
+	gb.Write(0xFF48, 0xE4)
+	gb.Write(0xFF49, 0x1B)
+	if err := gb.LoadVRAM(vram); err != nil {
+		t.Fatal(err)
+	}
+	if err := gb.LoadOAM(oam); err != nil {
+		t.Fatal(err)
+	}
+	gb.RunFrames(2, nil)
+
+	const want = 0x80c0f0dee50ccc65
+	if hash := gb.FrameHash(); hash != want {
+		t.Errorf("expected frame hash %016x, got %016x", uint64(want), hash)
+	}
+	if got := pixelAt(gb, 32, 24); got != 3 {
+		t.Errorf("expected object at (32, 24), got shade %d", got)
+	}
+
+	if err := gb.LoadWRAM([]byte{0x12, 0x34}); err != nil {
+		t.Fatal(err)
+	}
+	if v := gb.Read(0xC001); v != 0x34 {
+		t.Errorf("expected ($c001)=34, got %02x", v)
+	}
+
+	if err := gb.LoadOAM(make([]byte, 161)); err == nil {
+		t.Error("expected error for oversized OAM data")
+	}
+}
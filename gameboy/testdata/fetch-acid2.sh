@@ -0,0 +1,8 @@
+#!/bin/sh
+# Fetches the dmg-acid2 test ROM and its reference image, used by TestAcid2.
+# dmg-acid2 is by Matt Currie, under the MIT license:
+# https://github.com/mattcurrie/dmg-acid2
+set -e
+cd "$(dirname "$0")"
+curl -fsSL -o dmg-acid2.gb https://github.com/mattcurrie/dmg-acid2/releases/download/v1.0/dmg-acid2.gb
+curl -fsSL -o dmg-acid2.png https://raw.githubusercontent.com/mattcurrie/dmg-acid2/master/img/reference-dmg.png
@@ -0,0 +1,9 @@
+#!/bin/sh
+# Fetches a subset of the SM83 SingleStepTests vectors, used by TestSingleStep:
+# https://github.com/SingleStepTests/sm83
+set -e
+cd "$(dirname "$0")"
+mkdir -p sm83
+for op in 00 04 05 3e 77 7e 80 90 a8 c1 c5 c9 cd ea "cb 37"; do
+	curl -fsSL -o "sm83/$op.json" "https://raw.githubusercontent.com/SingleStepTests/sm83/main/v1/$(echo "$op" | sed 's/ /%20/').json"
+done
@@ -0,0 +1,79 @@
+package gameboy
+
+import (
+	"log"
+	"sort"
+)
+
+// UnimplementedAccess summarizes the accesses to an I/O register that the
+// emulator does not implement.
+type UnimplementedAccess struct {
+	Addr   uint16
+	Reads  int
+	Writes int
+
+	// Address of the instruction that first accessed the register
+	PC uint16
+}
+
+// unimplementedIO handles I/O registers the emulator does not implement.
+// Reads return 0xFF and writes are ignored. When tracking is enabled, accesses
+// are counted and the first access to each register is logged.
+type unimplementedIO struct {
+	gb       *Machine
+	tracking bool
+	accesses map[uint16]*UnimplementedAccess
+}
+
+func (u *unimplementedIO) record(addr uint16, write bool) {
+	if !u.tracking {
+		return
+	}
+
+	access, ok := u.accesses[addr]
+	if !ok {
+		access = &UnimplementedAccess{Addr: addr, PC: u.gb.cpu.oppc}
+		u.accesses[addr] = access
+		log.Printf("unimplemented register $%04x accessed at $%04x", addr, access.PC)
+	}
+
+	if write {
+		access.Writes++
+	} else {
+		access.Reads++
+	}
+}
+
+func (u *unimplementedIO) Read(addr uint16) uint8 {
+	u.record(addr, false)
+	return 0xFF
+}
+
+func (u *unimplementedIO) Write(addr uint16, value uint8) {
+	u.record(addr, true)
+}
+
+// SetUnimplementedAccessTracking enables or disables tracking of accesses to
+// unimplemented I/O registers, such as the serial port. Enabling tracking
+// clears the report.
+func (gb *Machine) SetUnimplementedAccessTracking(enabled bool) {
+	gb.unimplemented.tracking = enabled
+	if enabled {
+		gb.unimplemented.accesses = map[uint16]*UnimplementedAccess{}
+	}
+}
+
+// UnimplementedAccessReport returns the accesses to unimplemented I/O
+// registers since tracking was enabled, ordered by address.
+func (gb *Machine) UnimplementedAccessReport() []UnimplementedAccess {
+	report := make([]UnimplementedAccess, 0, len(gb.unimplemented.accesses))
+	for _, access := range gb.unimplemented.accesses {
+		report = append(report, *access)
+	}
+
+	sort.Slice(report, func(i, j int) bool {
+		return report[i].Addr < report[j].Addr
+	})
+
+	return report
+}
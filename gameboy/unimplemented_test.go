@@ -0,0 +1,34 @@
+package gameboy
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestUnimplementedAccessReport(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	// ld a, $41; ldh ($01), a; ld a, $81; ldh ($02), a; ldh a, ($02); jr -2
+	gb := NewMachine(newTestROM(0x3E, 0x41, 0xE0, 0x01, 0x3E, 0x81, 0xE0, 0x02, 0xF0, 0x02, 0x18, 0xFE), false)
+	gb.SetUnimplementedAccessTracking(true)
+
+	for i := 0; i < 6; i++ {
+		gb.Step()
+	}
+
+	expected := []UnimplementedAccess{
+		{Addr: 0xFF01, Writes: 1, PC: 0x0102},
+		{Addr: 0xFF02, Reads: 1, Writes: 1, PC: 0x0106},
+	}
+	if report := gb.UnimplementedAccessReport(); !reflect.DeepEqual(report, expected) {
+		t.Errorf("expected %+v, got %+v", expected, report)
+	}
+
+	if value := gb.Read(0xFF01); value != 0xFF {
+		t.Errorf("expected unimplemented register to read $ff, got $%02x", value)
+	}
+}